@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -21,6 +22,9 @@ func main() {
 	if err != nil {
 		log.Println(err)
 	}
+	messageDB.StartMediaWorker(2)
+	messageDB.StartScheduler(5 * time.Second)
+	messageDB.StartReaper(time.Minute)
 	ser := server.NewServer(addr, userDB, messageDB)
 	ser.Run()
 }
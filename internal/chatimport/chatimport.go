@@ -0,0 +1,173 @@
+// Package chatimport reads chat history exported from other messengers,
+// WhatsApp text or zip exports and Telegram JSON exports.
+package chatimport
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	SourceWhatsApp = "whatsapp"
+	SourceTelegram = "telegram"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unrecognized chat export")
+	ErrEmpty         = errors.New("chat export contains no messages")
+	ErrMediaNotFound = errors.New("media file not found in archive")
+)
+
+// Sender is an author as named in the export, ID is stable within one export
+// and equal to the name when the format has no separate id
+type Sender struct {
+	ID   string
+	Name string
+}
+
+type Message struct {
+	SenderID string
+	Time     time.Time
+	Body     string
+	// path of an attached file inside the archive, empty without media
+	Media string
+}
+
+type Chat struct {
+	Source   string
+	Title    string
+	Senders  []Sender // in order of first appearance
+	Messages []Message
+}
+
+// Archive is an opened export, media files can be read while it is open
+type Archive struct {
+	Chat  *Chat
+	zip   *zip.ReadCloser
+	files map[string]*zip.File
+	base  string
+}
+
+// Open parses the export stored at filePath, which may be a zip archive, a
+// WhatsApp chat text file or a Telegram result.json. WhatsApp timestamps
+// carry no zone and are read in loc.
+func Open(filePath string, loc *time.Location) (*Archive, error) {
+	if zr, err := zip.OpenReader(filePath); err == nil {
+		archive, err := openZip(zr, loc)
+		if err != nil {
+			zr.Close()
+			return nil, err
+		}
+		return archive, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chat, err := parse(bufio.NewReader(f), loc)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{Chat: chat}, nil
+}
+
+func openZip(zr *zip.ReadCloser, loc *time.Location) (*Archive, error) {
+	archive := &Archive{zip: zr, files: map[string]*zip.File{}}
+	var chatFile *zip.File
+	for _, f := range zr.File {
+		name := path.Clean(f.Name)
+		archive.files[name] = f
+		base := path.Base(name)
+		switch {
+		case base == "result.json":
+			chatFile = f
+		case chatFile == nil && strings.HasSuffix(strings.ToLower(base), ".txt"):
+			chatFile = f
+		case base == "_chat.txt":
+			chatFile = f
+		}
+	}
+	if chatFile == nil {
+		return nil, ErrUnknownFormat
+	}
+	archive.base = path.Dir(path.Clean(chatFile.Name))
+
+	rc, err := chatFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	chat, err := parse(bufio.NewReader(rc), loc)
+	if err != nil {
+		return nil, err
+	}
+	archive.Chat = chat
+	return archive, nil
+}
+
+// parse tells the formats apart by their first non blank character
+func parse(r *bufio.Reader, loc *time.Location) (*Chat, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, ErrUnknownFormat
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+			continue
+		case '{':
+			return ParseTelegram(r)
+		}
+		return ParseWhatsApp(r, loc)
+	}
+}
+
+// OpenMedia opens a file referenced by a message, paths are relative to the
+// directory holding the chat file
+func (a *Archive) OpenMedia(name string) (io.ReadCloser, int64, error) {
+	if a.zip == nil {
+		return nil, 0, ErrMediaNotFound
+	}
+	f, ok := a.files[path.Join(a.base, path.Clean("/" + name)[1:])]
+	if !ok {
+		return nil, 0, ErrMediaNotFound
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, int64(f.UncompressedSize64), nil
+}
+
+func (a *Archive) Close() error {
+	if a.zip == nil {
+		return nil
+	}
+	return a.zip.Close()
+}
+
+// senders collects the distinct authors of a chat while it is parsed
+type senders struct {
+	list []Sender
+	seen map[string]bool
+}
+
+func (s *senders) add(id string, name string) {
+	if s.seen == nil {
+		s.seen = map[string]bool{}
+	}
+	if s.seen[id] {
+		return
+	}
+	s.seen[id] = true
+	s.list = append(s.list, Sender{ID: id, Name: name})
+}
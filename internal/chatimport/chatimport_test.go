@@ -0,0 +1,138 @@
+package chatimport
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeZip(t *testing.T, files [][2]string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "export.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, file := range files {
+		w, err := zw.Create(file[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, file[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestOpenZip(t *testing.T) {
+	chatText, err := os.ReadFile("testdata/whatsapp_ios.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := writeZip(t, [][2]string{
+		{"secret.txt", "outside the chat directory"},
+		{"WhatsApp Chat - Bob/readme.txt", "not the chat"},
+		{"WhatsApp Chat - Bob/_chat.txt", string(chatText)},
+		{"WhatsApp Chat - Bob/00000004-PHOTO-2021-03-14-12-15-00.jpg", "jpeg bytes"},
+	})
+	archive, err := Open(name, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if n := len(archive.Chat.Messages); n != 5 {
+		t.Fatalf("got %d messages, want 5", n)
+	}
+	media := archive.Chat.Messages[2].Media
+	rc, size, err := archive.OpenMedia(media)
+	if err != nil {
+		t.Fatalf("OpenMedia(%q): %v", media, err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "jpeg bytes" || size != int64(len(data)) {
+		t.Errorf("media = %q with size %d", data, size)
+	}
+
+	// paths are resolved inside the chat's directory only
+	for _, name := range []string{"../secret.txt", "/secret.txt", "missing.jpg"} {
+		if _, _, err := archive.OpenMedia(name); err != ErrMediaNotFound {
+			t.Errorf("OpenMedia(%q) = %v, want %v", name, err, ErrMediaNotFound)
+		}
+	}
+}
+
+func TestOpenTelegramZip(t *testing.T) {
+	export, err := os.ReadFile("testdata/telegram.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := writeZip(t, [][2]string{
+		{"ChatExport_2021-03-14/result.json", string(export)},
+		{"ChatExport_2021-03-14/photos/photo_1@14-03-2021_09-03-00.jpg", "photo"},
+	})
+	archive, err := Open(name, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if archive.Chat.Source != SourceTelegram {
+		t.Errorf("source = %q", archive.Chat.Source)
+	}
+	rc, _, err := archive.OpenMedia(archive.Chat.Messages[2].Media)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+}
+
+func TestOpen(t *testing.T) {
+	for _, fixture := range []string{"whatsapp_ios.txt", "whatsapp_android.txt", "telegram.json"} {
+		archive, err := Open("testdata/"+fixture, time.UTC)
+		if err != nil {
+			t.Errorf("Open(%s): %v", fixture, err)
+			continue
+		}
+		if len(archive.Chat.Messages) == 0 {
+			t.Errorf("Open(%s) found no messages", fixture)
+		}
+		// plain files carry no media
+		if _, _, err := archive.OpenMedia("anything.jpg"); err != ErrMediaNotFound {
+			t.Errorf("OpenMedia on %s = %v", fixture, err)
+		}
+		archive.Close()
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		err     error
+	}{
+		{"blank", " \n\t\n", ErrUnknownFormat},
+		{"text without messages", "just some notes\nnothing else\n", ErrEmpty},
+		{"zip without a chat", "", ErrUnknownFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "export")
+			if tt.content == "" {
+				name = writeZip(t, [][2]string{{"photo.jpg", "jpeg"}})
+			} else if err := os.WriteFile(name, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(name, time.UTC); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
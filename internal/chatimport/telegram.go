@@ -0,0 +1,106 @@
+package chatimport
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type telegramExport struct {
+	Name     string            `json:"name"`
+	Messages []telegramMessage `json:"messages"`
+}
+
+type telegramMessage struct {
+	Type         string          `json:"type"`
+	Date         string          `json:"date"`
+	DateUnixtime string          `json:"date_unixtime"`
+	From         string          `json:"from"`
+	FromID       string          `json:"from_id"`
+	Text         json.RawMessage `json:"text"`
+	Photo        string          `json:"photo"`
+	File         string          `json:"file"`
+}
+
+// ParseTelegram reads the result.json of a Telegram Desktop chat export.
+// Service messages (joins, pins, calls) are skipped.
+func ParseTelegram(r io.Reader) (*Chat, error) {
+	var export telegramExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, ErrUnknownFormat
+	}
+
+	chat := &Chat{Source: SourceTelegram, Title: export.Name}
+	var authors senders
+	for _, m := range export.Messages {
+		if m.Type != "message" {
+			continue
+		}
+		t, err := telegramTime(m)
+		if err != nil {
+			return nil, err
+		}
+		id := m.FromID
+		if id == "" {
+			id = m.From
+		}
+		message := Message{SenderID: id, Time: t, Body: telegramText(m.Text), Media: m.Photo}
+		if message.Media == "" {
+			message.Media = m.File
+		}
+		// exports made without media keep a placeholder instead of the path
+		if strings.HasPrefix(message.Media, "(") {
+			message.Media = ""
+		}
+		authors.add(id, m.From)
+		chat.Messages = append(chat.Messages, message)
+	}
+	if len(chat.Messages) == 0 {
+		return nil, ErrEmpty
+	}
+	chat.Senders = authors.list
+	return chat, nil
+}
+
+// telegramTime prefers the unix timestamp, older exports only have the local
+// wall clock time of the exporting machine
+func telegramTime(m telegramMessage) (time.Time, error) {
+	if m.DateUnixtime != "" {
+		seconds, err := strconv.ParseInt(m.DateUnixtime, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	return time.Parse("2006-01-02T15:04:05", m.Date)
+}
+
+// telegramText flattens the text field, which is either a plain string or a
+// list of strings and formatted pieces like {"type": "bold", "text": "..."}
+func telegramText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var pieces []json.RawMessage
+	if err := json.Unmarshal(raw, &pieces); err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, piece := range pieces {
+		var plain string
+		if err := json.Unmarshal(piece, &plain); err == nil {
+			b.WriteString(plain)
+			continue
+		}
+		var entity struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(piece, &entity); err == nil {
+			b.WriteString(entity.Text)
+		}
+	}
+	return b.String()
+}
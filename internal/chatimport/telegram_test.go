@@ -0,0 +1,73 @@
+package chatimport
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTelegram(t *testing.T) {
+	f, err := os.Open("testdata/telegram.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	chat, err := ParseTelegram(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chat.Source != SourceTelegram || chat.Title != "Project Chat" {
+		t.Errorf("source %q, title %q", chat.Source, chat.Title)
+	}
+	// a sender keeps the name they first appeared with
+	wantSenders := []Sender{{ID: "user1", Name: "Erin"}, {ID: "user2", Name: "Frank"}}
+	if !reflect.DeepEqual(chat.Senders, wantSenders) {
+		t.Errorf("senders = %+v, want %+v", chat.Senders, wantSenders)
+	}
+	// the unix time wins over the wall clock date, the service message is
+	// skipped and the placeholder of a file left out of the export is no media
+	want := []Message{
+		{SenderID: "user1", Time: time.Date(2021, 3, 14, 9, 1, 0, 0, time.UTC), Body: "Hello team"},
+		{SenderID: "user2", Time: time.Date(2021, 3, 14, 9, 2, 0, 0, time.UTC), Body: "See this and https://example.com"},
+		{
+			SenderID: "user1",
+			Time:     time.Date(2021, 3, 14, 9, 3, 0, 0, time.UTC),
+			Body:     "Photo caption",
+			Media:    "photos/photo_1@14-03-2021_09-03-00.jpg",
+		},
+		{SenderID: "user2", Time: time.Date(2021, 3, 14, 9, 4, 0, 0, time.UTC)},
+		{SenderID: "user2", Time: time.Date(2021, 3, 14, 9, 5, 0, 0, time.UTC), Body: "old export"},
+	}
+	if len(chat.Messages) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(chat.Messages), len(want))
+	}
+	for i := range want {
+		got := chat.Messages[i]
+		if got.SenderID != want[i].SenderID || !got.Time.Equal(want[i].Time) ||
+			got.Body != want[i].Body || got.Media != want[i].Media {
+			t.Errorf("message %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestParseTelegramRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		export string
+		err    error
+	}{
+		{"not json", "{not json", ErrUnknownFormat},
+		{"no messages", `{"name": "x", "messages": []}`, ErrEmpty},
+		{"only service messages", `{"messages": [{"type": "service", "date": "2021-03-14T09:00:00"}]}`, ErrEmpty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseTelegram(strings.NewReader(tt.export)); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package chatimport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iOS exports look like "[31/12/20, 11:59:59 PM] Name: text", Android ones
+// like "31/12/20, 23:59 - Name: text"
+var (
+	whatsAppIOSLine      = regexp.MustCompile(`^\[(\d{1,4}[./-]\d{1,2}[./-]\d{1,4}),? (\d{1,2}[:.]\d{2}(?:[:.]\d{2})?(?: ?[AaPp]\.? ?[Mm]\.?)?)\] (.*)$`)
+	whatsAppAndroidLine  = regexp.MustCompile(`^(\d{1,4}[./-]\d{1,2}[./-]\d{1,4}),? (\d{1,2}[:.]\d{2}(?:[:.]\d{2})?(?: ?[AaPp]\.? ?[Mm]\.?)?) - (.*)$`)
+	whatsAppIOSMedia     = regexp.MustCompile(`^<attached: ([^>]+)>$`)
+	whatsAppAndroidMedia = regexp.MustCompile(`^(.+?) \(file attached\)$`)
+	dateSeparators       = regexp.MustCompile(`[./-]`)
+)
+
+// invisible marks WhatsApp puts around names and timestamps
+var whatsAppCleaner = strings.NewReplacer("\u200e", "", "\u200f", "", "\ufeff", "", "\u202f", " ", "\u00a0", " ")
+
+type whatsAppLine struct {
+	date, clock string
+	sender      string
+	body        string
+}
+
+// ParseWhatsApp reads a chat text export. Lines without a "Name: " prefix
+// are WhatsApp notices and skipped. The date order (day or month first)
+// depends on the exporting phone's locale and is guessed from the dates.
+func ParseWhatsApp(r io.Reader, loc *time.Location) (*Chat, error) {
+	var lines []whatsAppLine
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		text := whatsAppCleaner.Replace(scanner.Text())
+		match := whatsAppIOSLine.FindStringSubmatch(text)
+		if match == nil {
+			match = whatsAppAndroidLine.FindStringSubmatch(text)
+		}
+		if match == nil {
+			// continuation of a multi line message
+			if len(lines) > 0 {
+				lines[len(lines)-1].body += "\n" + text
+			}
+			continue
+		}
+		line := whatsAppLine{date: match[1], clock: match[2]}
+		if sender, body, ok := strings.Cut(match[3], ": "); ok {
+			line.sender = strings.TrimSpace(sender)
+			line.body = body
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	dayFirst := guessDayFirst(lines)
+	chat := &Chat{Source: SourceWhatsApp}
+	var authors senders
+	for _, line := range lines {
+		if line.sender == "" {
+			continue
+		}
+		t, err := parseWhatsAppTime(line.date, line.clock, dayFirst, loc)
+		if err != nil {
+			return nil, err
+		}
+		message := Message{SenderID: line.sender, Time: t, Body: line.body}
+		first, rest, _ := strings.Cut(line.body, "\n")
+		if media := whatsAppIOSMedia.FindStringSubmatch(first); media != nil {
+			message.Media, message.Body = media[1], strings.TrimSpace(rest)
+		} else if media := whatsAppAndroidMedia.FindStringSubmatch(first); media != nil {
+			message.Media, message.Body = media[1], strings.TrimSpace(rest)
+		}
+		authors.add(line.sender, line.sender)
+		chat.Messages = append(chat.Messages, message)
+	}
+	if len(chat.Messages) == 0 {
+		return nil, ErrEmpty
+	}
+	chat.Senders = authors.list
+	return chat, nil
+}
+
+func dateParts(date string) []int {
+	fields := dateSeparators.Split(date, -1)
+	parts := make([]int, len(fields))
+	for i, field := range fields {
+		parts[i], _ = strconv.Atoi(field)
+	}
+	return parts
+}
+
+// guessDayFirst looks for a date component above 12, which can only be a
+// day. Without one the day first order of most locales is assumed.
+func guessDayFirst(lines []whatsAppLine) bool {
+	for _, line := range lines {
+		parts := dateParts(line.date)
+		if len(parts) != 3 || parts[0] > 31 {
+			continue
+		}
+		if parts[0] > 12 {
+			return true
+		}
+		if parts[1] > 12 {
+			return false
+		}
+	}
+	return true
+}
+
+func parseWhatsAppTime(date string, clock string, dayFirst bool, loc *time.Location) (time.Time, error) {
+	parts := dateParts(date)
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("invalid date %q", date)
+	}
+	var year, month, day int
+	switch {
+	case parts[0] > 31:
+		year, month, day = parts[0], parts[1], parts[2]
+	case dayFirst:
+		day, month, year = parts[0], parts[1], parts[2]
+	default:
+		month, day, year = parts[0], parts[1], parts[2]
+	}
+	if year < 100 {
+		year += 2000
+	}
+
+	clock = strings.ToUpper(strings.NewReplacer(".", "", ":", "", " ", "").Replace(clock))
+	pm := strings.HasSuffix(clock, "PM")
+	am := strings.HasSuffix(clock, "AM")
+	clock = strings.TrimSuffix(strings.TrimSuffix(clock, "PM"), "AM")
+	// the separators were removed above, so the clock is now hmm, hhmm or hhmmss
+	var hour, minute, second int
+	switch len(clock) {
+	case 3, 4:
+		hour, _ = strconv.Atoi(clock[:len(clock)-2])
+		minute, _ = strconv.Atoi(clock[len(clock)-2:])
+	case 5, 6:
+		hour, _ = strconv.Atoi(clock[:len(clock)-4])
+		minute, _ = strconv.Atoi(clock[len(clock)-4 : len(clock)-2])
+		second, _ = strconv.Atoi(clock[len(clock)-2:])
+	default:
+		return time.Time{}, fmt.Errorf("invalid time %q", clock)
+	}
+	if pm && hour < 12 {
+		hour += 12
+	} else if am && hour == 12 {
+		hour = 0
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || minute > 59 || second > 59 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q %q", date, clock)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, loc), nil
+}
@@ -0,0 +1,149 @@
+package chatimport
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testZone = time.FixedZone("UTC+2", 2*60*60)
+
+func parseFixture(t *testing.T, name string) *Chat {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	chat, err := ParseWhatsApp(f, testZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chat
+}
+
+func TestParseWhatsAppIOS(t *testing.T) {
+	chat := parseFixture(t, "whatsapp_ios.txt")
+	if chat.Source != SourceWhatsApp {
+		t.Errorf("source = %q", chat.Source)
+	}
+	wantSenders := []Sender{{ID: "Alice Smith", Name: "Alice Smith"}, {ID: "Bob", Name: "Bob"}}
+	if !reflect.DeepEqual(chat.Senders, wantSenders) {
+		t.Errorf("senders = %+v, want %+v", chat.Senders, wantSenders)
+	}
+	// the encryption notice has no sender and is skipped
+	want := []Message{
+		{SenderID: "Alice Smith", Time: time.Date(2021, 3, 14, 9, 1, 5, 0, testZone), Body: "Morning!"},
+		{
+			SenderID: "Bob",
+			Time:     time.Date(2021, 3, 14, 9, 2, 10, 0, testZone),
+			Body:     "Are we still on for lunch?\nIt's at 12:30 PM: the usual place",
+		},
+		{
+			SenderID: "Alice Smith",
+			Time:     time.Date(2021, 3, 14, 12, 15, 0, 0, testZone),
+			Media:    "00000004-PHOTO-2021-03-14-12-15-00.jpg",
+		},
+		{
+			SenderID: "Bob",
+			Time:     time.Date(2021, 3, 14, 12, 16, 0, 0, testZone),
+			Body:     "look at this",
+			Media:    "00000005-VIDEO-2021-03-14-12-16-00.mp4",
+		},
+		{SenderID: "Alice Smith", Time: time.Date(2021, 3, 15, 0, 5, 30, 0, testZone), Body: "late night"},
+	}
+	if !reflect.DeepEqual(chat.Messages, want) {
+		t.Errorf("messages =\n%+v\nwant\n%+v", chat.Messages, want)
+	}
+}
+
+func TestParseWhatsAppAndroid(t *testing.T) {
+	chat := parseFixture(t, "whatsapp_android.txt")
+	wantSenders := []Sender{{ID: "Carol", Name: "Carol"}, {ID: "Dave", Name: "Dave"}}
+	if !reflect.DeepEqual(chat.Senders, wantSenders) {
+		t.Errorf("senders = %+v, want %+v", chat.Senders, wantSenders)
+	}
+	// 3/25/21 can only be month first, so 4/2/21 is the 2nd of April
+	want := []Message{
+		{
+			SenderID: "Carol",
+			Time:     time.Date(2021, 3, 25, 14, 6, 0, 0, testZone),
+			Body:     "Sunset from the hotel",
+			Media:    "IMG-20210325-WA0001.jpg",
+		},
+		{SenderID: "Dave", Time: time.Date(2021, 3, 25, 14, 7, 0, 0, testZone), Body: "Nice: really nice"},
+		{SenderID: "Dave", Time: time.Date(2021, 4, 2, 9, 30, 0, 0, testZone), Body: "<Media omitted>"},
+	}
+	if !reflect.DeepEqual(chat.Messages, want) {
+		t.Errorf("messages =\n%+v\nwant\n%+v", chat.Messages, want)
+	}
+}
+
+func TestGuessDayFirst(t *testing.T) {
+	tests := []struct {
+		name  string
+		dates []string
+		want  bool
+	}{
+		{"day above 12", []string{"14/03/21"}, true},
+		{"month first", []string{"3/25/21"}, false},
+		{"ambiguous", []string{"01/02/21", "03/04/21"}, true},
+		{"later date decides", []string{"01/02/21", "12/25/21"}, false},
+		{"year first is skipped", []string{"2021-03-25", "3/14/21"}, false},
+		{"dotted", []string{"31.12.20"}, true},
+		{"no dates", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := make([]whatsAppLine, len(tt.dates))
+			for i, date := range tt.dates {
+				lines[i].date = date
+			}
+			if got := guessDayFirst(lines); got != tt.want {
+				t.Errorf("guessDayFirst(%q) = %v, want %v", tt.dates, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWhatsAppTime(t *testing.T) {
+	tests := []struct {
+		date, clock string
+		dayFirst    bool
+		want        time.Time
+	}{
+		{"14/03/21", "9:00:00 AM", true, time.Date(2021, 3, 14, 9, 0, 0, 0, time.UTC)},
+		{"14/03/21", "12:05:30 AM", true, time.Date(2021, 3, 14, 0, 5, 30, 0, time.UTC)},
+		{"14/03/21", "12:05 PM", true, time.Date(2021, 3, 14, 12, 5, 0, 0, time.UTC)},
+		{"14/03/21", "1:05 p.m.", true, time.Date(2021, 3, 14, 13, 5, 0, 0, time.UTC)},
+		{"03/14/21", "11:59:59 pm", false, time.Date(2021, 3, 14, 23, 59, 59, 0, time.UTC)},
+		{"14.03.2021", "23.59", true, time.Date(2021, 3, 14, 23, 59, 0, 0, time.UTC)},
+		{"2021-03-14", "07:08:09", false, time.Date(2021, 3, 14, 7, 8, 9, 0, time.UTC)},
+		{"1/2/21", "0:00", true, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"1/2/21", "0:00", false, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseWhatsAppTime(tt.date, tt.clock, tt.dayFirst, time.UTC)
+		if err != nil {
+			t.Errorf("parseWhatsAppTime(%q, %q): %v", tt.date, tt.clock, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseWhatsAppTime(%q, %q) = %v, want %v", tt.date, tt.clock, got, tt.want)
+		}
+	}
+
+	invalid := []struct{ date, clock string }{
+		{"31/13/21", "10:00"},
+		{"14/03/21", "25:00"},
+		{"14/03/21", "10:61"},
+		{"14/03", "10:00"},
+		{"14/03/21", "1"},
+	}
+	for _, tt := range invalid {
+		if _, err := parseWhatsAppTime(tt.date, tt.clock, true, time.UTC); err == nil {
+			t.Errorf("parseWhatsAppTime(%q, %q) should fail", tt.date, tt.clock)
+		}
+	}
+}
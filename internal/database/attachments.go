@@ -0,0 +1,410 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/media"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+// MaxUploadSize is the largest file accepted by the upload endpoint
+const MaxUploadSize = 25 << 20
+
+type thumbnailSize struct {
+	name   string
+	maxDim int
+}
+
+// largest first so every size can be scaled from the previous one
+var thumbnailSizes = []thumbnailSize{
+	{name: "large", maxDim: 1024},
+	{name: "medium", maxDim: 320},
+	{name: "small", maxDim: 96},
+}
+
+func uploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return "uploads"
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UploadAttachment(
+	file io.Reader,
+	fileName string,
+	uploaderId string,
+	w http.ResponseWriter,
+) error {
+	data, err := io.ReadAll(io.LimitReader(file, MaxUploadSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxUploadSize {
+		return utils.WriteJson(
+			w,
+			http.StatusRequestEntityTooLarge,
+			utils.ApiError{ErrorMessage: "file is too large"},
+		)
+	}
+
+	attachment, err := writeUpload(data, fileName, uploaderId)
+	if errors.Is(err, errInvalidImage) {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: err.Error()},
+		)
+	} else if err != nil {
+		return err
+	}
+
+	if err := m.db.Create(attachment).Error; err != nil {
+		os.Remove(filepath.Join(uploadDir(), attachment.Path))
+		return err
+	}
+	if attachment.Status == AttachmentPending {
+		m.enqueueMedia(attachment.ID)
+	}
+
+	return utils.WriteJson(w, http.StatusCreated, attachmentInfo(*attachment))
+}
+
+var errInvalidImage = errors.New("invalid image file")
+
+// inlineContentTypes are the types ServeAttachment lets the browser render,
+// the images writeUpload sniffed and stripped itself
+var inlineContentTypes = map[string]bool{
+	media.ContentType(media.FormatJPEG): true,
+	media.ContentType(media.FormatPNG):  true,
+	media.ContentType(media.FormatGIF):  true,
+	media.ContentType(media.FormatWebP): true,
+}
+
+// writeUpload stores data in the upload directory and returns the attachment
+// row for it, not yet saved. Images are stored without their metadata and
+// queued for processing once the row exists.
+func writeUpload(data []byte, fileName string, uploaderID string) (*Attachment, error) {
+	attachment := &Attachment{
+		UploaderID:  uploaderID,
+		FileName:    filepath.Base(fileName),
+		ContentType: http.DetectContentType(data),
+		Status:      AttachmentReady,
+	}
+
+	format := media.Sniff(data)
+	if format != "" {
+		var err error
+		data, err = media.StripMetadata(format, data)
+		if err != nil {
+			return nil, errInvalidImage
+		}
+		attachment.Width, attachment.Height, err = media.Dimensions(format, data)
+		if err != nil {
+			return nil, errInvalidImage
+		}
+		// sizes are reported the way the image is displayed
+		if media.Orientation(format, data) >= 5 {
+			attachment.Width, attachment.Height = attachment.Height, attachment.Width
+		}
+		attachment.ContentType = media.ContentType(format)
+		if media.CanDecode(format) {
+			attachment.Status = AttachmentPending
+		}
+	}
+
+	attachment.Path = uuid.NewString() + filepath.Ext(attachment.FileName)
+	attachment.Size = int64(len(data))
+	if err := os.MkdirAll(uploadDir(), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir(), attachment.Path), data, 0o644); err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ServeAttachment(
+	attachmentID string,
+	size string,
+	userID string,
+	w http.ResponseWriter,
+	r *http.Request,
+) error {
+	var attachment Attachment
+	err := m.db.Preload("Thumbnails").First(&attachment, "id = ?", attachmentID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: "attachment not found"})
+	} else if err != nil {
+		return err
+	}
+
+	allowed, err := m.canReadAttachment(&attachment, userID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: "attachment not found"})
+	}
+
+	path := attachment.Path
+	if size != "" {
+		path = ""
+		for _, thumb := range attachment.Thumbnails {
+			if thumb.Size == size {
+				path = thumb.Path
+			}
+		}
+		if path == "" {
+			return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: "thumbnail not found"})
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+	} else if inlineContentTypes[attachment.ContentType] {
+		w.Header().Set("Content-Type", attachment.ContentType)
+		w.Header().Set(
+			"Content-Disposition",
+			fmt.Sprintf("inline; filename=%q", attachment.FileName),
+		)
+	} else {
+		// anything else, HTML or SVG included, would run on the API origin
+		// if rendered, so it is only ever downloaded
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(
+			"Content-Disposition",
+			fmt.Sprintf("attachment; filename=%q", attachment.FileName),
+		)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, filepath.Join(uploadDir(), path))
+	return nil
+}
+
+func (m *PostgresMessage) canReadAttachment(attachment *Attachment, userID string) (bool, error) {
+	if attachment.UploaderID == userID {
+		return true, nil
+	}
+	if attachment.MessageID == nil {
+		return false, nil
+	}
+	var count int64
+	err := m.db.Table("messages").
+		Joins("JOIN conversation_participants cp ON cp.conversation_id = messages.conversation_id").
+		Where("messages.id = ? AND cp.user_id = ?", *attachment.MessageID, userID).
+		Scopes(notExpired).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// attachUploads links uploads owned by the sender to a freshly created message
+func attachUploads(tx *gorm.DB, message *Message, attachmentIDs []string) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+	err := tx.Model(&Attachment{}).
+		Where("id IN ? AND uploader_id = ? AND message_id IS NULL", attachmentIDs, message.SenderID).
+		Update("message_id", message.ID).Error
+	if err != nil {
+		return err
+	}
+	return tx.Preload("Thumbnails").
+		Where("message_id = ?", message.ID).
+		Order("created_at ASC").
+		Find(&message.Attachments).Error
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+// media worker
+
+// StartMediaWorker processes pending image uploads in the background. Pending
+// rows are picked up again on start and by a periodic sweep, so uploads that
+// were interrupted by a restart still get their thumbnails.
+func (m *PostgresMessage) StartMediaWorker(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range m.mediaQueue {
+				if err := m.processAttachment(id); err != nil {
+					log.Printf("Error processing attachment %s: %v", id, err)
+				}
+			}
+		}()
+	}
+	go func() {
+		for {
+			m.sweepPendingMedia()
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func (m *PostgresMessage) enqueueMedia(id string) {
+	select {
+	case m.mediaQueue <- id:
+	default:
+		// the sweep picks it up once the queue drains
+	}
+}
+
+// backfillWebPThumbnails queues WebP uploads stored before they could be
+// decoded, so they get thumbnails and a blurhash too
+func backfillWebPThumbnails(db *gorm.DB) error {
+	return db.Model(&Attachment{}).
+		Where("content_type = ? AND status = ? AND blur_hash = ''", media.ContentType(media.FormatWebP), AttachmentReady).
+		Update("status", AttachmentPending).Error
+}
+
+func (m *PostgresMessage) sweepPendingMedia() {
+	var ids []string
+	err := m.db.Model(&Attachment{}).
+		Where("status = ? OR (status = ? AND updated_at < ?)",
+			AttachmentPending, AttachmentProcessing, time.Now().Add(-5*time.Minute)).
+		Order("created_at ASC").
+		Limit(cap(m.mediaQueue)).
+		Pluck("id", &ids).Error
+	if err != nil {
+		log.Printf("Error loading pending attachments: %v", err)
+		return
+	}
+	for _, id := range ids {
+		m.enqueueMedia(id)
+	}
+}
+
+func (m *PostgresMessage) processAttachment(id string) error {
+	// claim the row so concurrent workers and instances skip it
+	claim := m.db.Model(&Attachment{}).
+		Where("id = ? AND (status = ? OR (status = ? AND updated_at < ?))",
+			id, AttachmentPending, AttachmentProcessing, time.Now().Add(-5*time.Minute)).
+		Update("status", AttachmentProcessing)
+	if claim.Error != nil {
+		return claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return nil
+	}
+
+	var attachment Attachment
+	if err := m.db.First(&attachment, "id = ?", id).Error; err != nil {
+		return err
+	}
+	thumbs, blurHash, err := generateThumbnails(&attachment)
+	if err != nil {
+		m.db.Model(&attachment).Update("status", AttachmentFailed)
+		return err
+	}
+
+	var message Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("attachment_id = ?", attachment.ID).Delete(&Thumbnail{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&thumbs).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&attachment).Updates(map[string]interface{}{
+			"blur_hash": blurHash,
+			"status":    AttachmentReady,
+		}).Error
+		if err != nil {
+			return err
+		}
+		// the upload may have been sent while the thumbnails were made, the
+		// row lock taken above orders this read after that send
+		if err := tx.Select("message_id").First(&attachment, "id = ?", attachment.ID).Error; err != nil {
+			return err
+		}
+		if attachment.MessageID == nil {
+			return nil
+		}
+		// thumbnails change the message payload of an already sent message
+		if err := tx.Select("id", "conversation_id").First(&message, "id = ?", *attachment.MessageID).Error; err != nil {
+			return err
+		}
+		_, err = appendEvent(tx, message.ConversationID, EventMessageUpdated, message.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if message.ID != "" {
+		m.notifyMessageUpdated(message.ID)
+	}
+	return nil
+}
+
+func generateThumbnails(attachment *Attachment) ([]Thumbnail, string, error) {
+	data, err := os.ReadFile(filepath.Join(uploadDir(), attachment.Path))
+	if err != nil {
+		return nil, "", err
+	}
+	format := media.Sniff(data)
+	img, err := media.Decode(format, data)
+	if err != nil {
+		return nil, "", err
+	}
+	// thumbnails carry no EXIF, so the rotation goes into their pixels
+	img = media.Orient(img, media.Orientation(format, data))
+
+	thumbs := make([]Thumbnail, 0, len(thumbnailSizes))
+	for _, size := range thumbnailSizes {
+		img = media.Fit(img, size.maxDim)
+		var buf bytes.Buffer
+		if err := media.EncodeJPEG(&buf, img); err != nil {
+			return nil, "", err
+		}
+		path := fmt.Sprintf("%s_%s.jpg", attachment.ID, size.name)
+		if err := os.WriteFile(filepath.Join(uploadDir(), path), buf.Bytes(), 0o644); err != nil {
+			return nil, "", err
+		}
+		thumbs = append(thumbs, Thumbnail{
+			AttachmentID: attachment.ID,
+			Size:         size.name,
+			Width:        img.Bounds().Dx(),
+			Height:       img.Bounds().Dy(),
+			Path:         path,
+		})
+	}
+	return thumbs, media.BlurHash(media.Fit(img, 32), 4, 3), nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func attachmentInfo(a Attachment) AttachmentInfo {
+	info := AttachmentInfo{
+		ID:          a.ID,
+		FileName:    a.FileName,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		URL:         "/api/attachment/" + a.ID,
+		Width:       a.Width,
+		Height:      a.Height,
+		BlurHash:    a.BlurHash,
+	}
+	for _, t := range a.Thumbnails {
+		info.Thumbnails = append(info.Thumbnails, ThumbnailInfo{
+			Size:   t.Size,
+			Width:  t.Width,
+			Height: t.Height,
+			URL:    fmt.Sprintf("/api/attachment/%s/thumbnail/%s", a.ID, t.Size),
+		})
+	}
+	return info
+}
+
+func attachmentInfos(attachments []Attachment) []AttachmentInfo {
+	var infos []AttachmentInfo
+	for _, a := range attachments {
+		infos = append(infos, attachmentInfo(a))
+	}
+	return infos
+}
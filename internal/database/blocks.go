@@ -0,0 +1,295 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+var (
+	errBlockedUser   = errors.New("unblock this user to message them")
+	errBlockedBy     = errors.New("you cannot message this user")
+	errBlockSelf     = errors.New("you cannot block yourself")
+	errBlockedMember = errors.New("one or more users cannot be added to this group")
+)
+
+type BlockedUserInfo struct {
+	ID         string    `json:"id"`
+	FullName   string    `json:"fullname"`
+	ProfilePic string    `json:"profilePic"`
+	BlockedAt  time.Time `json:"blockedAt"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) BlockUser(blockedID string, userID string, w http.ResponseWriter) error {
+	if blockedID == userID {
+		return writeBlockError(w, errBlockSelf)
+	}
+	if err := m.validateReceiver(blockedID); err != nil {
+		return writeSendError(w, err)
+	}
+	block := Block{BlockerID: userID, BlockedID: blockedID}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&block).Error; err != nil {
+			return err
+		}
+		// a block ends the contact and any request between the two
+		_, err := removeContact(tx, userID, blockedID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.db.First(&block, "blocker_id = ? AND blocked_id = ?", userID, blockedID).Error; err != nil {
+		return err
+	}
+
+	// both sides drop out of each other's presence list
+	go broadcastOnlineUsers()
+	var user User
+	if err := m.db.Select("id", "full_name", "profile_pic").First(&user, "id = ?", blockedID).Error; err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, blockedUserInfo(user, block.CreatedAt))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UnblockUser(blockedID string, userID string, w http.ResponseWriter) error {
+	result := m.db.Where("blocker_id = ? AND blocked_id = ?", userID, blockedID).Delete(&Block{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: "user is not blocked"})
+	}
+	go broadcastOnlineUsers()
+	return utils.WriteJson(w, http.StatusOK, map[string]string{"id": blockedID})
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetBlockedUsers(userID string, w http.ResponseWriter) error {
+	var blocks []Block
+	err := m.db.Preload("Blocked", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name", "profile_pic")
+	}).
+		Where("blocker_id = ?", userID).
+		Order("created_at DESC").
+		Find(&blocks).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch blocked users"},
+		)
+	}
+	infos := []BlockedUserInfo{}
+	for _, block := range blocks {
+		infos = append(infos, blockedUserInfo(block.Blocked, block.CreatedAt))
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// blockBetween fails when either user blocked the other, errBlockedUser
+// when senderID did the blocking
+func blockBetween(db *gorm.DB, senderID string, otherID string) error {
+	var blocks []Block
+	err := db.Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)",
+		senderID, otherID, otherID, senderID).
+		Find(&blocks).Error
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if block.BlockerID == senderID {
+			return errBlockedUser
+		}
+	}
+	if len(blocks) > 0 {
+		return errBlockedBy
+	}
+	return nil
+}
+
+// directBlock applies blockBetween to the other member of a direct
+// conversation, groups and notes to self are never blocked
+func directBlock(db *gorm.DB, conversation *Conversation, senderID string) error {
+	if conversation.IsGroup {
+		return nil
+	}
+	var others []string
+	err := db.Table("conversation_participants").
+		Where("conversation_id = ? AND user_id <> ?", conversation.ID, senderID).
+		Pluck("user_id", &others).Error
+	if err != nil || len(others) == 0 {
+		return err
+	}
+	return blockBetween(db, senderID, others[0])
+}
+
+// blockedByAny fails with errBlockedMember when one of userIDs blocked actorID
+func blockedByAny(db *gorm.DB, actorID string, userIDs []string) error {
+	var count int64
+	err := db.Model(&Block{}).
+		Where("blocked_id = ? AND blocker_id IN ?", actorID, userIDs).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errBlockedMember
+	}
+	return nil
+}
+
+// blockedPairs returns, for each of userIDs, the users they blocked or were
+// blocked by
+func blockedPairs(db *gorm.DB, userIDs []string) (map[string]map[string]bool, error) {
+	pairs := map[string]map[string]bool{}
+	if len(userIDs) == 0 {
+		return pairs, nil
+	}
+	var blocks []Block
+	err := db.Where("blocker_id IN ? OR blocked_id IN ?", userIDs, userIDs).Find(&blocks).Error
+	if err != nil {
+		return nil, err
+	}
+	add := func(a, b string) {
+		if pairs[a] == nil {
+			pairs[a] = map[string]bool{}
+		}
+		pairs[a][b] = true
+	}
+	for _, block := range blocks {
+		add(block.BlockerID, block.BlockedID)
+		add(block.BlockedID, block.BlockerID)
+	}
+	return pairs, nil
+}
+
+// dropBlockedMessages reports whether BLOCKED_MESSAGE_POLICY asks for
+// messages to blockers to be dropped silently instead of rejected
+func dropBlockedMessages() bool {
+	return os.Getenv("BLOCKED_MESSAGE_POLICY") == "drop"
+}
+
+// writeBlockedSend answers a send that a block stopped. Under the drop
+// policy the sender gets a normal looking reply for a message that was
+// never stored, so they cannot tell they were blocked.
+func writeBlockedSend(w http.ResponseWriter, mess *MessagePlain, senderID string, err error) error {
+	if errors.Is(err, errBlockedBy) && dropBlockedMessages() {
+		message := Message{
+			ID:        uuid.NewString(),
+			SenderID:  senderID,
+			Body:      mess.Content,
+			Entities:  mess.Entities,
+			Kind:      MessageKindText,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+		}
+		if mess.ClientID != "" {
+			message.ClientMessageID = &mess.ClientID
+		}
+		return utils.WriteJson(w, http.StatusCreated, sendMessagePayload(message))
+	}
+	return writeBlockError(w, err)
+}
+
+// hiddenProfiles returns the users viewerID has a block with, in either
+// direction
+func hiddenProfiles(db *gorm.DB, viewerID string) (map[string]bool, error) {
+	pairs, err := blockedPairs(db, []string{viewerID})
+	if err != nil {
+		return nil, err
+	}
+	return pairs[viewerID], nil
+}
+
+// redactProfile blanks the name and picture of userID when it is hidden.
+// Every response that carries another user's profile goes through it, the
+// blocker's own list of blocked users being the one exception.
+func redactProfile(hidden map[string]bool, userID string, fullName *string, profilePic *string) {
+	if hidden[userID] {
+		*fullName = ""
+		*profilePic = ""
+	}
+}
+
+func redactUser(user UserInfo, hidden map[string]bool) UserInfo {
+	redactProfile(hidden, user.ID, &user.FullName, &user.ProfilePic)
+	return user
+}
+
+// redactBlocked hides the profiles of the hidden members
+func redactBlocked(info ConversationInfo, hidden map[string]bool) ConversationInfo {
+	if len(hidden) == 0 {
+		return info
+	}
+	members := make([]MemberInfo, len(info.Participants))
+	for i, member := range info.Participants {
+		redactProfile(hidden, member.ID, &member.FullName, &member.ProfilePic)
+		members[i] = member
+	}
+	info.Participants = members
+	return info
+}
+
+// conversationInfoFor is conversationInfo as viewerID may see it
+func (m *PostgresMessage) conversationInfoFor(conversationID string, viewerID string) (ConversationInfo, error) {
+	info, err := m.conversationInfo(conversationID)
+	if err != nil {
+		return info, err
+	}
+	return m.redactFor(info, viewerID)
+}
+
+func (m *PostgresMessage) redactFor(info ConversationInfo, viewerID string) (ConversationInfo, error) {
+	hidden, err := hiddenProfiles(m.db, viewerID)
+	if err != nil {
+		return info, err
+	}
+	return redactBlocked(info, hidden), nil
+}
+
+// notifyConversationInfo pushes info to every participant, without the
+// profiles of anyone they have a block with
+func (m *PostgresMessage) notifyConversationInfo(eventType string, info ConversationInfo) {
+	ids := make([]string, len(info.Participants))
+	for i, member := range info.Participants {
+		ids[i] = member.ID
+	}
+	pairs, err := blockedPairs(m.db, ids)
+	if err != nil {
+		log.Printf("Error loading blocks in %s: %v", info.ID, err)
+	}
+	for _, id := range ids {
+		notifyUsers([]string{id}, SocketEvent{Type: eventType, Content: redactBlocked(info, pairs[id])})
+	}
+}
+
+func blockedUserInfo(user User, blockedAt time.Time) BlockedUserInfo {
+	return BlockedUserInfo{
+		ID:         user.ID,
+		FullName:   user.FullName,
+		ProfilePic: user.ProfilePic,
+		BlockedAt:  blockedAt,
+	}
+}
+
+func writeBlockError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errBlockedUser), errors.Is(err, errBlockedBy), errors.Is(err, errBlockedMember),
+		errors.Is(err, errRequestDeclined):
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errBlockSelf):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return err
+}
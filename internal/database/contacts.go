@@ -0,0 +1,511 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+// contactRequestCooldown is how long a declined request stays declined
+// before its sender may ask again
+const contactRequestCooldown = 30 * 24 * time.Hour
+
+var (
+	errAlreadyContact          = errors.New("user is already a contact")
+	errContactSelf             = errors.New("you cannot add yourself as a contact")
+	errContactRequestNotFound  = errors.New("contact request not found")
+	errContactNotFound         = errors.New("user is not a contact")
+	errRequestDeclined         = errors.New("this user is not accepting your messages")
+	errMessageRequestNotFound  = errors.New("message request not found")
+	errContactRequestCompleted = errors.New("contact request was already answered")
+	errContactRequestDeclined  = errors.New("this user declined your contact request, try again later")
+	errContactsOnlyMember      = errors.New("one or more users only accept contacts, share an invite link with them instead")
+)
+
+type ContactRequestPlain struct {
+	UserID string `json:"userId"`
+}
+
+type ContactRequestInfo struct {
+	ID        string               `json:"id"`
+	From      UserInfo             `json:"from"`
+	To        UserInfo             `json:"to"`
+	Status    ContactRequestStatus `json:"status"`
+	CreatedAt time.Time            `json:"createdAt"`
+}
+
+type ContactRequests struct {
+	Incoming []ContactRequestInfo `json:"incoming"`
+	Outgoing []ContactRequestInfo `json:"outgoing"`
+}
+
+type ContactInfo struct {
+	ID         string    `json:"id"`
+	FullName   string    `json:"fullname"`
+	ProfilePic string    `json:"profilePic"`
+	AddedAt    time.Time `json:"addedAt"`
+}
+
+type MessageRequestInfo struct {
+	ConversationID string       `json:"conversationId"`
+	From           UserInfo     `json:"from"`
+	LastMessage    *MessageType `json:"lastMessage,omitempty"`
+	CreatedAt      time.Time    `json:"createdAt"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) SendContactRequest(req *ContactRequestPlain, userID string, w http.ResponseWriter) error {
+	if req.UserID == userID {
+		return writeContactError(w, errContactSelf)
+	}
+	if err := m.validateReceiver(req.UserID); err != nil {
+		return writeSendError(w, err)
+	}
+	if err := blockBetween(m.db, userID, req.UserID); err != nil {
+		return writeBlockError(w, err)
+	}
+
+	var request ContactRequest
+	accepted, repeated := false, false
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if ok, err := isContact(tx, userID, req.UserID); err != nil || ok {
+			if ok {
+				return errAlreadyContact
+			}
+			return err
+		}
+		// asking someone who already asked us accepts their request
+		var reverse ContactRequest
+		err := tx.Where("from_id = ? AND to_id = ? AND status = ?", req.UserID, userID, ContactRequestPending).
+			First(&reverse).Error
+		if err == nil {
+			accepted = true
+			request = reverse
+			return acceptContactRequest(tx, &request)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		request = ContactRequest{FromID: userID, ToID: req.UserID, Status: ContactRequestPending}
+		created := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&request)
+		if created.Error != nil || created.RowsAffected > 0 {
+			return created.Error
+		}
+		// asking again only reopens a request declined long enough ago
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("from_id = ? AND to_id = ?", userID, req.UserID).
+			First(&request).Error
+		if err != nil {
+			return err
+		}
+		switch {
+		case request.Status == ContactRequestPending:
+			repeated = true
+			return nil
+		case request.Status == ContactRequestDeclined && time.Since(request.UpdatedAt) < contactRequestCooldown:
+			return errContactRequestDeclined
+		}
+		request.Status = ContactRequestPending
+		return tx.Model(&request).Update("status", ContactRequestPending).Error
+	})
+	if err != nil {
+		return writeContactError(w, err)
+	}
+
+	info, err := m.contactRequestInfo(request.ID)
+	if err != nil {
+		return err
+	}
+	if accepted {
+		notifyUsers([]string{request.FromID}, SocketEvent{Type: "contactRequestAccepted", Content: info})
+		return utils.WriteJson(w, http.StatusOK, info)
+	}
+	// asking again while the request is open does not ping the user again
+	if repeated {
+		return utils.WriteJson(w, http.StatusOK, info)
+	}
+	notifyUsers([]string{request.ToID}, SocketEvent{Type: "contactRequestReceived", Content: info})
+	return utils.WriteJson(w, http.StatusCreated, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetContactRequests(userID string, w http.ResponseWriter) error {
+	var requests []ContactRequest
+	err := m.db.Scopes(preloadContactRequestUsers).
+		Where("(to_id = ? OR from_id = ?) AND status = ?", userID, userID, ContactRequestPending).
+		Order("updated_at DESC").
+		Find(&requests).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch contact requests"},
+		)
+	}
+	hidden, err := hiddenProfiles(m.db, userID)
+	if err != nil {
+		return err
+	}
+	result := ContactRequests{Incoming: []ContactRequestInfo{}, Outgoing: []ContactRequestInfo{}}
+	for _, request := range requests {
+		info := contactRequestInfo(request)
+		info.From, info.To = redactUser(info.From, hidden), redactUser(info.To, hidden)
+		if request.ToID == userID {
+			result.Incoming = append(result.Incoming, info)
+		} else {
+			result.Outgoing = append(result.Outgoing, info)
+		}
+	}
+	return utils.WriteJson(w, http.StatusOK, result)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) AnswerContactRequest(
+	requestID string,
+	accept bool,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	var request ContactRequest
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND to_id = ?", requestID, userID).
+			First(&request).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errContactRequestNotFound
+		} else if err != nil {
+			return err
+		}
+		if request.Status != ContactRequestPending {
+			return errContactRequestCompleted
+		}
+		if accept {
+			return acceptContactRequest(tx, &request)
+		}
+		request.Status = ContactRequestDeclined
+		return tx.Model(&request).Update("status", ContactRequestDeclined).Error
+	})
+	if err != nil {
+		return writeContactError(w, err)
+	}
+
+	info, err := m.contactRequestInfo(request.ID)
+	if err != nil {
+		return err
+	}
+	// a declined request is not announced to its sender
+	if accept {
+		notifyUsers([]string{request.FromID}, SocketEvent{Type: "contactRequestAccepted", Content: info})
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetContacts(userID string, w http.ResponseWriter) error {
+	var contacts []Contact
+	err := m.db.Preload("Contact", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name", "profile_pic")
+	}).
+		Where("user_id = ?", userID).
+		Find(&contacts).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch contacts"},
+		)
+	}
+	infos := []ContactInfo{}
+	for _, contact := range contacts {
+		infos = append(infos, ContactInfo{
+			ID:         contact.Contact.ID,
+			FullName:   contact.Contact.FullName,
+			ProfilePic: contact.Contact.ProfilePic,
+			AddedAt:    contact.CreatedAt,
+		})
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) RemoveContact(contactID string, userID string, w http.ResponseWriter) error {
+	var removed int64
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		removed, err = removeContact(tx, userID, contactID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return writeContactError(w, errContactNotFound)
+	}
+	notifyUsers([]string{contactID}, SocketEvent{Type: "contactRemoved", Content: userID})
+	return utils.WriteJson(w, http.StatusOK, map[string]string{"id": contactID})
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetMessageRequests(userID string, w http.ResponseWriter) error {
+	var rows []struct {
+		ConversationID string
+		CreatedAt      time.Time
+		UserInfo
+	}
+	err := m.db.Table("conversation_participants me").
+		Select("me.conversation_id, c.created_at, u.id, u.full_name, u.profile_pic").
+		Joins("JOIN conversations c ON c.id = me.conversation_id").
+		Joins("JOIN conversation_participants other ON other.conversation_id = me.conversation_id"+
+			" AND other.user_id <> me.user_id").
+		Joins("JOIN users u ON u.id = other.user_id").
+		Where("me.user_id = ? AND me.is_request AND NOT me.request_declined", userID).
+		// requests from users we blocked are dropped, not just redacted
+		Where("other.user_id NOT IN (?)", m.db.Model(&Block{}).Select("blocked_id").Where("blocker_id = ?", userID)).
+		Order("c.created_at DESC").
+		Scan(&rows).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch message requests"},
+		)
+	}
+
+	conversationIDs := make([]string, len(rows))
+	for i, row := range rows {
+		conversationIDs[i] = row.ConversationID
+	}
+	lastMessages := map[string]*MessageType{}
+	if len(conversationIDs) > 0 {
+		var messages []Message
+		err := m.db.Scopes(notExpired, preloadMessageDetails("")).
+			Where("(conversation_id, seq) IN (?)", m.db.Model(&Message{}).
+				Select("conversation_id, MAX(seq)").
+				Where("conversation_id IN ?", conversationIDs).
+				Group("conversation_id")).
+			Find(&messages).Error
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			info := messageType(message)
+			lastMessages[message.ConversationID] = &info
+		}
+	}
+
+	hidden, err := hiddenProfiles(m.db, userID)
+	if err != nil {
+		return err
+	}
+	infos := []MessageRequestInfo{}
+	for _, row := range rows {
+		infos = append(infos, MessageRequestInfo{
+			ConversationID: row.ConversationID,
+			From:           redactUser(row.UserInfo, hidden),
+			LastMessage:    lastMessages[row.ConversationID],
+			CreatedAt:      row.CreatedAt,
+		})
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) AnswerMessageRequest(
+	conversationID string,
+	accept bool,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	updates := map[string]interface{}{"is_request": false, "request_declined": false}
+	if !accept {
+		// declined requests stay out of the sidebar and take no more messages
+		updates = map[string]interface{}{"request_declined": true}
+	}
+	result := m.db.Model(&ConversationParticipant{}).
+		Where("conversation_id = ? AND user_id = ? AND is_request AND NOT request_declined", conversationID, userID).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return writeContactError(w, errMessageRequestNotFound)
+	}
+
+	event := "messageRequestAccepted"
+	if !accept {
+		event = "messageRequestDeclined"
+	}
+	notifyUsers([]string{userID}, SocketEvent{Type: event, Content: conversationID})
+	return utils.WriteJson(w, http.StatusOK, map[string]string{"conversationId": conversationID})
+}
+
+// isContact reports whether userID has contactID in their contacts
+func isContact(db *gorm.DB, userID string, contactID string) (bool, error) {
+	var count int64
+	err := db.Model(&Contact{}).
+		Where("user_id = ? AND contact_id = ?", userID, contactID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// contactsOnlyStrangers fails with errContactsOnlyMember when one of userIDs
+// only takes messages from contacts and actorID is not one of them, they
+// join such groups through an invite link instead
+func contactsOnlyStrangers(db *gorm.DB, actorID string, userIDs []string) error {
+	var count int64
+	err := db.Model(&User{}).
+		Where("id IN ? AND id <> ? AND message_privacy = ?", userIDs, actorID, PrivacyContacts).
+		Where("id NOT IN (?)", db.Model(&Contact{}).Select("user_id").Where("contact_id = ?", actorID)).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errContactsOnlyMember
+	}
+	return nil
+}
+
+// acceptContactRequest makes both users each other's contacts and lets any
+// direct chat between them out of the message requests inbox
+func acceptContactRequest(tx *gorm.DB, request *ContactRequest) error {
+	request.Status = ContactRequestAccepted
+	if err := tx.Model(request).Update("status", ContactRequestAccepted).Error; err != nil {
+		return err
+	}
+	contacts := []Contact{
+		{UserID: request.FromID, ContactID: request.ToID},
+		{UserID: request.ToID, ContactID: request.FromID},
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&contacts).Error; err != nil {
+		return err
+	}
+	conversation, err := findConversation(tx, request.FromID, request.ToID)
+	if err != nil || conversation == nil {
+		return err
+	}
+	return tx.Model(&ConversationParticipant{}).
+		Where("conversation_id = ?", conversation.ID).
+		Updates(map[string]interface{}{"is_request": false, "request_declined": false}).Error
+}
+
+// removeContact drops the contact both ways along with the requests between
+// the two users, so either may ask again
+func removeContact(tx *gorm.DB, userID string, contactID string) (int64, error) {
+	result := tx.Where("(user_id = ? AND contact_id = ?) OR (user_id = ? AND contact_id = ?)",
+		userID, contactID, contactID, userID).
+		Delete(&Contact{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	err := tx.Where("(from_id = ? AND to_id = ?) OR (from_id = ? AND to_id = ?)",
+		userID, contactID, contactID, userID).
+		Delete(&ContactRequest{}).Error
+	return result.RowsAffected, err
+}
+
+// startsAsRequest reports whether a new direct chat from senderID lands in
+// receiverID's message requests inbox
+func startsAsRequest(tx *gorm.DB, senderID string, receiverID string) (bool, error) {
+	var receiver User
+	if err := tx.Select("id", "message_privacy").First(&receiver, "id = ?", receiverID).Error; err != nil {
+		return false, err
+	}
+	if receiver.MessagePrivacy != PrivacyContacts {
+		return false, nil
+	}
+	ok, err := isContact(tx, receiverID, senderID)
+	return !ok, err
+}
+
+// answerRequestOnSend keeps message requests in step with a new message in
+// a direct chat: writing in a request accepts it, and a declined request
+// takes no more messages from the other side
+func answerRequestOnSend(tx *gorm.DB, conversation *Conversation, senderID string) error {
+	if conversation.IsGroup {
+		return nil
+	}
+	var participants []ConversationParticipant
+	err := tx.Where("conversation_id = ?", conversation.ID).Find(&participants).Error
+	if err != nil {
+		return err
+	}
+	for _, participant := range participants {
+		if participant.UserID == senderID {
+			continue
+		}
+		if participant.RequestDeclined {
+			return errRequestDeclined
+		}
+	}
+	return tx.Model(&ConversationParticipant{}).
+		Where("conversation_id = ? AND user_id = ? AND (is_request OR request_declined)", conversation.ID, senderID).
+		Updates(map[string]interface{}{"is_request": false, "request_declined": false}).Error
+}
+
+// pendingRequests returns the participants who have conversationID waiting
+// in their message requests inbox
+func (m *PostgresMessage) pendingRequests(conversationID string) (map[string]bool, error) {
+	var ids []string
+	err := m.db.Model(&ConversationParticipant{}).
+		Where("conversation_id = ? AND is_request AND NOT request_declined", conversationID).
+		Pluck("user_id", &ids).Error
+	pending := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		pending[id] = true
+	}
+	return pending, err
+}
+
+func preloadContactRequestUsers(db *gorm.DB) *gorm.DB {
+	selectUser := func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name", "profile_pic")
+	}
+	return db.Preload("From", selectUser).Preload("To", selectUser)
+}
+
+func (m *PostgresMessage) contactRequestInfo(requestID string) (ContactRequestInfo, error) {
+	var request ContactRequest
+	err := m.db.Scopes(preloadContactRequestUsers).First(&request, "id = ?", requestID).Error
+	return contactRequestInfo(request), err
+}
+
+func contactRequestInfo(request ContactRequest) ContactRequestInfo {
+	return ContactRequestInfo{
+		ID:        request.ID,
+		From:      UserInfo{ID: request.From.ID, FullName: request.From.FullName, ProfilePic: request.From.ProfilePic},
+		To:        UserInfo{ID: request.To.ID, FullName: request.To.FullName, ProfilePic: request.To.ProfilePic},
+		Status:    request.Status,
+		CreatedAt: request.CreatedAt,
+	}
+}
+
+func writeContactError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errContactRequestNotFound), errors.Is(err, errContactNotFound),
+		errors.Is(err, errMessageRequestNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errAlreadyContact), errors.Is(err, errContactRequestCompleted),
+		errors.Is(err, errContactRequestDeclined):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errContactSelf):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return err
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeContactRequest(r *http.Request) (*ContactRequestPlain, error) {
+	req := new(ContactRequestPlain)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
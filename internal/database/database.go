@@ -8,21 +8,40 @@ import (
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/linkpreview"
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
 )
 
 // /////////////////////////////////////////////////////////////////////////////////////
+// UserInfo is a sidebar entry, groups are listed with their conversation
+// id, name and avatar and IsGroup set
 type UserInfo struct {
 	ID         string `json:"id"`
 	FullName   string `json:"fullname"`
 	ProfilePic string `json:"profilePic"`
+	HasDraft   bool   `json:"hasDraft,omitempty" gorm:"-"`
+	IsGroup    bool   `json:"isGroup,omitempty" gorm:"-"`
+	Muted      bool   `json:"muted,omitempty" gorm:"-"`
+	Archived   bool   `json:"archived,omitempty" gorm:"-"`
+	Pinned     bool   `json:"pinned,omitempty" gorm:"-"`
 }
 type User struct {
-	ID            string `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
-	Username      string `gorm:"unique"`
-	FullName      string
-	Password      string
-	Gender        Gender `gorm:"type:gender;default:'male'"`
-	ProfilePic    string
+	ID         string `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	Username   string `gorm:"unique"`
+	FullName   string
+	Password   string
+	Gender     Gender `gorm:"type:gender;default:'male'"`
+	ProfilePic string
+	// MessagePrivacy "contacts" sends strangers' first messages to the
+	// message requests inbox
+	MessagePrivacy MessagePrivacy `gorm:"type:varchar(16);default:'everyone';not null"`
+	// Searchable false keeps the user out of directory search for anyone
+	// but their contacts
+	Searchable bool `gorm:"default:true;not null"`
+	// Placeholder users stand in for the senders of imported chats, they
+	// have no password and nobody can message, add or find them
+	Placeholder   bool           `gorm:"default:false;not null"`
 	Conversations []Conversation `gorm:"many2many:user_conversations;constraint:OnDelete:CASCADE"`
 	Messages      []Message      `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE"`
 	CreatedAt     time.Time      `gorm:"autoCreateTime"`
@@ -37,6 +56,8 @@ type UserPlain struct {
 	ConfirmPassword string `json:"confirmPassword,omitempty"`
 	Gender          string `json:"gender,omitempty"`
 	ProfilePic      string `json:"profilePic,omitempty"`
+	MessagePrivacy  string `json:"messagePrivacy,omitempty"`
+	Searchable      *bool  `json:"searchable,omitempty"`
 }
 
 type PostgresUser struct {
@@ -44,33 +65,344 @@ type PostgresUser struct {
 }
 
 // /////////////////////////////////////////////////////////////////////////////////////
-// Conversation model
+// Conversation model, direct chats and notes to self have no name, groups
+// are marked by IsGroup
 type Conversation struct {
-	ID           string    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
-	Participants []User    `gorm:"many2many:conversation_participants;constraint:OnDelete:CASCADE"`
-	Messages     []Message `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
-	CreatedAt    time.Time `gorm:"autoCreateTime"`
-	UpdatedAt    time.Time `gorm:"autoUpdateTime"`
+	ID             string    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	Participants   []User    `gorm:"many2many:conversation_participants;constraint:OnDelete:CASCADE"`
+	Messages       []Message `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
+	IsGroup        bool      `gorm:"default:false;not null"`
+	Name           string
+	AvatarURL      string
+	CreatedByID    *string   `gorm:"type:uuid"`
+	DisappearAfter int64     `gorm:"default:0;not null"` // seconds, 0 keeps messages forever
+	LastSeq        int64     `gorm:"default:0;not null"`
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+	UpdatedAt      time.Time `gorm:"autoUpdateTime"`
 }
 
-// Message model
-type Message struct {
-	ID             string       `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
-	ConversationID string       `gorm:"type:uuid;index;not null"`
-	Conversation   Conversation `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
-	SenderID       string       `gorm:"type:uuid;index;not null"`
-	Sender         User         `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE"`
-	Body           string
+// ConversationParticipant is the join table behind Conversation.Participants.
+// Role only matters in groups, direct chats leave everyone a member. The
+// rest are the participant's own settings for the conversation, a mute
+// without MutedUntil lasts until it is lifted. IsRequest marks a stranger's
+// direct chat waiting in the message requests inbox.
+type ConversationParticipant struct {
+	ConversationID  string          `gorm:"type:uuid;primaryKey"`
+	UserID          string          `gorm:"type:uuid;primaryKey;index"`
+	Role            ParticipantRole `gorm:"type:varchar(16);default:'member';not null"`
+	Muted           bool            `gorm:"default:false;not null"`
+	MutedUntil      *time.Time
+	ArchivedAt      *time.Time
+	KeepArchived    bool `gorm:"default:false;not null"`
+	PinnedAt        *time.Time
+	IsRequest       bool      `gorm:"default:false;not null"`
+	RequestDeclined bool      `gorm:"default:false;not null"`
+	JoinedAt        time.Time `gorm:"autoCreateTime"`
+}
+
+// Contact model, one row per direction so each side lists the other
+type Contact struct {
+	UserID    string    `gorm:"type:uuid;primaryKey"`
+	User      User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	ContactID string    `gorm:"type:uuid;primaryKey;index"`
+	Contact   User      `gorm:"foreignKey:ContactID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// ContactRequest model, one row per pair and direction, asking again
+// reopens a declined request
+type ContactRequest struct {
+	ID        string               `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	FromID    string               `gorm:"type:uuid;not null;uniqueIndex:idx_contact_request_pair"`
+	From      User                 `gorm:"foreignKey:FromID;constraint:OnDelete:CASCADE"`
+	ToID      string               `gorm:"type:uuid;not null;uniqueIndex:idx_contact_request_pair;index"`
+	To        User                 `gorm:"foreignKey:ToID;constraint:OnDelete:CASCADE"`
+	Status    ContactRequestStatus `gorm:"type:varchar(16);default:'pending';not null"`
+	CreatedAt time.Time            `gorm:"autoCreateTime"`
+	UpdatedAt time.Time            `gorm:"autoUpdateTime"`
+}
+
+// Block model, BlockerID no longer hears from BlockedID
+type Block struct {
+	BlockerID string    `gorm:"type:uuid;primaryKey"`
+	Blocker   User      `gorm:"foreignKey:BlockerID;constraint:OnDelete:CASCADE"`
+	BlockedID string    `gorm:"type:uuid;primaryKey;index"`
+	Blocked   User      `gorm:"foreignKey:BlockedID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time `gorm:"autoCreateTime"`
+}
+
+// GroupInvite model, a shareable link into a group. MaxUses of 0 is
+// unlimited, Uses is only ever raised by a conditional update.
+type GroupInvite struct {
+	ID               string       `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ConversationID   string       `gorm:"type:uuid;not null;index"`
+	Conversation     Conversation `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
+	Code             string       `gorm:"type:varchar(32);not null;uniqueIndex"`
+	CreatedByID      string       `gorm:"type:uuid;not null"`
+	ExpiresAt        *time.Time
+	MaxUses          int  `gorm:"default:0;not null"`
+	Uses             int  `gorm:"default:0;not null"`
+	RequiresApproval bool `gorm:"default:false;not null"`
+	RevokedAt        *time.Time
+	CreatedAt        time.Time `gorm:"autoCreateTime"`
+}
+
+// JoinRequest model, a user waiting for an admin to let them in through an
+// invite that requires approval. One row per user and group, a new request
+// reopens a decided one.
+type JoinRequest struct {
+	ID             string            `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ConversationID string            `gorm:"type:uuid;not null;uniqueIndex:idx_join_request_conversation_user"`
+	Conversation   Conversation      `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
+	UserID         string            `gorm:"type:uuid;not null;uniqueIndex:idx_join_request_conversation_user"`
+	User           User              `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	InviteID       string            `gorm:"type:uuid;not null"`
+	Status         JoinRequestStatus `gorm:"type:varchar(16);default:'pending';not null"`
+	ReviewerID     *string           `gorm:"type:uuid"`
+	ReviewedAt     *time.Time
 	CreatedAt      time.Time `gorm:"autoCreateTime"`
 	UpdatedAt      time.Time `gorm:"autoUpdateTime"`
 }
+
+// Message model, SystemAction and TargetID are only set on system messages.
+// ForwardedFrom* point at the original message and author without a foreign
+// key so the attribution survives the source being deleted.
+type Message struct {
+	ID                    string       `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ConversationID        string       `gorm:"type:uuid;index;not null;index:idx_messages_conversation_seq"`
+	Seq                   int64        `gorm:"default:0;not null;index:idx_messages_conversation_seq"`
+	Conversation          Conversation `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
+	SenderID              string       `gorm:"type:uuid;index;not null;uniqueIndex:idx_sender_client_message"`
+	Sender                User         `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE"`
+	Body                  string
+	ClientMessageID       *string       `gorm:"type:varchar(64);uniqueIndex:idx_sender_client_message"`
+	Entities              Entities      `gorm:"type:jsonb"`
+	Kind                  MessageKind   `gorm:"type:varchar(16);default:'text';not null"`
+	SystemAction          string        `gorm:"type:varchar(32)"`
+	TargetID              *string       `gorm:"type:uuid"`
+	ExpiresAt             *time.Time    `gorm:"index"`
+	ForwardedFromID       *string       `gorm:"type:uuid"`
+	ForwardedFromSenderID *string       `gorm:"type:uuid"`
+	ImportedFrom          string        `gorm:"type:varchar(128)"` // export sender of an imported message, empty for the importer
+	Attachments           []Attachment  `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE"`
+	LinkPreviews          []LinkPreview `gorm:"many2many:message_link_previews;constraint:OnDelete:CASCADE"`
+	Mentions              []Mention     `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE"`
+	Poll                  *Poll         `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE"`
+	CreatedAt             time.Time     `gorm:"autoCreateTime"`
+	UpdatedAt             time.Time     `gorm:"autoUpdateTime"`
+}
+
+// Attachment model, MessageID stays empty until the upload is sent
+type Attachment struct {
+	ID          string  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	MessageID   *string `gorm:"type:uuid;index"`
+	UploaderID  string  `gorm:"type:uuid;index;not null"`
+	FileName    string
+	ContentType string
+	Size        int64
+	Path        string
+	Width       int
+	Height      int
+	BlurHash    string
+	Status      AttachmentStatus `gorm:"type:varchar(16);default:'pending';index"`
+	Thumbnails  []Thumbnail      `gorm:"foreignKey:AttachmentID;constraint:OnDelete:CASCADE"`
+	CreatedAt   time.Time        `gorm:"autoCreateTime"`
+	UpdatedAt   time.Time        `gorm:"autoUpdateTime"`
+}
+
+// Thumbnail model
+type Thumbnail struct {
+	ID           string `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	AttachmentID string `gorm:"type:uuid;index;not null"`
+	Size         string
+	Width        int
+	Height       int
+	Path         string
+}
+
+// Mention model, one row per mentioned user. Offset and Length are in UTF-16
+// code units of the message body, @all rows share the same span.
+type Mention struct {
+	ID              string    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	MessageID       string    `gorm:"type:uuid;index;not null"`
+	Message         Message   `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE"`
+	ConversationID  string    `gorm:"type:uuid;not null"`
+	MentionedUserID string    `gorm:"type:uuid;index;not null"`
+	SenderID        string    `gorm:"type:uuid;not null"`
+	All             bool      `gorm:"default:false;not null"`
+	Offset          int       `gorm:"not null"`
+	Length          int       `gorm:"not null"`
+	CreatedAt       time.Time `gorm:"autoCreateTime;index"`
+}
+
+// PinnedMessage model
+type PinnedMessage struct {
+	ID             string    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ConversationID string    `gorm:"type:uuid;not null;uniqueIndex:idx_pinned_conversation_message"`
+	MessageID      string    `gorm:"type:uuid;not null;uniqueIndex:idx_pinned_conversation_message"`
+	Message        Message   `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE"`
+	PinnedByID     string    `gorm:"type:uuid;not null"`
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+}
+
+// ScheduledMessage model, pending messages are kept apart from Message until
+// the scheduler delivers them
+type ScheduledMessage struct {
+	ID              string  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	SenderID        string  `gorm:"type:uuid;index;not null;uniqueIndex:idx_scheduled_sender_client_message"`
+	ClientMessageID *string `gorm:"type:varchar(64);uniqueIndex:idx_scheduled_sender_client_message"`
+	ReceiverID      string  `gorm:"type:uuid;not null"`
+	Body            string
+	Entities        Entities        `gorm:"type:jsonb"`
+	AttachmentIDs   string          `gorm:"type:jsonb;default:'[]';not null"`
+	SendAt          time.Time       `gorm:"index;not null"`
+	Status          ScheduledStatus `gorm:"type:varchar(16);default:'pending';index;not null"`
+	MessageID       *string         `gorm:"type:uuid"`
+	LastError       string
+	Attempts        int        `gorm:"default:0;not null"` // deliveries that failed for a passing reason
+	RetryAt         *time.Time // the next attempt waits until then
+	CreatedAt       time.Time  `gorm:"autoCreateTime"`
+	UpdatedAt       time.Time  `gorm:"autoUpdateTime"`
+}
+
+// Draft model, one unsent message per user and conversation
+type Draft struct {
+	UserID          string       `gorm:"type:uuid;primaryKey"`
+	ConversationID  string       `gorm:"type:uuid;primaryKey"`
+	Conversation    Conversation `gorm:"foreignKey:ConversationID;constraint:OnDelete:CASCADE"`
+	Body            string
+	ClientUpdatedAt time.Time `gorm:"not null"`
+	UpdatedAt       time.Time `gorm:"autoUpdateTime"`
+}
+
+// ConversationEvent model, the change log behind delta sync. Seq is gap
+// free per conversation, MessageID has no foreign key so deletions stay
+// in the log.
+type ConversationEvent struct {
+	ID             string    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ConversationID string    `gorm:"type:uuid;not null;uniqueIndex:idx_conversation_event_seq"`
+	Seq            int64     `gorm:"not null;uniqueIndex:idx_conversation_event_seq"`
+	Kind           string    `gorm:"type:varchar(32);not null"`
+	MessageID      string    `gorm:"type:uuid;not null"`
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+}
+
+// ModerationFlag model, a message waiting for a moderator's review. Body is
+// a copy so the review still works after the message is gone.
+type ModerationFlag struct {
+	ID             string               `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	MessageID      string               `gorm:"type:uuid;not null;index"`
+	ConversationID string               `gorm:"type:uuid;not null"`
+	SenderID       string               `gorm:"type:uuid;not null"`
+	Body           string               `gorm:"not null"`
+	Rules          string               `gorm:"not null"`
+	Reasons        string               `gorm:"not null"`
+	Status         ModerationFlagStatus `gorm:"type:varchar(16);default:'pending';not null;index:idx_flag_status_time,priority:1"`
+	ReviewerID     *string              `gorm:"type:uuid"`
+	ReviewedAt     *time.Time
+	CreatedAt      time.Time `gorm:"autoCreateTime;index:idx_flag_status_time,priority:2"`
+}
+
+// StarredMessage model, a user's bookmark. MessageID has no foreign key so
+// the star survives the message and can be listed as a tombstone.
+type StarredMessage struct {
+	UserID         string    `gorm:"type:uuid;primaryKey;index:idx_starred_user_time,priority:1"`
+	User           User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	MessageID      string    `gorm:"type:uuid;primaryKey"`
+	ConversationID string    `gorm:"type:uuid;not null"`
+	StarredAt      time.Time `gorm:"autoCreateTime;index:idx_starred_user_time,priority:2"`
+}
+
+// Poll model, the question and options of a poll message. Votes are
+// counted when the poll is read.
+type Poll struct {
+	ID             string  `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	MessageID      string  `gorm:"type:uuid;not null;uniqueIndex"`
+	Message        Message `gorm:"foreignKey:MessageID;constraint:OnDelete:CASCADE"`
+	Question       string  `gorm:"not null"`
+	MultipleChoice bool    `gorm:"default:false;not null"`
+	Anonymous      bool    `gorm:"default:false;not null"`
+	ClosesAt       *time.Time
+	ClosedAt       *time.Time
+	Options        []PollOption `gorm:"foreignKey:PollID;constraint:OnDelete:CASCADE"`
+	Votes          []PollVote   `gorm:"foreignKey:PollID;constraint:OnDelete:CASCADE"`
+	CreatedAt      time.Time    `gorm:"autoCreateTime"`
+}
+
+type PollOption struct {
+	ID       string `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	PollID   string `gorm:"type:uuid;not null;index"`
+	Position int    `gorm:"not null"`
+	Text     string `gorm:"not null"`
+}
+
+// PollVote model, one row per chosen option
+type PollVote struct {
+	PollID    string     `gorm:"type:uuid;primaryKey"`
+	OptionID  string     `gorm:"type:uuid;primaryKey"`
+	Option    PollOption `gorm:"foreignKey:OptionID;constraint:OnDelete:CASCADE"`
+	UserID    string     `gorm:"type:uuid;primaryKey;index"`
+	User      User       `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time  `gorm:"autoCreateTime"`
+}
+
+// ImportRecord remembers which chat exports a user already imported, keyed
+// by the SHA-256 of the uploaded file
+type ImportRecord struct {
+	ID             string    `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	UserID         string    `gorm:"type:uuid;not null;uniqueIndex:idx_import_user_hash"`
+	User           User      `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	Hash           string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_import_user_hash"`
+	Source         string    `gorm:"type:varchar(16);not null"`
+	ConversationID string    `gorm:"type:uuid;not null"`
+	Imported       int       `gorm:"not null"`
+	CreatedAt      time.Time `gorm:"autoCreateTime"`
+}
+
+// ImportedSender model, a sender of a chat someone imported who is not the
+// importer. A placeholder user sends their messages until the account the
+// importer mapped them to confirms it, which then takes the messages over.
+type ImportedSender struct {
+	ID            string            `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	ImporterID    string            `gorm:"type:uuid;not null;uniqueIndex:idx_imported_sender"`
+	Importer      User              `gorm:"foreignKey:ImporterID;constraint:OnDelete:CASCADE"`
+	Source        string            `gorm:"type:varchar(16);not null;uniqueIndex:idx_imported_sender"`
+	SenderKey     string            `gorm:"type:varchar(64);not null;uniqueIndex:idx_imported_sender"` // hash of the export sender id
+	Name          string            `gorm:"type:varchar(128);not null"`
+	PlaceholderID string            `gorm:"type:uuid;not null"`
+	Placeholder   User              `gorm:"foreignKey:PlaceholderID;constraint:OnDelete:CASCADE"`
+	ClaimUserID   *string           `gorm:"type:uuid;index"` // account the importer mapped the sender to
+	ClaimUser     *User             `gorm:"foreignKey:ClaimUserID;constraint:OnDelete:SET NULL"`
+	ClaimStatus   ImportClaimStatus `gorm:"type:varchar(16);default:'';not null"`
+	CreatedAt     time.Time         `gorm:"autoCreateTime"`
+	UpdatedAt     time.Time         `gorm:"autoUpdateTime"`
+}
+
+// LinkPreview model, cached per URL and shared between messages
+type LinkPreview struct {
+	ID          string `gorm:"type:uuid;default:uuid_generate_v4();primaryKey"`
+	URL         string `gorm:"uniqueIndex;not null"`
+	Title       string
+	Description string
+	SiteName    string
+	ImageURL    string
+	Type        string
+	Failed      bool
+	FetchedAt   time.Time
+}
+
 type SendMessage struct {
-	ID             string    `json:"id"`
-	ConversationID string    `json:"conversationId"`
-	SenderID       string    `json:"senderId"`
-	Body           string    `json:"body"`
-	CreatedAt      time.Time `json:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt"`
+	ID             string           `json:"id"`
+	ClientID       string           `json:"clientId,omitempty"`
+	ConversationID string           `json:"conversationId"`
+	Seq            int64            `json:"seq"`
+	SenderID       string           `json:"senderId"`
+	Body           string           `json:"body"`
+	Entities       Entities         `json:"entities,omitempty"`
+	ForwardedFrom  *ForwardInfo     `json:"forwardedFrom,omitempty"`
+	Attachments    []AttachmentInfo `json:"attachments,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	UpdatedAt      time.Time        `json:"updatedAt"`
 }
 type MessagePlain struct {
 	ID         uuid.UUID `json:"id,omitempty"`
@@ -80,17 +412,74 @@ type MessagePlain struct {
 	Timestamp  string    `json:"time,omitempty"`
 	IsFile     bool      `json:"file,omitempty"`
 	FilePath   string    `json:"filePath,omitempty"`
+	// ids returned by the upload endpoint
+	Attachments []string `json:"attachments,omitempty"`
+	// delivers the message later through the scheduler
+	SendAt *time.Time `json:"sendAt,omitempty"`
+	// unique per sender, a retry with the same id returns the first message
+	ClientID string `json:"clientId,omitempty"`
+	// "markdown" parses Content into plain text and Entities
+	Format   string   `json:"format,omitempty"`
+	Entities Entities `json:"-"`
+	// moderation results to record once the message is stored
+	Findings []moderation.Finding `json:"-"`
 }
 
 type MessageType struct {
-	ID          string    `json:"id"`
-	Body        string    `json:"body"`
-	SenderID    string    `json:"senderId"`
-	CreatedAt   time.Time `json:"createdAt"`
-	ShouldShake *bool     `json:"shouldShake,omitempty"`
+	ID             string                `json:"id"`
+	ClientID       string                `json:"clientId,omitempty"`
+	ConversationID string                `json:"conversationId,omitempty"`
+	Seq            int64                 `json:"seq,omitempty"`
+	Body           string                `json:"body"`
+	Entities       Entities              `json:"entities,omitempty"`
+	SenderID       string                `json:"senderId"`
+	Kind           MessageKind           `json:"kind,omitempty"`
+	SystemAction   string                `json:"action,omitempty"`
+	TargetID       string                `json:"targetId,omitempty"`
+	ForwardedFrom  *ForwardInfo          `json:"forwardedFrom,omitempty"`
+	ImportedFrom   string                `json:"importedFrom,omitempty"`
+	Attachments    []AttachmentInfo      `json:"attachments,omitempty"`
+	LinkPreviews   []linkpreview.Preview `json:"linkPreviews,omitempty"`
+	Mentions       []MentionInfo         `json:"mentions,omitempty"`
+	Poll           *PollInfo             `json:"poll,omitempty"`
+	CreatedAt      time.Time             `json:"createdAt"`
+	ExpiresAt      *time.Time            `json:"expiresAt,omitempty"`
+	ShouldShake    *bool                 `json:"shouldShake,omitempty"`
+}
+
+type AttachmentInfo struct {
+	ID          string          `json:"id"`
+	FileName    string          `json:"fileName"`
+	ContentType string          `json:"contentType"`
+	Size        int64           `json:"size"`
+	URL         string          `json:"url"`
+	Width       int             `json:"width,omitempty"`
+	Height      int             `json:"height,omitempty"`
+	BlurHash    string          `json:"blurhash,omitempty"`
+	Thumbnails  []ThumbnailInfo `json:"thumbnails,omitempty"`
+}
+
+type ThumbnailInfo struct {
+	Size   string `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+type MentionInfo struct {
+	UserID string `json:"userId"`
+	All    bool   `json:"all,omitempty"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
 }
+
 type PostgresMessage struct {
-	db *gorm.DB
+	db           *gorm.DB
+	push         PushNotifier
+	mediaQueue   chan string
+	previews     *linkpreview.Fetcher
+	previewSlots chan struct{}
+	moderator    *moderation.Pipeline
 }
 
 // Gender type
@@ -101,11 +490,86 @@ const (
 	GenderFemale Gender = "female"
 )
 
+type MessageKind string
+
+const (
+	MessageKindText   MessageKind = "text"
+	MessageKindSystem MessageKind = "system"
+	MessageKindPoll   MessageKind = "poll"
+)
+
+type ParticipantRole string
+
+const (
+	RoleOwner  ParticipantRole = "owner"
+	RoleAdmin  ParticipantRole = "admin"
+	RoleMember ParticipantRole = "member"
+)
+
+type MessagePrivacy string
+
+const (
+	PrivacyEveryone MessagePrivacy = "everyone"
+	PrivacyContacts MessagePrivacy = "contacts"
+)
+
+type ContactRequestStatus string
+
+const (
+	ContactRequestPending  ContactRequestStatus = "pending"
+	ContactRequestAccepted ContactRequestStatus = "accepted"
+	ContactRequestDeclined ContactRequestStatus = "declined"
+)
+
+type ImportClaimStatus string
+
+const (
+	ImportClaimPending   ImportClaimStatus = "pending"
+	ImportClaimConfirmed ImportClaimStatus = "confirmed"
+	ImportClaimDeclined  ImportClaimStatus = "declined"
+)
+
+type JoinRequestStatus string
+
+const (
+	JoinRequestPending  JoinRequestStatus = "pending"
+	JoinRequestApproved JoinRequestStatus = "approved"
+	JoinRequestDeclined JoinRequestStatus = "declined"
+)
+
+type ModerationFlagStatus string
+
+const (
+	FlagPending   ModerationFlagStatus = "pending"
+	FlagDismissed ModerationFlagStatus = "dismissed"
+	FlagRemoved   ModerationFlagStatus = "removed"
+)
+
+type ScheduledStatus string
+
+const (
+	ScheduledPending  ScheduledStatus = "pending"
+	ScheduledSent     ScheduledStatus = "sent"
+	ScheduledCanceled ScheduledStatus = "canceled"
+	ScheduledFailed   ScheduledStatus = "failed"
+)
+
+type AttachmentStatus string
+
+const (
+	AttachmentPending    AttachmentStatus = "pending"
+	AttachmentProcessing AttachmentStatus = "processing"
+	AttachmentReady      AttachmentStatus = "ready"
+	AttachmentFailed     AttachmentStatus = "failed"
+)
+
 func ExpoDB() (*gorm.DB, error) {
 	db, err := gorm.Open(postgres.Open(os.Getenv("DB_STRING")), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
+	// participants carry a role, so the join table has a model of its own
+	err = db.SetupJoinTable(&Conversation{}, "Participants", &ConversationParticipant{})
 	return db, err
 }
 
@@ -116,6 +580,9 @@ func Migrate() {
 	if err := db.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`).Error; err != nil {
 		log.Fatal("Failed to enable UUID extension:", err)
 	}
+	if err := db.Exec(`CREATE EXTENSION IF NOT EXISTS pg_trgm`).Error; err != nil {
+		log.Fatal("Failed to enable trigram extension:", err)
+	}
 	if err := db.Exec(`DO $$ BEGIN
 		IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'gender') THEN
 			CREATE TYPE gender AS ENUM ('male', 'female');
@@ -124,10 +591,22 @@ func Migrate() {
 		log.Fatal("Failed to create gender enum type:", err)
 	}
 	// Perform auto-migration
-	err = db.AutoMigrate(&User{}, &Conversation{}, &Message{})
+	err = db.AutoMigrate(&User{}, &Conversation{}, &Message{}, &Attachment{}, &Thumbnail{}, &LinkPreview{}, &PinnedMessage{}, &ScheduledMessage{}, &Mention{}, &Draft{}, &ConversationEvent{}, &ImportRecord{}, &ImportedSender{}, &Poll{}, &PollOption{}, &PollVote{}, &StarredMessage{}, &ModerationFlag{}, &ConversationParticipant{}, &GroupInvite{}, &JoinRequest{}, &Block{}, &Contact{}, &ContactRequest{})
 	if err != nil {
 		log.Fatal("Failed to auto-migrate database:", err)
 	}
+	if err := backfillSequences(db); err != nil {
+		log.Fatal("Failed to backfill message sequence numbers:", err)
+	}
+	if err := backfillGroupOwners(db); err != nil {
+		log.Fatal("Failed to backfill group owners:", err)
+	}
+	if err := backfillWebPThumbnails(db); err != nil {
+		log.Fatal("Failed to queue WebP thumbnails:", err)
+	}
+	if err := createSearchIndexes(db); err != nil {
+		log.Fatal("Failed to create user search indexes:", err)
+	}
 
 	log.Println("Database migration completed successfully.")
 }
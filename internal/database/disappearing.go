@@ -0,0 +1,217 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	minDisappearAfter = int64(time.Minute / time.Second)
+	maxDisappearAfter = int64(90 * 24 * time.Hour / time.Second)
+	reaperBatchSize   = 500
+)
+
+type DisappearingSettings struct {
+	Seconds int64 `json:"seconds"`
+}
+
+type MessagesDeleted struct {
+	ConversationID string   `json:"conversationId"`
+	MessageIDs     []string `json:"messageIds"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) SetDisappearingTimer(
+	conversationID string,
+	userID string,
+	seconds int64,
+	w http.ResponseWriter,
+) error {
+	if seconds != 0 && (seconds < minDisappearAfter || seconds > maxDisappearAfter) {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "timer must be between one minute and 90 days, or 0 to turn it off"},
+		)
+	}
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	}
+
+	var systemMessage *Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Conversation{}).
+			Where("id = ?", conversationID).
+			Update("disappear_after", seconds).Error
+		if err != nil {
+			return err
+		}
+		body := "turned off disappearing messages"
+		if seconds > 0 {
+			body = "set disappearing messages to " + formatTimer(seconds)
+		}
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, "disappearing_timer", "", body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.notifyParticipants(conversationID, newMessagePayload(*systemMessage))
+	return utils.WriteJson(w, http.StatusOK, DisappearingSettings{Seconds: seconds})
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+// reaper
+
+// StartReaper hard deletes expired messages together with their attachment
+// files every interval. GetMessage already hides them in between runs.
+func (m *PostgresMessage) StartReaper(interval time.Duration) {
+	go func() {
+		for {
+			for {
+				deleted, err := m.reapExpiredMessages()
+				if err != nil {
+					log.Printf("Error deleting expired messages: %v", err)
+				}
+				if deleted < reaperBatchSize {
+					break
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (m *PostgresMessage) reapExpiredMessages() (int, error) {
+	var messages []Message
+	err := m.db.Select("id", "conversation_id").
+		Preload("Attachments").
+		Preload("Attachments.Thumbnails").
+		Where("expires_at <= ?", time.Now()).
+		Limit(reaperBatchSize).
+		Find(&messages).Error
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	if err := m.deleteMessages(messages); err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
+
+// deleteMessages removes messages for everyone together with their upload
+// files and tells the participants. The messages need their Attachments and
+// Attachments.Thumbnails preloaded.
+func (m *PostgresMessage) deleteMessages(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+	}
+	// attachments, thumbnails and pins go with the message through cascades
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id IN ?", ids).Delete(&Message{}).Error; err != nil {
+			return err
+		}
+		for _, message := range messages {
+			_, err := appendEvent(tx, message.ConversationID, EventMessageDeleted, message.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	byConversation := map[string][]string{}
+	for _, message := range messages {
+		byConversation[message.ConversationID] = append(byConversation[message.ConversationID], message.ID)
+		for _, attachment := range message.Attachments {
+			m.removeUpload(attachment.Path)
+			for _, thumb := range attachment.Thumbnails {
+				m.removeUpload(thumb.Path)
+			}
+		}
+	}
+	for conversationID, messageIDs := range byConversation {
+		m.notifyParticipants(conversationID, SocketEvent{
+			Type:    "messagesDeleted",
+			Content: MessagesDeleted{ConversationID: conversationID, MessageIDs: messageIDs},
+		})
+	}
+	return nil
+}
+
+// removeUpload deletes a stored file once no attachment or thumbnail row
+// refers to it anymore, forwarded copies share the files of their source
+func (m *PostgresMessage) removeUpload(path string) {
+	if path == "" {
+		return
+	}
+	var refs int64
+	err := m.db.Raw(`SELECT (SELECT COUNT(*) FROM attachments WHERE path = ?) +
+		(SELECT COUNT(*) FROM thumbnails WHERE path = ?)`, path, path).Scan(&refs).Error
+	if err != nil {
+		log.Printf("Error counting references to upload %s: %v", path, err)
+		return
+	}
+	if refs > 0 {
+		return
+	}
+	if err := os.Remove(filepath.Join(uploadDir(), path)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing upload %s: %v", path, err)
+	}
+}
+
+// formatTimer renders a timer like 1h, 7d or 1h30m
+func formatTimer(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	days := int64(d / (24 * time.Hour))
+	d -= time.Duration(days) * 24 * time.Hour
+	hours := int64(d / time.Hour)
+	d -= time.Duration(hours) * time.Hour
+	minutes := int64(d / time.Minute)
+
+	out := ""
+	for _, part := range []struct {
+		value int64
+		unit  string
+	}{{days, "d"}, {hours, "h"}, {minutes, "m"}} {
+		if part.value > 0 {
+			out += fmt.Sprintf("%d%s", part.value, part.unit)
+		}
+	}
+	if out == "" {
+		out = fmt.Sprintf("%ds", seconds)
+	}
+	return out
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeDisappearingSettings(r *http.Request) (*DisappearingSettings, error) {
+	settings := new(DisappearingSettings)
+	err := json.NewDecoder(r.Body).Decode(settings)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
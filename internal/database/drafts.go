@@ -0,0 +1,165 @@
+package database
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const maxDraftLength = 16 << 10
+
+type DraftPlain struct {
+	Body string `json:"body"`
+	// client clock of the edit, the newest write wins
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type DraftInfo struct {
+	ConversationID string    `json:"conversationId"`
+	Body           string    `json:"body"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) SetDraft(
+	conversationID string,
+	userID string,
+	socketID string,
+	draft *DraftPlain,
+	w http.ResponseWriter,
+) error {
+	if len(draft.Body) > maxDraftLength {
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: "draft is too long"})
+	}
+	// a clear stamped with the server clock could wipe a newer edit made on
+	// a device whose clock runs behind
+	if draft.Body == "" && draft.UpdatedAt.IsZero() {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "updatedAt is required to clear a draft"},
+		)
+	}
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	}
+	if draft.UpdatedAt.IsZero() {
+		draft.UpdatedAt = time.Now()
+	}
+
+	// clearing stores an empty body so an older write cannot bring it back
+	row := Draft{
+		UserID:          userID,
+		ConversationID:  conversationID,
+		Body:            draft.Body,
+		ClientUpdatedAt: draft.UpdatedAt,
+	}
+	result := m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "conversation_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"body", "client_updated_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "drafts.client_updated_at < excluded.client_updated_at"},
+		}},
+	}).Create(&row)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	var stored Draft
+	err = m.db.Where("user_id = ? AND conversation_id = ?", userID, conversationID).First(&stored).Error
+	if err != nil {
+		return err
+	}
+	info := draftInfo(stored)
+	if result.RowsAffected > 0 {
+		notifyUserExcept(userID, socketID, SocketEvent{Type: "draftUpdated", Content: info})
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetDraft(conversationID string, userID string, w http.ResponseWriter) error {
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	}
+
+	var drafts []Draft
+	err = m.db.Where("user_id = ? AND conversation_id = ?", userID, conversationID).
+		Limit(1).
+		Find(&drafts).Error
+	if err != nil {
+		return err
+	}
+	if len(drafts) == 0 {
+		return utils.WriteJson(w, http.StatusOK, DraftInfo{ConversationID: conversationID})
+	}
+	return utils.WriteJson(w, http.StatusOK, draftInfo(drafts[0]))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetDrafts(userID string, w http.ResponseWriter) error {
+	var drafts []Draft
+	err := m.db.Where("user_id = ? AND body <> ''", userID).
+		Order("client_updated_at DESC").
+		Find(&drafts).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch drafts"},
+		)
+	}
+
+	infos := []DraftInfo{}
+	for _, draft := range drafts {
+		infos = append(infos, draftInfo(draft))
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// draftPartners returns the users whose one-to-one chat with userID has a
+// draft, groups are keyed by their conversation id
+func (m *PostgresMessage) draftPartners(userID string) (map[string]bool, error) {
+	var partners []string
+	err := m.db.Table("drafts").
+		Joins("JOIN conversations c ON c.id = drafts.conversation_id").
+		Joins("JOIN conversation_participants cp ON cp.conversation_id = drafts.conversation_id").
+		Where("drafts.user_id = ? AND drafts.body <> ''", userID).
+		Where("c.is_group OR cp.user_id <> ?", userID).
+		Distinct().
+		Pluck("CASE WHEN c.is_group THEN c.id::text ELSE cp.user_id::text END", &partners).Error
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(partners))
+	for _, id := range partners {
+		set[id] = true
+	}
+	return set, nil
+}
+
+func draftInfo(d Draft) DraftInfo {
+	return DraftInfo{ConversationID: d.ConversationID, Body: d.Body, UpdatedAt: d.ClientUpdatedAt}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeDraft(r *http.Request) (*DraftPlain, error) {
+	draft := new(DraftPlain)
+	err := json.NewDecoder(r.Body).Decode(draft)
+	if err != nil {
+		return nil, err
+	}
+	return draft, nil
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/richtext"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+// Entities are the formatting spans of a message body, stored as jsonb
+type Entities []richtext.Entity
+
+func (e Entities) Value() (driver.Value, error) {
+	if len(e) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(e)
+	return string(b), err
+}
+
+func (e *Entities) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*e = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, e)
+	case string:
+		return json.Unmarshal([]byte(v), e)
+	}
+	return fmt.Errorf("cannot scan %T into Entities", value)
+}
+
+// formatMessage replaces a markdown body with its plain text and entities
+func formatMessage(mess *MessagePlain) error {
+	switch mess.Format {
+	case "", "plain":
+		mess.Entities = nil
+		return nil
+	case "markdown":
+		body, entities, err := richtext.Parse(mess.Content)
+		if err != nil {
+			return err
+		}
+		mess.Content = body
+		mess.Entities = entities
+		mess.Format = ""
+		return nil
+	}
+	return fmt.Errorf("%w: unknown format %q", richtext.ErrMalformed, mess.Format)
+}
+
+func writeFormatError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, richtext.ErrMalformed) || errors.Is(err, richtext.ErrUnsafeLink) {
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return err
+}
@@ -0,0 +1,345 @@
+package database
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	exportBatchSize = 500
+	// larger files are linked even when inlining is requested
+	maxInlineAttachmentSize = 5 << 20
+)
+
+type ExportOptions struct {
+	Format string // json, txt or html
+	From   *time.Time
+	To     *time.Time
+	// embed attachments as data URIs in html exports instead of linking them
+	Inline bool
+}
+
+type ExportedMessage struct {
+	MessageType
+	SenderName string `json:"senderName"`
+}
+
+// exportWriter renders one export format, messages arrive in conversation
+// order one batch at a time so the history is never held in memory
+type exportWriter interface {
+	contentType() string
+	extension() string
+	begin(conversationID string) error
+	message(ExportedMessage) error
+	end() error
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ExportConversation(
+	conversationID string,
+	userID string,
+	opts ExportOptions,
+	w http.ResponseWriter,
+) error {
+	participant, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !participant {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	}
+
+	buf := bufio.NewWriter(w)
+	var out exportWriter
+	switch opts.Format {
+	case "", "json":
+		out = &jsonExport{w: buf}
+	case "txt":
+		out = &textExport{w: buf}
+	case "html":
+		out = &htmlExport{w: buf, inline: opts.Inline, m: m}
+	default:
+		return utils.WriteJson(w, http.StatusBadRequest, utils.ApiError{ErrorMessage: "unknown export format"})
+	}
+
+	w.Header().Set("Content-Type", out.contentType())
+	w.Header().Set(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", "conversation-"+conversationID+"."+out.extension()),
+	)
+	w.WriteHeader(http.StatusOK)
+
+	// the status line is gone once streaming started, failures can only be
+	// logged and the client sees a truncated file
+	if err := m.streamExport(conversationID, opts, out, buf, w); err != nil {
+		log.Printf("Error exporting conversation %s: %v", conversationID, err)
+	}
+	return nil
+}
+
+func (m *PostgresMessage) streamExport(
+	conversationID string,
+	opts ExportOptions,
+	out exportWriter,
+	buf *bufio.Writer,
+	w http.ResponseWriter,
+) error {
+	if err := out.begin(conversationID); err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	var lastSeq int64
+	for {
+		query := m.db.Scopes(notExpired, preloadMessageDetails("")).
+			Where("conversation_id = ? AND seq > ?", conversationID, lastSeq)
+		if opts.From != nil {
+			query = query.Where("created_at >= ?", *opts.From)
+		}
+		if opts.To != nil {
+			query = query.Where("created_at < ?", *opts.To)
+		}
+		var batch []Message
+		if err := query.Order("seq ASC").Limit(exportBatchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+		if err := m.loadSenderNames(batch, names); err != nil {
+			return err
+		}
+		for _, message := range batch {
+			exported := ExportedMessage{MessageType: messageType(message), SenderName: names[message.SenderID]}
+			if err := out.message(exported); err != nil {
+				return err
+			}
+			lastSeq = message.Seq
+		}
+		if err := buf.Flush(); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if len(batch) < exportBatchSize {
+			break
+		}
+	}
+
+	if err := out.end(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+// loadSenderNames adds the names of senders not seen in earlier batches
+func (m *PostgresMessage) loadSenderNames(batch []Message, names map[string]string) error {
+	var missing []string
+	for _, message := range batch {
+		if _, ok := names[message.SenderID]; !ok {
+			missing = append(missing, message.SenderID)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var users []User
+	err := m.db.Select("id", "full_name").Where("id IN ?", uniqueStrings(missing)).Find(&users).Error
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		names[user.ID] = user.FullName
+	}
+	return nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+type jsonExport struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExport) contentType() string { return "application/json" }
+func (e *jsonExport) extension() string   { return "json" }
+
+func (e *jsonExport) begin(conversationID string) error {
+	_, err := fmt.Fprintf(
+		e.w,
+		`{"conversationId":%q,"exportedAt":%q,"messages":[`,
+		conversationID, time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+func (e *jsonExport) message(message ExportedMessage) error {
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExport) end() error {
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+type textExport struct {
+	w io.Writer
+}
+
+func (e *textExport) contentType() string { return "text/plain; charset=utf-8" }
+func (e *textExport) extension() string   { return "txt" }
+
+func (e *textExport) begin(conversationID string) error {
+	_, err := fmt.Fprintf(
+		e.w,
+		"Conversation %s, exported %s\n\n",
+		conversationID, time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+func (e *textExport) message(message ExportedMessage) error {
+	stamp := message.CreatedAt.UTC().Format("2006-01-02 15:04:05")
+	var err error
+	if message.Kind == MessageKindSystem {
+		_, err = fmt.Fprintf(e.w, "[%s] * %s\n", stamp, message.Body)
+	} else {
+		_, err = fmt.Fprintf(e.w, "[%s] %s: %s\n", stamp, message.SenderName, message.Body)
+	}
+	if err != nil {
+		return err
+	}
+	for _, attachment := range message.Attachments {
+		if _, err := fmt.Fprintf(e.w, "    <attachment: %s %s>\n", attachment.FileName, attachment.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *textExport) end() error { return nil }
+
+// ////////////////////////////////////////////////////////////////////////////////////
+type htmlExport struct {
+	w      io.Writer
+	inline bool
+	m      *PostgresMessage
+}
+
+func (e *htmlExport) contentType() string { return "text/html; charset=utf-8" }
+func (e *htmlExport) extension() string   { return "html" }
+
+const exportStyle = `body{font-family:sans-serif;max-width:48em;margin:2em auto;color:#222}
+.msg{margin:.6em 0}.meta{color:#888;font-size:.8em}.system{color:#888;font-style:italic;text-align:center}
+.body{white-space:pre-wrap}img{max-width:100%;border-radius:4px}`
+
+func (e *htmlExport) begin(conversationID string) error {
+	_, err := fmt.Fprintf(
+		e.w,
+		"<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Conversation %s</title><style>%s</style></head><body>\n<h1>Conversation export</h1><p class=\"meta\">Exported %s</p>\n",
+		html.EscapeString(conversationID), exportStyle, time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
+
+func (e *htmlExport) message(message ExportedMessage) error {
+	stamp := message.CreatedAt.UTC().Format("2006-01-02 15:04:05")
+	if message.Kind == MessageKindSystem {
+		_, err := fmt.Fprintf(e.w, "<div class=\"system\">%s <span class=\"meta\">%s</span></div>\n",
+			html.EscapeString(message.Body), stamp)
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<div class=\"msg\"><div class=\"meta\"><b>%s</b> %s</div>",
+		html.EscapeString(message.SenderName), stamp)
+	if message.Body != "" {
+		fmt.Fprintf(&b, "<div class=\"body\">%s</div>", html.EscapeString(message.Body))
+	}
+	for _, attachment := range message.Attachments {
+		b.WriteString(e.attachment(attachment))
+	}
+	b.WriteString("</div>\n")
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *htmlExport) attachment(attachment AttachmentInfo) string {
+	name := html.EscapeString(attachment.FileName)
+	src := html.EscapeString(attachment.URL)
+	if e.inline && attachment.Size <= maxInlineAttachmentSize {
+		if uri, err := e.m.attachmentDataURI(attachment.ID, attachment.ContentType); err == nil {
+			src = uri
+		} else {
+			log.Printf("Error inlining attachment %s: %v", attachment.ID, err)
+		}
+	}
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		return fmt.Sprintf("<div><img src=\"%s\" alt=\"%s\"></div>", src, name)
+	}
+	return fmt.Sprintf("<div><a href=\"%s\" download=\"%s\">%s</a></div>", src, name, name)
+}
+
+func (e *htmlExport) end() error {
+	_, err := io.WriteString(e.w, "</body></html>\n")
+	return err
+}
+
+// attachmentDataURI reads an attachment from the upload directory, only
+// called for attachments of messages the caller may read
+func (m *PostgresMessage) attachmentDataURI(attachmentID string, contentType string) (string, error) {
+	var attachment Attachment
+	if err := m.db.Select("path").First(&attachment, "id = ?", attachmentID).Error; err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(uploadDir(), attachment.Path))
+	if err != nil {
+		return "", err
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeExportOptions(r *http.Request) (*ExportOptions, error) {
+	query := r.URL.Query()
+	opts := &ExportOptions{
+		Format: query.Get("format"),
+		Inline: query.Get("attachments") == "inline",
+	}
+	for _, bound := range []struct {
+		name   string
+		target **time.Time
+	}{{"from", &opts.From}, {"to", &opts.To}} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s date: %w", bound.name, err)
+		}
+		*bound.target = &t
+	}
+	return opts, nil
+}
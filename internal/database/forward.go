@@ -0,0 +1,260 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"gorm.io/gorm"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	maxForwardMessages = 20
+	maxForwardTargets  = 20
+)
+
+var errForwardTarget = errors.New("cannot post to one of the target conversations")
+
+type ForwardRequest struct {
+	MessageIDs      []string `json:"messageIds"`
+	ConversationIDs []string `json:"conversationIds"`
+	// one-to-one chats that may not exist yet
+	UserIDs []string `json:"userIds"`
+}
+
+type ForwardInfo struct {
+	MessageID string `json:"messageId"`
+	SenderID  string `json:"senderId"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ForwardMessages(req *ForwardRequest, senderId string, w http.ResponseWriter) error {
+	targets := len(req.ConversationIDs) + len(req.UserIDs)
+	if len(req.MessageIDs) == 0 || targets == 0 {
+		return utils.WriteJson(
+			w,
+			http.StatusBadRequest,
+			utils.ApiError{ErrorMessage: "messageIds and at least one target are required"},
+		)
+	}
+	if len(req.MessageIDs) > maxForwardMessages || targets > maxForwardTargets {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "too many messages or targets"},
+		)
+	}
+
+	sources, err := m.readableMessages(req.MessageIDs, senderId)
+	if err != nil {
+		return err
+	}
+	if len(sources) != len(uniqueStrings(req.MessageIDs)) {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errMessageNotFound.Error()})
+	}
+	// forwarded text is posted by the forwarder, so it passes their moderation
+	findings := make([][]moderation.Finding, len(sources))
+	for i := range sources {
+		if findings[i], err = m.moderateForward(&sources[i], senderId); err != nil {
+			return writeModerationError(w, err)
+		}
+	}
+
+	var forwarded []*Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		conversations, err := forwardTargets(tx, req, senderId)
+		if err != nil {
+			return err
+		}
+		for _, conversation := range conversations {
+			for i, source := range sources {
+				message, err := forwardMessage(tx, conversation, source, senderId)
+				if err != nil {
+					return err
+				}
+				if err := recordFlags(tx, message, findings[i]); err != nil {
+					return err
+				}
+				forwarded = append(forwarded, message)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errForwardTarget) {
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	if err != nil {
+		return writeBlockError(w, err)
+	}
+
+	payload := make([]SendMessage, 0, len(forwarded))
+	for _, message := range forwarded {
+		m.deliverToConversation(message)
+		payload = append(payload, sendMessagePayload(*message))
+	}
+	return utils.WriteJson(w, http.StatusCreated, payload)
+}
+
+// readableMessages loads the requested messages in the given order, dropping
+// any the user cannot see
+func (m *PostgresMessage) readableMessages(ids []string, userID string) ([]Message, error) {
+	var messages []Message
+	err := m.db.Joins("JOIN conversation_participants cp ON cp.conversation_id = messages.conversation_id").
+		Where("messages.id IN ? AND cp.user_id = ? AND messages.kind = ?", ids, userID, MessageKindText).
+		Scopes(notExpired).
+		Scopes(preloadMessageDetails("")).
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]Message{}
+	for _, message := range messages {
+		byID[message.ID] = message
+	}
+	ordered := make([]Message, 0, len(messages))
+	for _, id := range uniqueStrings(ids) {
+		if message, ok := byID[id]; ok {
+			ordered = append(ordered, message)
+		}
+	}
+	return ordered, nil
+}
+
+// moderateForward masks source in place like a new message of senderID,
+// previews of a changed message are dropped as they may show what was masked
+func (m *PostgresMessage) moderateForward(source *Message, senderID string) ([]moderation.Finding, error) {
+	mess := MessagePlain{Content: source.Body, Entities: source.Entities}
+	if err := m.moderate(&mess, senderID); err != nil {
+		return nil, err
+	}
+	if mess.Content != source.Body || len(mess.Entities) != len(source.Entities) {
+		source.LinkPreviews = nil
+	}
+	source.Body, source.Entities = mess.Content, mess.Entities
+	return mess.Findings, nil
+}
+
+// forwardTargets resolves the target conversations, the sender has to be a
+// participant of every listed conversation
+func forwardTargets(tx *gorm.DB, req *ForwardRequest, senderId string) ([]*Conversation, error) {
+	var conversations []*Conversation
+	conversationIDs := uniqueStrings(req.ConversationIDs)
+	if len(conversationIDs) > 0 {
+		var found []Conversation
+		err := tx.Joins("JOIN conversation_participants cp ON cp.conversation_id = conversations.id").
+			Where("conversations.id IN ? AND cp.user_id = ?", conversationIDs, senderId).
+			Find(&found).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(found) != len(conversationIDs) {
+			return nil, errForwardTarget
+		}
+		for i := range found {
+			conversations = append(conversations, &found[i])
+		}
+	}
+
+	for _, userID := range uniqueStrings(req.UserIDs) {
+		var count int64
+		if err := tx.Model(&User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, errForwardTarget
+		}
+		conversation, err := findOrCreateConversation(tx, senderId, userID)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, nil
+}
+
+// forwardMessage copies source into conversation. Attachments are copied by
+// reference, the new rows point at the same stored files and thumbnails.
+func forwardMessage(tx *gorm.DB, conversation *Conversation, source Message, senderId string) (*Message, error) {
+	originID, originSender := source.ID, source.SenderID
+	if source.ForwardedFromID != nil {
+		originID = *source.ForwardedFromID
+		originSender = stringValue(source.ForwardedFromSenderID)
+	}
+
+	message := &Message{
+		Kind:                  MessageKindText,
+		SenderID:              senderId,
+		Body:                  source.Body,
+		Entities:              source.Entities,
+		ForwardedFromID:       &originID,
+		ForwardedFromSenderID: &originSender,
+	}
+	if err := storeInConversation(tx, conversation, message); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range source.Attachments {
+		clone := attachment
+		clone.ID = ""
+		clone.MessageID = &message.ID
+		clone.Thumbnails = nil
+		if err := tx.Omit("Thumbnails").Create(&clone).Error; err != nil {
+			return nil, err
+		}
+		for _, thumb := range attachment.Thumbnails {
+			thumbClone := thumb
+			thumbClone.ID = ""
+			thumbClone.AttachmentID = clone.ID
+			if err := tx.Create(&thumbClone).Error; err != nil {
+				return nil, err
+			}
+			clone.Thumbnails = append(clone.Thumbnails, thumbClone)
+		}
+		message.Attachments = append(message.Attachments, clone)
+	}
+
+	if len(source.LinkPreviews) > 0 {
+		previews := source.LinkPreviews
+		if err := tx.Model(message).Association("LinkPreviews").Append(&previews); err != nil {
+			return nil, err
+		}
+		message.LinkPreviews = previews
+	}
+	return message, nil
+}
+
+func forwardInfo(message *Message) *ForwardInfo {
+	if message.ForwardedFromID == nil {
+		return nil
+	}
+	return &ForwardInfo{
+		MessageID: *message.ForwardedFromID,
+		SenderID:  stringValue(message.ForwardedFromSenderID),
+	}
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeForwardRequest(r *http.Request) (*ForwardRequest, error) {
+	req := new(ForwardRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,485 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	maxGroupNameLength = 100
+	maxGroupMembers    = 256
+	maxAvatarURLLength = 2048
+)
+
+var (
+	errInvalidGroupName  = errors.New("group name must be 1 to 100 characters")
+	errInvalidAvatarURL  = errors.New("avatar must be an http(s) URL or an uploaded attachment")
+	errTooManyMembers    = errors.New("too many group members")
+	errUnknownMember     = errors.New("one or more members do not exist")
+	errNotGroup          = errors.New("conversation is not a group")
+	errGroupScheduleSend = errors.New("scheduling is only supported for direct messages")
+)
+
+type GroupPlain struct {
+	Name      *string  `json:"name"`
+	AvatarURL *string  `json:"avatarUrl"`
+	MemberIDs []string `json:"memberIds"`
+}
+
+type ConversationInfo struct {
+	ID             string       `json:"id"`
+	IsGroup        bool         `json:"isGroup"`
+	Name           string       `json:"name,omitempty"`
+	AvatarURL      string       `json:"avatarUrl,omitempty"`
+	CreatedByID    string       `json:"createdById,omitempty"`
+	DisappearAfter int64        `json:"disappearAfter,omitempty"`
+	Participants   []MemberInfo `json:"participants"`
+	CreatedAt      time.Time    `json:"createdAt"`
+}
+
+type MemberInfo struct {
+	ID         string          `json:"id"`
+	FullName   string          `json:"fullname"`
+	ProfilePic string          `json:"profilePic"`
+	Role       ParticipantRole `json:"role,omitempty"`
+	JoinedAt   time.Time       `json:"joinedAt"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) CreateGroup(group *GroupPlain, creatorID string, w http.ResponseWriter) error {
+	name := ""
+	if group.Name != nil {
+		name = strings.TrimSpace(*group.Name)
+	}
+	if err := validateGroupName(name); err != nil {
+		return writeGroupError(w, err)
+	}
+	findings, err := m.moderateName(&name, creatorID)
+	if err != nil {
+		return writeModerationError(w, err)
+	}
+	avatarURL := ""
+	if group.AvatarURL != nil {
+		avatarURL = strings.TrimSpace(*group.AvatarURL)
+	}
+	if err := validateAvatarURL(avatarURL); err != nil {
+		return writeGroupError(w, err)
+	}
+	members := uniqueStrings(append([]string{creatorID}, group.MemberIDs...))
+	if len(members) > maxGroupMembers {
+		return writeGroupError(w, errTooManyMembers)
+	}
+	if err := m.usersExist(members); err != nil {
+		return writeGroupError(w, err)
+	}
+	if err := blockedByAny(m.db, creatorID, members); err != nil {
+		return writeGroupError(w, err)
+	}
+	if err := contactsOnlyStrangers(m.db, creatorID, members); err != nil {
+		return writeGroupError(w, err)
+	}
+
+	conversation := Conversation{IsGroup: true, Name: name, AvatarURL: avatarURL, CreatedByID: &creatorID}
+	var systemMessage *Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&conversation).Error; err != nil {
+			return err
+		}
+		participants := make([]ConversationParticipant, len(members))
+		for i, id := range members {
+			participants[i] = ConversationParticipant{ConversationID: conversation.ID, UserID: id, Role: RoleMember}
+		}
+		// the creator is always first
+		participants[0].Role = RoleOwner
+		if err := tx.Create(&participants).Error; err != nil {
+			return err
+		}
+		var err error
+		body := fmt.Sprintf("created the group %q", name)
+		systemMessage, err = m.createSystemMessage(tx, conversation.ID, creatorID, "group_created", "", body)
+		if err != nil {
+			return err
+		}
+		return recordFlags(tx, systemMessage, findings)
+	})
+	if err != nil {
+		return err
+	}
+
+	info, err := m.conversationInfo(conversation.ID)
+	if err != nil {
+		return err
+	}
+	m.notifyConversationInfo("conversationCreated", info)
+	m.notifyParticipants(conversation.ID, newMessagePayload(*systemMessage))
+	if info, err = m.redactFor(info, creatorID); err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusCreated, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetConversation(conversationID string, userID string, w http.ResponseWriter) error {
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writeGroupError(w, errNotParticipant)
+	}
+	info, err := m.conversationInfoFor(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UpdateGroup(
+	conversationID string,
+	group *GroupPlain,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if group.Name == nil && group.AvatarURL == nil {
+		return utils.WriteJson(w, http.StatusBadRequest, utils.ApiError{ErrorMessage: "nothing to update"})
+	}
+	var name, avatarURL string
+	var findings []moderation.Finding
+	if group.Name != nil {
+		name = strings.TrimSpace(*group.Name)
+		if err := validateGroupName(name); err != nil {
+			return writeGroupError(w, err)
+		}
+		var err error
+		findings, err = m.moderateName(&name, userID)
+		if err != nil {
+			return writeModerationError(w, err)
+		}
+	}
+	if group.AvatarURL != nil {
+		avatarURL = strings.TrimSpace(*group.AvatarURL)
+		if err := validateAvatarURL(avatarURL); err != nil {
+			return writeGroupError(w, err)
+		}
+	}
+	if err := m.canManageGroup(m.db, conversationID, userID); err != nil {
+		return writeGroupError(w, err)
+	}
+
+	var systemMessages []*Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		conversation, role, err := m.groupFor(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		if !role.canManage() {
+			return errNotGroupAdmin
+		}
+		if group.Name != nil && name != conversation.Name {
+			if err := tx.Model(conversation).Update("name", name).Error; err != nil {
+				return err
+			}
+			body := fmt.Sprintf("renamed the group to %q", name)
+			message, err := m.createSystemMessage(tx, conversationID, userID, "group_renamed", "", body)
+			if err != nil {
+				return err
+			}
+			if err := recordFlags(tx, message, findings); err != nil {
+				return err
+			}
+			systemMessages = append(systemMessages, message)
+		}
+		if group.AvatarURL != nil && avatarURL != conversation.AvatarURL {
+			if err := tx.Model(conversation).Update("avatar_url", avatarURL).Error; err != nil {
+				return err
+			}
+			body := "changed the group photo"
+			if avatarURL == "" {
+				body = "removed the group photo"
+			}
+			message, err := m.createSystemMessage(tx, conversationID, userID, "group_avatar_changed", "", body)
+			if err != nil {
+				return err
+			}
+			systemMessages = append(systemMessages, message)
+		}
+		return nil
+	})
+	if err != nil {
+		return writeGroupError(w, err)
+	}
+
+	info, err := m.conversationInfo(conversationID)
+	if err != nil {
+		return err
+	}
+	if len(systemMessages) > 0 {
+		m.notifyConversationInfo("conversationUpdated", info)
+		for _, message := range systemMessages {
+			m.notifyParticipants(conversationID, newMessagePayload(*message))
+		}
+	}
+	if info, err = m.redactFor(info, userID); err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) SendToConversation(
+	conversationID string,
+	mess *MessagePlain,
+	senderID string,
+	w http.ResponseWriter,
+) error {
+	if len(mess.ClientID) > maxClientIDLength {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "clientId is too long"},
+		)
+	}
+	if mess.SendAt != nil {
+		return writeGroupError(w, errGroupScheduleSend)
+	}
+	if err := formatMessage(mess); err != nil {
+		return writeFormatError(w, err)
+	}
+	if err := validateMessage(mess); err != nil {
+		return writeSendError(w, err)
+	}
+	ok, err := m.isParticipant(conversationID, senderID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writeGroupError(w, errNotParticipant)
+	}
+	var conversation Conversation
+	if err := m.db.First(&conversation, "id = ?", conversationID).Error; err != nil {
+		return err
+	}
+	if err := directBlock(m.db, &conversation, senderID); err != nil {
+		return writeBlockedSend(w, mess, senderID, err)
+	}
+	if existing, err := m.messageByClientID(senderID, mess.ClientID); err != nil || existing != nil {
+		if err != nil {
+			return err
+		}
+		return utils.WriteJson(w, http.StatusOK, sendMessagePayload(*existing))
+	}
+	if err := m.moderate(mess, senderID); err != nil {
+		return writeModerationError(w, err)
+	}
+
+	var newMessage *Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		// hold the sender's membership until the message is in, so a removal
+		// either lands first and rejects it or waits for it
+		var participant ConversationParticipant
+		err := tx.Clauses(clause.Locking{Strength: "SHARE"}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, senderID).
+			First(&participant).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errNotParticipant
+		} else if err != nil {
+			return err
+		}
+		var conversation Conversation
+		if err := tx.First(&conversation, "id = ?", conversationID).Error; err != nil {
+			return err
+		}
+		newMessage, err = storeMessageIn(tx, &conversation, mess, senderID)
+		return err
+	})
+	if errors.Is(err, errDuplicateClientID) {
+		existing, err := m.messageByClientID(senderID, mess.ClientID)
+		if err != nil || existing == nil {
+			return err
+		}
+		return utils.WriteJson(w, http.StatusOK, sendMessagePayload(*existing))
+	} else if errors.Is(err, errNotParticipant) {
+		return writeGroupError(w, err)
+	} else if err != nil {
+		return writeBlockError(w, err)
+	}
+
+	m.deliverToConversation(newMessage)
+	return utils.WriteJson(w, http.StatusCreated, sendMessagePayload(*newMessage))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetConversationMessages(
+	conversationID string,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writeGroupError(w, errNotParticipant)
+	}
+
+	var messages []Message
+	err = m.db.Scopes(notExpired, preloadMessageDetails("")).
+		Where("conversation_id = ?", conversationID).
+		Order("seq ASC, created_at ASC").
+		Find(&messages).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch the conversation"},
+		)
+	}
+
+	messageArr := []MessageType{}
+	for _, message := range messages {
+		messageArr = append(messageArr, messageType(message))
+	}
+	return utils.WriteJson(w, http.StatusOK, messageArr)
+}
+
+// groupFor loads a group conversation userID takes part in along with their
+// role in it
+func (m *PostgresMessage) groupFor(
+	db *gorm.DB,
+	conversationID string,
+	userID string,
+) (*Conversation, ParticipantRole, error) {
+	var conversation Conversation
+	err := db.Where("id = ?", conversationID).First(&conversation).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, "", errNotParticipant
+	} else if err != nil {
+		return nil, "", err
+	}
+	role, err := participantRole(db, conversationID, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if !conversation.IsGroup {
+		return nil, "", errNotGroup
+	}
+	return &conversation, role, nil
+}
+
+func (m *PostgresMessage) conversationInfo(conversationID string) (ConversationInfo, error) {
+	var conversation Conversation
+	if err := m.db.First(&conversation, "id = ?", conversationID).Error; err != nil {
+		return ConversationInfo{}, err
+	}
+	members := []MemberInfo{}
+	err := m.db.Table("conversation_participants cp").
+		Select("u.id, u.full_name, u.profile_pic, cp.role, cp.joined_at").
+		Joins("JOIN users u ON u.id = cp.user_id").
+		Where("cp.conversation_id = ?", conversationID).
+		Order("cp.joined_at ASC").
+		Scan(&members).Error
+	if err != nil {
+		return ConversationInfo{}, err
+	}
+	if !conversation.IsGroup {
+		// roles mean nothing outside of groups
+		for i := range members {
+			members[i].Role = ""
+		}
+	}
+	return ConversationInfo{
+		ID:             conversation.ID,
+		IsGroup:        conversation.IsGroup,
+		Name:           conversation.Name,
+		AvatarURL:      conversation.AvatarURL,
+		CreatedByID:    stringValue(conversation.CreatedByID),
+		DisappearAfter: conversation.DisappearAfter,
+		Participants:   members,
+		CreatedAt:      conversation.CreatedAt,
+	}, nil
+}
+
+// usersExist fails with errUnknownMember unless every id is a user other
+// than an import placeholder
+func (m *PostgresMessage) usersExist(ids []string) error {
+	var count int64
+	err := m.db.Model(&User{}).Where("id IN ? AND NOT placeholder", ids).Count(&count).Error
+	if err != nil {
+		// malformed ids fail the uuid cast
+		return errUnknownMember
+	}
+	if int(count) != len(ids) {
+		return errUnknownMember
+	}
+	return nil
+}
+
+func validateGroupName(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxGroupNameLength {
+		return errInvalidGroupName
+	}
+	return nil
+}
+
+// validateAvatarURL accepts http(s) URLs and links to uploaded attachments,
+// an empty value removes the avatar
+func validateAvatarURL(avatarURL string) error {
+	if avatarURL == "" {
+		return nil
+	}
+	if len(avatarURL) > maxAvatarURLLength {
+		return errInvalidAvatarURL
+	}
+	if strings.HasPrefix(avatarURL, "/api/attachment/") {
+		return nil
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errInvalidAvatarURL
+	}
+	return nil
+}
+
+func writeGroupError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errNotParticipant), errors.Is(err, gorm.ErrRecordNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	case errors.Is(err, errMemberNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errNotGroupAdmin), errors.Is(err, errNotGroupOwner), errors.Is(err, errBlockedMember),
+		errors.Is(err, errContactsOnlyMember):
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errOwnerMustTransfer):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errNotGroup), errors.Is(err, errGroupScheduleSend):
+		return utils.WriteJson(w, http.StatusBadRequest, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errInvalidGroupName), errors.Is(err, errInvalidAvatarURL),
+		errors.Is(err, errTooManyMembers), errors.Is(err, errUnknownMember),
+		errors.Is(err, errInvalidRole), errors.Is(err, errRemoveSelf):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return err
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeGroup(r *http.Request) (*GroupPlain, error) {
+	group := new(GroupPlain)
+	err := json.NewDecoder(r.Body).Decode(group)
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
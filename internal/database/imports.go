@@ -0,0 +1,758 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/chatimport"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+// MaxImportSize is the largest export archive accepted by the import endpoint
+const MaxImportSize = 512 << 20
+
+const (
+	maxImportedName   = 128
+	importLookupBatch = 1000
+)
+
+type ImportOptions struct {
+	// export sender id or name to a user id. Mapping a sender to the
+	// importer marks them as the importer when their name differs from
+	// their account, mapping one to a contact asks that contact to confirm
+	// it. Until then a placeholder user sends their messages.
+	Senders map[string]string `json:"senders"`
+	// zone of the wall clock times in WhatsApp exports
+	Location *time.Location `json:"-"`
+}
+
+type ImportResult struct {
+	ConversationID  string            `json:"conversationId"`
+	Source          string            `json:"source"`
+	Imported        int               `json:"imported"`
+	Skipped         int               `json:"skipped"`
+	Senders         map[string]string `json:"senders,omitempty"` // export sender name to the user sending their messages
+	Pending         map[string]string `json:"pending,omitempty"` // export sender name to the contact asked to confirm
+	AlreadyImported bool              `json:"alreadyImported,omitempty"`
+}
+
+type ImportClaimInfo struct {
+	ID        string            `json:"id"`
+	Importer  UserInfo          `json:"importer"`
+	Name      string            `json:"name"`
+	Source    string            `json:"source"`
+	Status    ImportClaimStatus `json:"status"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// importAuthor is the account sending the messages of one export sender
+type importAuthor struct {
+	userID string
+	// shown on messages a placeholder sends
+	importedFrom string
+	// contact asked to confirm the sender, empty once they answered
+	pending string
+	// set when userID is a contact who confirmed the sender
+	confirmed bool
+}
+
+var (
+	errImportSenderTarget  = errors.New("senders can only be mapped to your own account or a contact")
+	errImportSenderClaimed = errors.New("this sender was already confirmed by another account")
+	errImportInProgress    = errors.New("this chat is already being imported")
+	errImportClaimNotFound = errors.New("import claim not found")
+	errImportClaimAnswered = errors.New("import claim was already answered")
+)
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ImportChat(file io.Reader, opts ImportOptions, userID string, w http.ResponseWriter) error {
+	// zip archives need random access, so the upload goes to disk first
+	tmp, err := os.CreateTemp("", "mumble-import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(file, MaxImportSize+1))
+	if err != nil {
+		return err
+	}
+	if size > MaxImportSize {
+		return utils.WriteJson(
+			w,
+			http.StatusRequestEntityTooLarge,
+			utils.ApiError{ErrorMessage: "export is too large"},
+		)
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	var record ImportRecord
+	err = m.db.Where("user_id = ? AND hash = ?", userID, digest).First(&record).Error
+	if err == nil {
+		return utils.WriteJson(w, http.StatusOK, ImportResult{
+			ConversationID:  record.ConversationID,
+			Source:          record.Source,
+			Imported:        record.Imported,
+			AlreadyImported: true,
+		})
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	archive, err := chatimport.Open(tmp.Name(), opts.Location)
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: err.Error()},
+		)
+	}
+	defer archive.Close()
+
+	var result *ImportResult
+	var written []string
+	var requested []ImportedSender
+	var systemMessages []*Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, written, requested, systemMessages, err = m.importChat(tx, archive, digest, opts, userID)
+		return err
+	})
+	if err != nil {
+		for _, path := range written {
+			os.Remove(filepath.Join(uploadDir(), path))
+		}
+		return writeImportError(w, err)
+	}
+	m.sweepPendingMedia()
+	if len(systemMessages) > 0 {
+		if _, err := m.notifyMembershipChange(result.ConversationID, systemMessages); err != nil {
+			log.Printf("Error announcing members of import %s: %v", result.ConversationID, err)
+		}
+	}
+	for _, imported := range requested {
+		info, err := m.importClaimInfo(imported.ID)
+		if err != nil {
+			log.Printf("Error loading import claim %s: %v", imported.ID, err)
+			continue
+		}
+		notifyUsers([]string{*imported.ClaimUserID}, SocketEvent{Type: "importClaimRequested", Content: info})
+	}
+	return utils.WriteJson(w, http.StatusCreated, result)
+}
+
+// importChat stores the messages of archive. It also returns the uploads it
+// wrote, so the caller can remove them if tx rolls back, the senders whose
+// contact is newly asked to confirm them and the system messages of the
+// members it added.
+func (m *PostgresMessage) importChat(
+	tx *gorm.DB,
+	archive *chatimport.Archive,
+	digest string,
+	opts ImportOptions,
+	userID string,
+) (*ImportResult, []string, []ImportedSender, []*Message, error) {
+	chat := archive.Chat
+	authors, requested, err := resolveImportSenders(tx, chat, opts.Senders, userID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// imported history goes in oldest first, so seq order matches time order
+	sort.SliceStable(chat.Messages, func(i, j int) bool {
+		return chat.Messages[i].Time.Before(chat.Messages[j].Time)
+	})
+	clientIDs := importClientIDs(chat)
+	existing, err := importedMessages(tx, clientIDs, userID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	conversation, err := importTarget(tx, existing, chat.Title, userID)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	result := &ImportResult{
+		ConversationID: conversation.ID,
+		Source:         chat.Source,
+		Senders:        map[string]string{},
+		Pending:        map[string]string{},
+	}
+	var members []string
+	for _, sender := range chat.Senders {
+		author := authors[sender.ID]
+		result.Senders[sender.Name] = author.userID
+		if author.pending != "" {
+			result.Pending[sender.Name] = author.pending
+		}
+		if author.confirmed {
+			members = append(members, author.userID)
+		}
+	}
+
+	var written []string
+	for i, imported := range chat.Messages {
+		// skipped before a sequence number is taken, so re-imports leave no
+		// gaps in the conversation's sequence
+		if existing[clientIDs[i]] != "" {
+			result.Skipped++
+			continue
+		}
+		author := authors[imported.SenderID]
+		message := Message{
+			ConversationID:  conversation.ID,
+			SenderID:        author.userID,
+			Body:            imported.Body,
+			ClientMessageID: &clientIDs[i],
+			ImportedFrom:    author.importedFrom,
+			CreatedAt:       imported.Time,
+		}
+		err := insertMessage(tx, &message)
+		if errors.Is(err, errDuplicateClientID) {
+			// another import of the same chat committed first
+			return nil, written, nil, nil, errImportInProgress
+		} else if err != nil {
+			return nil, written, nil, nil, err
+		}
+		result.Imported++
+
+		if imported.Media == "" {
+			continue
+		}
+		attachment, err := importMedia(archive, imported.Media, message)
+		if err != nil {
+			log.Printf("Error importing media %s: %v", imported.Media, err)
+			continue
+		}
+		written = append(written, attachment.Path)
+		if err := tx.Create(attachment).Error; err != nil {
+			return nil, written, nil, nil, err
+		}
+	}
+
+	// contacts who confirmed a sender join the group after its history
+	names, err := userNames(tx, members)
+	if err != nil {
+		return nil, written, nil, nil, err
+	}
+	var systemMessages []*Message
+	for _, memberID := range uniqueStrings(members) {
+		message, err := m.addImportMember(tx, conversation.ID, userID, memberID, "member_added", "added "+names[memberID])
+		if err != nil {
+			return nil, written, nil, nil, err
+		}
+		if message != nil {
+			systemMessages = append(systemMessages, message)
+		}
+	}
+
+	record := ImportRecord{
+		UserID:         userID,
+		Hash:           digest,
+		Source:         chat.Source,
+		ConversationID: conversation.ID,
+		Imported:       result.Imported,
+	}
+	if err := tx.Create(&record).Error; err != nil {
+		return nil, written, nil, nil, err
+	}
+	return result, written, requested, systemMessages, nil
+}
+
+func importMedia(archive *chatimport.Archive, name string, message Message) (*Attachment, error) {
+	rc, size, err := archive.OpenMedia(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if size > MaxUploadSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", MaxUploadSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, MaxUploadSize))
+	if err != nil {
+		return nil, err
+	}
+	attachment, err := writeUpload(data, name, message.SenderID)
+	if err != nil {
+		return nil, err
+	}
+	attachment.MessageID = &message.ID
+	attachment.CreatedAt = message.CreatedAt
+	return attachment, nil
+}
+
+// importClientIDs derives a client id for every message of chat from the
+// message itself rather than the file, so a later export that extends the
+// chat matches the messages imported before. Identical messages are told
+// apart by how often they were seen.
+func importClientIDs(chat *chatimport.Chat) []string {
+	ids := make([]string, len(chat.Messages))
+	seen := map[string]int{}
+	for i, message := range chat.Messages {
+		sum := sha256.Sum256([]byte(strings.Join([]string{
+			chat.Source,
+			message.SenderID,
+			message.Time.UTC().Format(time.RFC3339Nano),
+			message.Body,
+			message.Media,
+		}, "\x00")))
+		key := hex.EncodeToString(sum[:])[:40]
+		ids[i] = fmt.Sprintf("import:%s:%d", key, seen[key])
+		seen[key]++
+	}
+	return ids
+}
+
+// importedMessages returns the conversation of each of clientIDs userID
+// already imported, whether the importer, a placeholder or a contact who
+// confirmed a sender sends it now
+func importedMessages(tx *gorm.DB, clientIDs []string, userID string) (map[string]string, error) {
+	senderIDs := []string{userID}
+	var placeholders []ImportedSender
+	err := tx.Select("placeholder_id", "claim_user_id", "claim_status").
+		Where("importer_id = ?", userID).
+		Find(&placeholders).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, imported := range placeholders {
+		senderIDs = append(senderIDs, imported.PlaceholderID)
+		if imported.ClaimStatus == ImportClaimConfirmed && imported.ClaimUserID != nil {
+			senderIDs = append(senderIDs, *imported.ClaimUserID)
+		}
+	}
+	imports := tx.Model(&ImportRecord{}).Select("conversation_id").Where("user_id = ?", userID)
+
+	existing := map[string]string{}
+	for start := 0; start < len(clientIDs); start += importLookupBatch {
+		var rows []struct {
+			ClientMessageID string
+			ConversationID  string
+		}
+		err := tx.Model(&Message{}).
+			Select("client_message_id", "conversation_id").
+			Where("sender_id IN ? AND client_message_id IN ? AND conversation_id IN (?)",
+				uniqueStrings(senderIDs), clientIDs[start:min(start+importLookupBatch, len(clientIDs))], imports).
+			Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			existing[row.ClientMessageID] = row.ConversationID
+		}
+	}
+	return existing, nil
+}
+
+// importTarget continues the conversation an earlier import of the same chat
+// went into while the importer is still in it, and starts a new one otherwise
+func importTarget(tx *gorm.DB, existing map[string]string, title string, userID string) (*Conversation, error) {
+	conversationIDs := make([]string, 0, len(existing))
+	for _, conversationID := range existing {
+		conversationIDs = append(conversationIDs, conversationID)
+	}
+	for _, conversationID := range uniqueStrings(conversationIDs) {
+		var count int64
+		err := tx.Model(&ConversationParticipant{}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+			Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+		var conversation Conversation
+		if err := tx.First(&conversation, "id = ?", conversationID).Error; err != nil {
+			return nil, err
+		}
+		return &conversation, nil
+	}
+	return importConversation(tx, title, userID)
+}
+
+// resolveImportSenders decides who sends the messages of each export
+// sender. The importer sends their own, found through the mapping or else a
+// sender named like the importer's full name or username. Everyone else has
+// a placeholder user, kept per importer so later imports reuse it. Mapping a
+// sender to a contact asks the contact to confirm, no account speaks through
+// an export before it agreed to. The senders whose contact is newly asked
+// are returned too.
+func resolveImportSenders(
+	tx *gorm.DB,
+	chat *chatimport.Chat,
+	mapping map[string]string,
+	userID string,
+) (map[string]importAuthor, []ImportedSender, error) {
+	var user User
+	if err := tx.Select("id", "username", "full_name").First(&user, "id = ?", userID).Error; err != nil {
+		return nil, nil, err
+	}
+
+	authors := map[string]importAuthor{}
+	var requested []ImportedSender
+	for _, sender := range chat.Senders {
+		target, mapped := mapping[sender.ID]
+		if !mapped {
+			target, mapped = mapping[sender.Name]
+		}
+		name := strings.TrimSpace(sender.Name)
+		if target == userID || (len(mapping) == 0 &&
+			(strings.EqualFold(name, user.FullName) || strings.EqualFold(name, user.Username))) {
+			authors[sender.ID] = importAuthor{userID: userID}
+			continue
+		}
+		if mapped {
+			if ok, err := isContact(tx, userID, target); err != nil || !ok {
+				if err == nil {
+					err = errImportSenderTarget
+				}
+				return nil, nil, err
+			}
+		}
+
+		imported, err := importedSender(tx, chat.Source, sender, userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		// asking the same contact again does not reopen a declined claim
+		if mapped && (imported.ClaimUserID == nil || *imported.ClaimUserID != target) {
+			if imported.ClaimStatus == ImportClaimConfirmed && imported.ClaimUserID != nil {
+				return nil, nil, errImportSenderClaimed
+			}
+			imported.ClaimUserID, imported.ClaimStatus = &target, ImportClaimPending
+			err := tx.Model(imported).
+				Updates(map[string]interface{}{"claim_user_id": target, "claim_status": ImportClaimPending}).Error
+			if err != nil {
+				return nil, nil, err
+			}
+			requested = append(requested, *imported)
+		}
+
+		author := importAuthor{userID: imported.PlaceholderID, importedFrom: imported.Name}
+		if imported.ClaimUserID != nil {
+			switch imported.ClaimStatus {
+			case ImportClaimConfirmed:
+				author = importAuthor{userID: *imported.ClaimUserID, confirmed: true}
+			case ImportClaimPending:
+				author.pending = *imported.ClaimUserID
+			}
+		}
+		authors[sender.ID] = author
+	}
+	return authors, requested, nil
+}
+
+// importedSender returns the record of sender among the senders of
+// importerID's imports, the first import they appear in creates it along
+// with their placeholder user
+func importedSender(tx *gorm.DB, source string, sender chatimport.Sender, importerID string) (*ImportedSender, error) {
+	sum := sha256.Sum256([]byte(sender.ID))
+	key := hex.EncodeToString(sum[:])
+	var imported ImportedSender
+	err := tx.Where("importer_id = ? AND source = ? AND sender_key = ?", importerID, source, key).
+		First(&imported).Error
+	if err == nil {
+		return &imported, nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// no password, so nobody can log in as a placeholder
+	placeholder := User{
+		Username:    "imported-" + uuid.NewString(),
+		FullName:    importedName(sender.Name),
+		Placeholder: true,
+	}
+	if err := tx.Create(&placeholder).Error; err != nil {
+		return nil, err
+	}
+	// a false Searchable is the zero value, which Create replaces by the default
+	if err := tx.Model(&placeholder).Update("searchable", false).Error; err != nil {
+		return nil, err
+	}
+	imported = ImportedSender{
+		ImporterID:    importerID,
+		Source:        source,
+		SenderKey:     key,
+		Name:          placeholder.FullName,
+		PlaceholderID: placeholder.ID,
+	}
+	created := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&imported)
+	if created.Error != nil {
+		return nil, created.Error
+	}
+	if created.RowsAffected == 0 {
+		// another import of the same chat created it first
+		return nil, errImportInProgress
+	}
+	return &imported, nil
+}
+
+// addImportMember adds userID to the group of an import unless they are in
+// it already or it is full, the system message is nil then
+func (m *PostgresMessage) addImportMember(
+	tx *gorm.DB,
+	conversationID string,
+	actorID string,
+	userID string,
+	action string,
+	body string,
+) (*Message, error) {
+	if _, err := lockConversation(tx, conversationID); err != nil {
+		return nil, err
+	}
+	var existing []string
+	err := tx.Model(&ConversationParticipant{}).
+		Where("conversation_id = ?", conversationID).
+		Pluck("user_id", &existing).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxGroupMembers {
+		return nil, nil
+	}
+	for _, id := range existing {
+		if id == userID {
+			return nil, nil
+		}
+	}
+	participant := ConversationParticipant{ConversationID: conversationID, UserID: userID, Role: RoleMember}
+	if err := tx.Create(&participant).Error; err != nil {
+		return nil, err
+	}
+	return m.createSystemMessage(tx, conversationID, actorID, action, userID, body)
+}
+
+func importedName(name string) string {
+	if name = strings.TrimSpace(name); name == "" {
+		return "Imported user"
+	}
+	if runes := []rune(name); len(runes) > maxImportedName {
+		return string(runes[:maxImportedName])
+	}
+	return name
+}
+
+// importConversation creates the conversation an import is written into, a
+// group named after the chat with the importer as its only member so the
+// export never reaches anyone else's chats
+func importConversation(tx *gorm.DB, title string, userID string) (*Conversation, error) {
+	name := strings.TrimSpace(title)
+	if name == "" || validateGroupName(name) != nil {
+		name = "Imported chat"
+	}
+	conversation := Conversation{IsGroup: true, Name: name, CreatedByID: &userID}
+	if err := tx.Create(&conversation).Error; err != nil {
+		return nil, err
+	}
+	owner := ConversationParticipant{ConversationID: conversation.ID, UserID: userID, Role: RoleOwner}
+	if err := tx.Create(&owner).Error; err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetImportClaims(userID string, w http.ResponseWriter) error {
+	var claims []ImportedSender
+	err := m.db.Scopes(preloadImporter).
+		Where("claim_user_id = ? AND claim_status = ?", userID, ImportClaimPending).
+		Order("updated_at DESC").
+		Find(&claims).Error
+	if err != nil {
+		return err
+	}
+	hidden, err := hiddenProfiles(m.db, userID)
+	if err != nil {
+		return err
+	}
+	infos := []ImportClaimInfo{}
+	for _, imported := range claims {
+		info := importClaimInfo(imported)
+		info.Importer = redactUser(info.Importer, hidden)
+		infos = append(infos, info)
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) AnswerImportClaim(
+	claimID string,
+	accept bool,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	var imported ImportedSender
+	var systemMessages []*Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND claim_user_id = ?", claimID, userID).
+			First(&imported).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errImportClaimNotFound
+		} else if err != nil {
+			return err
+		}
+		if imported.ClaimStatus != ImportClaimPending {
+			return errImportClaimAnswered
+		}
+		if !accept {
+			imported.ClaimStatus = ImportClaimDeclined
+			return tx.Model(&imported).Update("claim_status", ImportClaimDeclined).Error
+		}
+		if err := blockBetween(tx, userID, imported.ImporterID); err != nil {
+			return err
+		}
+		imported.ClaimStatus = ImportClaimConfirmed
+		if err := tx.Model(&imported).Update("claim_status", ImportClaimConfirmed).Error; err != nil {
+			return err
+		}
+		systemMessages, err = m.claimImportedMessages(tx, &imported, userID)
+		return err
+	})
+	if err != nil {
+		return writeImportError(w, err)
+	}
+
+	for _, message := range systemMessages {
+		if _, err := m.notifyMembershipChange(message.ConversationID, []*Message{message}); err != nil {
+			log.Printf("Error announcing %s joining %s: %v", userID, message.ConversationID, err)
+		}
+	}
+	info, err := m.importClaimInfo(imported.ID)
+	if err != nil {
+		return err
+	}
+	// a declined claim is not announced to the importer
+	if accept {
+		notifyUsers([]string{imported.ImporterID}, SocketEvent{Type: "importClaimConfirmed", Content: info})
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// claimImportedMessages hands the messages of a confirmed sender over from
+// their placeholder to userID and adds userID to the groups holding them.
+// Messages userID sent under the same client id in an import of their own
+// stay with the placeholder, the unique client ids would clash otherwise.
+func (m *PostgresMessage) claimImportedMessages(tx *gorm.DB, imported *ImportedSender, userID string) ([]*Message, error) {
+	var moved []struct {
+		ID             string
+		ConversationID string
+	}
+	err := tx.Raw(`UPDATE messages SET sender_id = ?, imported_from = ''
+		WHERE sender_id = ? AND NOT EXISTS (
+			SELECT 1 FROM messages own WHERE own.sender_id = ? AND own.client_message_id = messages.client_message_id
+		)
+		RETURNING id, conversation_id`,
+		userID, imported.PlaceholderID, userID,
+	).Scan(&moved).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Exec(`UPDATE attachments SET uploader_id = ? FROM messages
+		WHERE attachments.message_id = messages.id AND attachments.uploader_id = ? AND messages.sender_id = ?`,
+		userID, imported.PlaceholderID, userID,
+	).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// synced clients learn about the new sender through update events
+	var conversationIDs []string
+	for _, message := range moved {
+		if _, err := appendEvent(tx, message.ConversationID, EventMessageUpdated, message.ID); err != nil {
+			return nil, err
+		}
+		conversationIDs = append(conversationIDs, message.ConversationID)
+	}
+	var systemMessages []*Message
+	for _, conversationID := range uniqueStrings(conversationIDs) {
+		message, err := m.addImportMember(
+			tx, conversationID, userID, userID, "member_joined", "joined with their imported messages",
+		)
+		if err != nil {
+			return nil, err
+		}
+		if message != nil {
+			systemMessages = append(systemMessages, message)
+		}
+	}
+	return systemMessages, nil
+}
+
+func preloadImporter(db *gorm.DB) *gorm.DB {
+	return db.Preload("Importer", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name", "profile_pic")
+	})
+}
+
+func (m *PostgresMessage) importClaimInfo(claimID string) (ImportClaimInfo, error) {
+	var imported ImportedSender
+	err := m.db.Scopes(preloadImporter).First(&imported, "id = ?", claimID).Error
+	return importClaimInfo(imported), err
+}
+
+func importClaimInfo(imported ImportedSender) ImportClaimInfo {
+	return ImportClaimInfo{
+		ID: imported.ID,
+		Importer: UserInfo{
+			ID:         imported.Importer.ID,
+			FullName:   imported.Importer.FullName,
+			ProfilePic: imported.Importer.ProfilePic,
+		},
+		Name:      imported.Name,
+		Source:    imported.Source,
+		Status:    imported.ClaimStatus,
+		CreatedAt: imported.UpdatedAt,
+	}
+}
+
+func writeImportError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errImportSenderTarget), errors.Is(err, errImportSenderClaimed):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errImportInProgress), errors.Is(err, errImportClaimAnswered):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errImportClaimNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return writeBlockError(w, err)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeImportOptions(r *http.Request) (*ImportOptions, error) {
+	opts := new(ImportOptions)
+	if senders := r.FormValue("senders"); senders != "" {
+		if err := json.Unmarshal([]byte(senders), &opts.Senders); err != nil {
+			return nil, err
+		}
+	}
+	if zone := r.FormValue("timezone"); zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, err
+		}
+		opts.Location = loc
+	}
+	return opts, nil
+}
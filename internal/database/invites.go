@@ -0,0 +1,578 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	maxInviteUses      = 10000
+	maxInviteLifetime  = 365 * 24 * time.Hour
+	maxActiveInvites   = 20
+	inviteCodeByteSize = 12
+)
+
+var (
+	errInviteNotFound       = errors.New("invite not found")
+	errInviteExpired        = errors.New("invite has expired or reached its limit")
+	errInvalidInvite        = errors.New("maxUses must be between 0 and 10000 and expiresIn at most a year")
+	errTooManyInvites       = errors.New("too many active invites for this group")
+	errJoinRequestNotFound  = errors.New("join request not found")
+	errInvalidJoinDecision  = errors.New(`decision must be "approve" or "decline"`)
+	errJoinRequestCompleted = errors.New("join request was already decided")
+)
+
+type InviteRequest struct {
+	// seconds until the link expires, 0 never expires
+	ExpiresIn        int64 `json:"expiresIn"`
+	MaxUses          int   `json:"maxUses"`
+	RequiresApproval bool  `json:"requiresApproval"`
+}
+
+type InviteInfo struct {
+	ID               string     `json:"id"`
+	ConversationID   string     `json:"conversationId"`
+	Code             string     `json:"code"`
+	CreatedByID      string     `json:"createdById"`
+	ExpiresAt        *time.Time `json:"expiresAt,omitempty"`
+	MaxUses          int        `json:"maxUses"`
+	Uses             int        `json:"uses"`
+	RequiresApproval bool       `json:"requiresApproval"`
+	RevokedAt        *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+}
+
+// InvitePreview is what a user sees before joining, the group id is only
+// shown to its members
+type InvitePreview struct {
+	ConversationID   string `json:"conversationId,omitempty"`
+	Name             string `json:"name"`
+	AvatarURL        string `json:"avatarUrl,omitempty"`
+	MemberCount      int64  `json:"memberCount"`
+	RequiresApproval bool   `json:"requiresApproval"`
+	IsMember         bool   `json:"isMember"`
+	RequestPending   bool   `json:"requestPending"`
+}
+
+type JoinResult struct {
+	// "joined", "pending" or "member"
+	Status       string            `json:"status"`
+	Conversation *ConversationInfo `json:"conversation,omitempty"`
+}
+
+type JoinRequestInfo struct {
+	ID             string            `json:"id"`
+	ConversationID string            `json:"conversationId"`
+	User           UserInfo          `json:"user"`
+	Status         JoinRequestStatus `json:"status"`
+	CreatedAt      time.Time         `json:"createdAt"`
+}
+
+type JoinDecision struct {
+	Decision string `json:"decision"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) CreateInvite(
+	conversationID string,
+	req *InviteRequest,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if req.MaxUses < 0 || req.MaxUses > maxInviteUses ||
+		req.ExpiresIn < 0 || time.Duration(req.ExpiresIn)*time.Second > maxInviteLifetime {
+		return writeInviteError(w, errInvalidInvite)
+	}
+	if err := m.canManageGroup(m.db, conversationID, userID); err != nil {
+		return writeInviteError(w, err)
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		return err
+	}
+	invite := GroupInvite{
+		ConversationID:   conversationID,
+		Code:             code,
+		CreatedByID:      userID,
+		MaxUses:          req.MaxUses,
+		RequiresApproval: req.RequiresApproval,
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		invite.ExpiresAt = &expiresAt
+	}
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockConversation(tx, conversationID); err != nil {
+			return err
+		}
+		var count int64
+		err := tx.Model(&GroupInvite{}).Scopes(activeInvites).
+			Where("conversation_id = ?", conversationID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count >= maxActiveInvites {
+			return errTooManyInvites
+		}
+		return tx.Create(&invite).Error
+	})
+	if err != nil {
+		return writeInviteError(w, err)
+	}
+	return utils.WriteJson(w, http.StatusCreated, inviteInfo(invite))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetInvites(conversationID string, userID string, w http.ResponseWriter) error {
+	if err := m.canManageGroup(m.db, conversationID, userID); err != nil {
+		return writeInviteError(w, err)
+	}
+	var invites []GroupInvite
+	err := m.db.Scopes(activeInvites).
+		Where("conversation_id = ?", conversationID).
+		Order("created_at DESC").
+		Find(&invites).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch invites"},
+		)
+	}
+	infos := []InviteInfo{}
+	for _, invite := range invites {
+		infos = append(infos, inviteInfo(invite))
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) RevokeInvite(
+	conversationID string,
+	inviteID string,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if err := m.canManageGroup(m.db, conversationID, userID); err != nil {
+		return writeInviteError(w, err)
+	}
+	var invite GroupInvite
+	err := m.db.Where("id = ? AND conversation_id = ? AND revoked_at IS NULL", inviteID, conversationID).
+		First(&invite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return writeInviteError(w, errInviteNotFound)
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	invite.RevokedAt = &now
+	if err := m.db.Model(&invite).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, inviteInfo(invite))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) PreviewInvite(code string, userID string, w http.ResponseWriter) error {
+	invite, err := usableInvite(m.db, code)
+	if err != nil {
+		return writeInviteError(w, err)
+	}
+	var conversation Conversation
+	if err := m.db.First(&conversation, "id = ?", invite.ConversationID).Error; err != nil {
+		return writeInviteError(w, err)
+	}
+
+	preview := InvitePreview{
+		Name:             conversation.Name,
+		AvatarURL:        conversation.AvatarURL,
+		RequiresApproval: invite.RequiresApproval,
+	}
+	err = m.db.Model(&ConversationParticipant{}).
+		Where("conversation_id = ?", conversation.ID).
+		Count(&preview.MemberCount).Error
+	if err != nil {
+		return err
+	}
+	if preview.IsMember, err = m.isParticipant(conversation.ID, userID); err != nil {
+		return err
+	}
+	if preview.IsMember {
+		preview.ConversationID = conversation.ID
+	}
+	var pending int64
+	err = m.db.Model(&JoinRequest{}).
+		Where("conversation_id = ? AND user_id = ? AND status = ?", conversation.ID, userID, JoinRequestPending).
+		Count(&pending).Error
+	if err != nil {
+		return err
+	}
+	preview.RequestPending = pending > 0
+	return utils.WriteJson(w, http.StatusOK, preview)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) JoinByInvite(code string, userID string, w http.ResponseWriter) error {
+	invite, err := usableInvite(m.db, code)
+	if err != nil {
+		return writeInviteError(w, err)
+	}
+
+	status := "joined"
+	var systemMessage *Message
+	var joinRequest *JoinRequest
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		conversation, err := lockConversation(tx, invite.ConversationID)
+		if err != nil {
+			return err
+		}
+		if !conversation.IsGroup {
+			return errInviteNotFound
+		}
+		if _, err := participantRole(tx, conversation.ID, userID); err == nil {
+			status = "member"
+			return nil
+		} else if !errors.Is(err, errNotParticipant) {
+			return err
+		}
+
+		if invite.RequiresApproval {
+			status = "pending"
+			joinRequest, err = requestToJoin(tx, invite, userID)
+			return err
+		}
+		if err := useInvite(tx, invite.ID); err != nil {
+			return err
+		}
+		systemMessage, err = m.addJoinedMember(tx, conversation.ID, userID)
+		return err
+	})
+	if err != nil {
+		return writeInviteError(w, err)
+	}
+
+	result := JoinResult{Status: status}
+	switch status {
+	case "pending":
+		if joinRequest != nil {
+			m.notifyGroupAdmins(invite.ConversationID, SocketEvent{Type: "joinRequestCreated", Content: joinRequest.ID})
+		}
+		return utils.WriteJson(w, http.StatusAccepted, result)
+	case "joined":
+		info, err := m.notifyMembershipChange(invite.ConversationID, []*Message{systemMessage})
+		if err != nil {
+			return err
+		}
+		if info, err = m.redactFor(info, userID); err != nil {
+			return err
+		}
+		result.Conversation = &info
+	default:
+		info, err := m.conversationInfoFor(invite.ConversationID, userID)
+		if err != nil {
+			return err
+		}
+		result.Conversation = &info
+	}
+	return utils.WriteJson(w, http.StatusOK, result)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetJoinRequests(conversationID string, userID string, w http.ResponseWriter) error {
+	if err := m.canManageGroup(m.db, conversationID, userID); err != nil {
+		return writeInviteError(w, err)
+	}
+	var requests []JoinRequest
+	err := m.db.Preload("User", func(db *gorm.DB) *gorm.DB {
+		return db.Select("id", "full_name", "profile_pic")
+	}).
+		Where("conversation_id = ? AND status = ?", conversationID, JoinRequestPending).
+		Order("created_at ASC").
+		Find(&requests).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch join requests"},
+		)
+	}
+	hidden, err := hiddenProfiles(m.db, userID)
+	if err != nil {
+		return err
+	}
+	infos := []JoinRequestInfo{}
+	for _, request := range requests {
+		info := joinRequestInfo(request)
+		info.User = redactUser(info.User, hidden)
+		infos = append(infos, info)
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ReviewJoinRequest(
+	conversationID string,
+	requestID string,
+	decision *JoinDecision,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	status := JoinRequestApproved
+	switch decision.Decision {
+	case "approve":
+	case "decline":
+		status = JoinRequestDeclined
+	default:
+		return writeInviteError(w, errInvalidJoinDecision)
+	}
+
+	var request JoinRequest
+	var systemMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		_, role, err := m.lockGroup(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		if !role.canManage() {
+			return errNotGroupAdmin
+		}
+		err = tx.Where("id = ? AND conversation_id = ?", requestID, conversationID).First(&request).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errJoinRequestNotFound
+		} else if err != nil {
+			return err
+		}
+		if request.Status != JoinRequestPending {
+			return errJoinRequestCompleted
+		}
+
+		now := time.Now()
+		request.Status = status
+		request.ReviewerID = &userID
+		request.ReviewedAt = &now
+		err = tx.Model(&request).Updates(map[string]interface{}{
+			"status":      status,
+			"reviewer_id": userID,
+			"reviewed_at": now,
+		}).Error
+		if err != nil || status == JoinRequestDeclined {
+			return err
+		}
+		if _, err := participantRole(tx, conversationID, request.UserID); err == nil {
+			// added by an admin in the meantime
+			return nil
+		} else if !errors.Is(err, errNotParticipant) {
+			return err
+		}
+		systemMessage, err = m.addJoinedMember(tx, conversationID, request.UserID)
+		return err
+	})
+	if err != nil {
+		return writeInviteError(w, err)
+	}
+
+	if systemMessage != nil {
+		if _, err := m.notifyMembershipChange(conversationID, []*Message{systemMessage}); err != nil {
+			return err
+		}
+	} else if status == JoinRequestDeclined {
+		notifyUsers([]string{request.UserID}, SocketEvent{Type: "joinRequestDeclined", Content: request.ID})
+	}
+	return utils.WriteJson(w, http.StatusOK, JoinRequestInfo{
+		ID:             request.ID,
+		ConversationID: request.ConversationID,
+		User:           UserInfo{ID: request.UserID},
+		Status:         request.Status,
+		CreatedAt:      request.CreatedAt,
+	})
+}
+
+// activeInvites keeps invites that have not been revoked, run out or expired
+func activeInvites(db *gorm.DB) *gorm.DB {
+	return db.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND (max_uses = 0 OR uses < max_uses)",
+		time.Now())
+}
+
+// usableInvite looks code up, telling unknown and revoked links apart from
+// ones that expired or ran out
+func usableInvite(db *gorm.DB, code string) (*GroupInvite, error) {
+	var invite GroupInvite
+	err := db.Where("code = ? AND revoked_at IS NULL", code).First(&invite).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInviteNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if (invite.ExpiresAt != nil && !invite.ExpiresAt.After(time.Now())) ||
+		(invite.MaxUses > 0 && invite.Uses >= invite.MaxUses) {
+		return nil, errInviteExpired
+	}
+	return &invite, nil
+}
+
+// useInvite counts one use of the invite in a single conditional update, so
+// concurrent joins can never exceed MaxUses
+func useInvite(tx *gorm.DB, inviteID string) error {
+	result := tx.Model(&GroupInvite{}).Scopes(activeInvites).
+		Where("id = ?", inviteID).
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInviteExpired
+	}
+	return nil
+}
+
+// requestToJoin files a pending join request. The request takes one use of
+// the invite so a limited link cannot be used to flood the admins, asking
+// again while a request is pending changes nothing.
+func requestToJoin(tx *gorm.DB, invite *GroupInvite, userID string) (*JoinRequest, error) {
+	var existing JoinRequest
+	err := tx.Where("conversation_id = ? AND user_id = ?", invite.ConversationID, userID).First(&existing).Error
+	if err == nil && existing.Status == JoinRequestPending {
+		return nil, nil
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err := useInvite(tx, invite.ID); err != nil {
+		return nil, err
+	}
+
+	request := JoinRequest{
+		ConversationID: invite.ConversationID,
+		UserID:         userID,
+		InviteID:       invite.ID,
+		Status:         JoinRequestPending,
+	}
+	err = tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "conversation_id"}, {Name: "user_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"invite_id":   invite.ID,
+			"status":      JoinRequestPending,
+			"reviewer_id": nil,
+			"reviewed_at": nil,
+			"created_at":  time.Now(),
+			"updated_at":  time.Now(),
+		}),
+	}).Create(&request).Error
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+// addJoinedMember adds userID to a locked group as a member
+func (m *PostgresMessage) addJoinedMember(tx *gorm.DB, conversationID string, userID string) (*Message, error) {
+	var count int64
+	err := tx.Model(&ConversationParticipant{}).
+		Where("conversation_id = ?", conversationID).
+		Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count >= maxGroupMembers {
+		return nil, errTooManyMembers
+	}
+	participant := ConversationParticipant{ConversationID: conversationID, UserID: userID, Role: RoleMember}
+	if err := tx.Create(&participant).Error; err != nil {
+		return nil, err
+	}
+	return m.createSystemMessage(tx, conversationID, userID, "member_joined", userID, "joined via invite link")
+}
+
+func (m *PostgresMessage) notifyGroupAdmins(conversationID string, event interface{}) {
+	var admins []string
+	err := m.db.Model(&ConversationParticipant{}).
+		Where("conversation_id = ? AND role IN ?", conversationID, []ParticipantRole{RoleOwner, RoleAdmin}).
+		Pluck("user_id", &admins).Error
+	if err != nil {
+		log.Printf("Error loading admins of %s: %v", conversationID, err)
+		return
+	}
+	notifyUsers(admins, event)
+}
+
+func newInviteCode() (string, error) {
+	b := make([]byte, inviteCodeByteSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func inviteInfo(invite GroupInvite) InviteInfo {
+	return InviteInfo{
+		ID:               invite.ID,
+		ConversationID:   invite.ConversationID,
+		Code:             invite.Code,
+		CreatedByID:      invite.CreatedByID,
+		ExpiresAt:        invite.ExpiresAt,
+		MaxUses:          invite.MaxUses,
+		Uses:             invite.Uses,
+		RequiresApproval: invite.RequiresApproval,
+		RevokedAt:        invite.RevokedAt,
+		CreatedAt:        invite.CreatedAt,
+	}
+}
+
+func joinRequestInfo(request JoinRequest) JoinRequestInfo {
+	return JoinRequestInfo{
+		ID:             request.ID,
+		ConversationID: request.ConversationID,
+		User: UserInfo{
+			ID:         request.User.ID,
+			FullName:   request.User.FullName,
+			ProfilePic: request.User.ProfilePic,
+		},
+		Status:    request.Status,
+		CreatedAt: request.CreatedAt,
+	}
+}
+
+func writeInviteError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errInviteNotFound), errors.Is(err, errJoinRequestNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errInviteExpired):
+		return utils.WriteJson(w, http.StatusGone, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errJoinRequestCompleted), errors.Is(err, errTooManyInvites):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errInvalidInvite), errors.Is(err, errInvalidJoinDecision):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return writeGroupError(w, err)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeInviteRequest(r *http.Request) (*InviteRequest, error) {
+	req := new(InviteRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeJoinDecision(r *http.Request) (*JoinDecision, error) {
+	decision := new(JoinDecision)
+	err := json.NewDecoder(r.Body).Decode(decision)
+	if err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
@@ -0,0 +1,499 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+var (
+	errNotGroupAdmin     = errors.New("only group admins can do that")
+	errNotGroupOwner     = errors.New("only the group owner can do that")
+	errMemberNotFound    = errors.New("user is not a member of this group")
+	errInvalidRole       = errors.New(`role must be "admin" or "member"`)
+	errOwnerMustTransfer = errors.New("transfer ownership before leaving the group")
+	errRemoveSelf        = errors.New("use leave to remove yourself")
+)
+
+type MembersRequest struct {
+	MemberIDs []string `json:"memberIds"`
+}
+
+type RoleRequest struct {
+	Role ParticipantRole `json:"role"`
+}
+
+type OwnershipRequest struct {
+	UserID string `json:"userId"`
+}
+
+type RemovedFromConversation struct {
+	ConversationID string `json:"conversationId"`
+}
+
+// canManage reports whether the role may change members and group info
+func (r ParticipantRole) canManage() bool {
+	return r == RoleOwner || r == RoleAdmin
+}
+
+// participantRole returns userID's role in conversationID, errNotParticipant
+// if they are not in it
+func participantRole(db *gorm.DB, conversationID string, userID string) (ParticipantRole, error) {
+	var participant ConversationParticipant
+	err := db.Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		First(&participant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", errNotParticipant
+	}
+	return participant.Role, err
+}
+
+// canManageGroup checks that userID is an owner or admin of the group
+func (m *PostgresMessage) canManageGroup(db *gorm.DB, conversationID string, userID string) error {
+	_, role, err := m.groupFor(db, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !role.canManage() {
+		return errNotGroupAdmin
+	}
+	return nil
+}
+
+// lockGroup serialises membership changes of a group and returns the
+// conversation and the role of userID
+func (m *PostgresMessage) lockGroup(
+	tx *gorm.DB,
+	conversationID string,
+	userID string,
+) (*Conversation, ParticipantRole, error) {
+	if _, err := lockConversation(tx, conversationID); err != nil {
+		return nil, "", err
+	}
+	return m.groupFor(tx, conversationID, userID)
+}
+
+func lockConversation(tx *gorm.DB, conversationID string) (*Conversation, error) {
+	var conversation Conversation
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&conversation, "id = ?", conversationID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errNotParticipant
+	}
+	return &conversation, err
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) AddGroupMembers(
+	conversationID string,
+	req *MembersRequest,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	memberIDs := uniqueStrings(req.MemberIDs)
+	if len(memberIDs) == 0 {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "memberIds is required"},
+		)
+	}
+	if len(memberIDs) > maxGroupMembers {
+		return writeGroupError(w, errTooManyMembers)
+	}
+	if err := m.canManageGroup(m.db, conversationID, userID); err != nil {
+		return writeGroupError(w, err)
+	}
+	if err := m.usersExist(memberIDs); err != nil {
+		return writeGroupError(w, err)
+	}
+	if err := blockedByAny(m.db, userID, memberIDs); err != nil {
+		return writeGroupError(w, err)
+	}
+	if err := contactsOnlyStrangers(m.db, userID, memberIDs); err != nil {
+		return writeGroupError(w, err)
+	}
+
+	var systemMessages []*Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		_, role, err := m.lockGroup(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		if !role.canManage() {
+			return errNotGroupAdmin
+		}
+
+		var existing []string
+		err = tx.Table("conversation_participants").
+			Where("conversation_id = ?", conversationID).
+			Pluck("user_id", &existing).Error
+		if err != nil {
+			return err
+		}
+		isMember := make(map[string]bool, len(existing))
+		for _, id := range existing {
+			isMember[id] = true
+		}
+		var added []ConversationParticipant
+		for _, id := range memberIDs {
+			if !isMember[id] {
+				added = append(added, ConversationParticipant{
+					ConversationID: conversationID,
+					UserID:         id,
+					Role:           RoleMember,
+				})
+			}
+		}
+		if len(added) == 0 {
+			return nil
+		}
+		if len(existing)+len(added) > maxGroupMembers {
+			return errTooManyMembers
+		}
+		if err := tx.Create(&added).Error; err != nil {
+			return err
+		}
+
+		names, err := userNames(tx, memberIDs)
+		if err != nil {
+			return err
+		}
+		for _, participant := range added {
+			body := "added " + names[participant.UserID]
+			message, err := m.createSystemMessage(tx, conversationID, userID, "member_added", participant.UserID, body)
+			if err != nil {
+				return err
+			}
+			systemMessages = append(systemMessages, message)
+		}
+		return nil
+	})
+	if err != nil {
+		return writeGroupError(w, err)
+	}
+	return m.writeMembershipChange(conversationID, systemMessages, nil, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) RemoveGroupMember(
+	conversationID string,
+	memberID string,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if memberID == userID {
+		return writeGroupError(w, errRemoveSelf)
+	}
+
+	var systemMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		_, role, err := m.lockGroup(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		if !role.canManage() {
+			return errNotGroupAdmin
+		}
+		memberRole, err := participantRole(tx, conversationID, memberID)
+		if errors.Is(err, errNotParticipant) {
+			return errMemberNotFound
+		} else if err != nil {
+			return err
+		}
+		// admins remove members, only the owner removes admins
+		if memberRole == RoleOwner || (memberRole == RoleAdmin && role != RoleOwner) {
+			return errNotGroupOwner
+		}
+
+		err = tx.Where("conversation_id = ? AND user_id = ?", conversationID, memberID).
+			Delete(&ConversationParticipant{}).Error
+		if err != nil {
+			return err
+		}
+		names, err := userNames(tx, []string{memberID})
+		if err != nil {
+			return err
+		}
+		body := "removed " + names[memberID]
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, "member_removed", memberID, body)
+		return err
+	})
+	if err != nil {
+		return writeGroupError(w, err)
+	}
+	return m.writeMembershipChange(conversationID, []*Message{systemMessage}, []string{memberID}, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) SetMemberRole(
+	conversationID string,
+	memberID string,
+	req *RoleRequest,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if req.Role != RoleAdmin && req.Role != RoleMember {
+		return writeGroupError(w, errInvalidRole)
+	}
+
+	var systemMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		_, role, err := m.lockGroup(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		if role != RoleOwner {
+			return errNotGroupOwner
+		}
+		memberRole, err := participantRole(tx, conversationID, memberID)
+		if errors.Is(err, errNotParticipant) {
+			return errMemberNotFound
+		} else if err != nil {
+			return err
+		}
+		if memberRole == RoleOwner {
+			return errOwnerMustTransfer
+		}
+		if memberRole == req.Role {
+			return nil
+		}
+
+		err = tx.Model(&ConversationParticipant{}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, memberID).
+			Update("role", req.Role).Error
+		if err != nil {
+			return err
+		}
+		names, err := userNames(tx, []string{memberID})
+		if err != nil {
+			return err
+		}
+		action, body := "member_promoted", fmt.Sprintf("made %s an admin", names[memberID])
+		if req.Role == RoleMember {
+			action, body = "member_demoted", fmt.Sprintf("removed %s as admin", names[memberID])
+		}
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, action, memberID, body)
+		return err
+	})
+	if err != nil {
+		return writeGroupError(w, err)
+	}
+	var systemMessages []*Message
+	if systemMessage != nil {
+		systemMessages = append(systemMessages, systemMessage)
+	}
+	return m.writeMembershipChange(conversationID, systemMessages, nil, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) TransferGroupOwnership(
+	conversationID string,
+	req *OwnershipRequest,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if req.UserID == userID {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "you already own this group"},
+		)
+	}
+
+	var systemMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		_, role, err := m.lockGroup(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		if role != RoleOwner {
+			return errNotGroupOwner
+		}
+		if _, err := participantRole(tx, conversationID, req.UserID); errors.Is(err, errNotParticipant) {
+			return errMemberNotFound
+		} else if err != nil {
+			return err
+		}
+
+		// the previous owner stays on as an admin
+		err = tx.Model(&ConversationParticipant{}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+			Update("role", RoleAdmin).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&ConversationParticipant{}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, req.UserID).
+			Update("role", RoleOwner).Error
+		if err != nil {
+			return err
+		}
+		names, err := userNames(tx, []string{req.UserID})
+		if err != nil {
+			return err
+		}
+		body := fmt.Sprintf("made %s the group owner", names[req.UserID])
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, "ownership_transferred", req.UserID, body)
+		return err
+	})
+	if err != nil {
+		return writeGroupError(w, err)
+	}
+	return m.writeMembershipChange(conversationID, []*Message{systemMessage}, nil, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) LeaveGroup(conversationID string, userID string, w http.ResponseWriter) error {
+	var systemMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		_, role, err := m.lockGroup(tx, conversationID, userID)
+		if err != nil {
+			return err
+		}
+		var count int64
+		err = tx.Model(&ConversationParticipant{}).
+			Where("conversation_id = ?", conversationID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		// the last member may leave as owner, the group is then empty
+		if role == RoleOwner && count > 1 {
+			return errOwnerMustTransfer
+		}
+
+		err = tx.Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+			Delete(&ConversationParticipant{}).Error
+		if err != nil {
+			return err
+		}
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, "member_left", userID, "left the group")
+		return err
+	})
+	if err != nil {
+		return writeGroupError(w, err)
+	}
+
+	m.notifyRemoved(conversationID, []string{userID}, systemMessage)
+	if _, err := m.notifyMembershipChange(conversationID, []*Message{systemMessage}); err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, RemovedFromConversation{ConversationID: conversationID})
+}
+
+// writeMembershipChange pushes a membership change to the group and to the
+// removed users, then answers with the group as it is now
+func (m *PostgresMessage) writeMembershipChange(
+	conversationID string,
+	systemMessages []*Message,
+	removedIDs []string,
+	actorID string,
+	w http.ResponseWriter,
+) error {
+	for _, message := range systemMessages {
+		m.notifyRemoved(conversationID, removedIDs, message)
+	}
+	info, err := m.notifyMembershipChange(conversationID, systemMessages)
+	if err != nil {
+		return err
+	}
+	if info, err = m.redactFor(info, actorID); err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+func (m *PostgresMessage) notifyMembershipChange(
+	conversationID string,
+	systemMessages []*Message,
+) (ConversationInfo, error) {
+	info, err := m.conversationInfo(conversationID)
+	if err != nil {
+		return info, err
+	}
+	if len(systemMessages) == 0 {
+		return info, nil
+	}
+	m.notifyConversationInfo("conversationUpdated", info)
+	for _, message := range systemMessages {
+		m.notifyParticipants(conversationID, newMessagePayload(*message))
+	}
+	return info, nil
+}
+
+// notifyRemoved tells removed users' open sockets that they have left the
+// conversation. Deliveries go to current participants only, so nothing sent
+// after the removal reaches them.
+func (m *PostgresMessage) notifyRemoved(conversationID string, userIDs []string, systemMessage *Message) {
+	if len(userIDs) == 0 {
+		return
+	}
+	notifyUsers(userIDs, newMessagePayload(*systemMessage))
+	notifyUsers(userIDs, SocketEvent{
+		Type:    "removedFromConversation",
+		Content: RemovedFromConversation{ConversationID: conversationID},
+	})
+}
+
+// userNames maps user ids to full names for system message bodies
+func userNames(db *gorm.DB, ids []string) (map[string]string, error) {
+	var users []User
+	if err := db.Select("id", "full_name").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(users))
+	for _, user := range users {
+		names[user.ID] = user.FullName
+	}
+	return names, nil
+}
+
+// backfillGroupOwners makes the creators of groups from before roles existed
+// their owners
+func backfillGroupOwners(db *gorm.DB) error {
+	return db.Exec(`
+		UPDATE conversation_participants cp SET role = ?
+		FROM conversations c
+		WHERE c.id = cp.conversation_id AND c.is_group AND c.created_by_id = cp.user_id
+			AND NOT EXISTS (
+				SELECT 1 FROM conversation_participants o
+				WHERE o.conversation_id = c.id AND o.role = ?
+			)`, RoleOwner, RoleOwner).Error
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeMembersRequest(r *http.Request) (*MembersRequest, error) {
+	req := new(MembersRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeRoleRequest(r *http.Request) (*RoleRequest, error) {
+	req := new(RoleRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeOwnershipRequest(r *http.Request) (*OwnershipRequest, error) {
+	req := new(OwnershipRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"gorm.io/gorm"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	defaultMentionsLimit = 50
+	maxMentionsLimit     = 100
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([A-Za-z0-9_.]{1,32})`)
+
+type MentionOfMe struct {
+	ID             string      `json:"id"`
+	ConversationID string      `json:"conversationId"`
+	All            bool        `json:"all,omitempty"`
+	Message        MessageType `json:"message"`
+	CreatedAt      time.Time   `json:"createdAt"`
+}
+
+type mentionToken struct {
+	username string
+	offset   int
+	length   int
+}
+
+// parseMentions finds @username tokens in body, offsets are UTF-16 code units
+func parseMentions(body string) []mentionToken {
+	var tokens []mentionToken
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(body, -1) {
+		username := strings.TrimRight(body[match[2]:match[3]], ".")
+		if username == "" {
+			continue
+		}
+		at := match[2] - 1
+		tokens = append(tokens, mentionToken{
+			username: username,
+			offset:   utf16Len(body[:at]),
+			length:   utf16Len(body[at : match[2]+len(username)]),
+		})
+	}
+	return tokens
+}
+
+// storeMentions resolves the @mentions of message against the participants of
+// its conversation. @all expands to every other participant in groups.
+func storeMentions(tx *gorm.DB, message *Message) error {
+	tokens := parseMentions(message.Body)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var participants []User
+	err := tx.Select("users.id", "users.username").
+		Joins("JOIN conversation_participants cp ON cp.user_id = users.id").
+		Where("cp.conversation_id = ?", message.ConversationID).
+		Find(&participants).Error
+	if err != nil {
+		return err
+	}
+	byUsername := map[string]string{}
+	for _, p := range participants {
+		byUsername[strings.ToLower(p.Username)] = p.ID
+	}
+
+	var mentions []Mention
+	seen := map[string]bool{}
+	add := func(userID string, token mentionToken, all bool) {
+		if userID == message.SenderID || seen[userID] {
+			return
+		}
+		seen[userID] = true
+		mentions = append(mentions, Mention{
+			MessageID:       message.ID,
+			ConversationID:  message.ConversationID,
+			MentionedUserID: userID,
+			SenderID:        message.SenderID,
+			All:             all,
+			Offset:          token.offset,
+			Length:          token.length,
+		})
+	}
+	for _, token := range tokens {
+		name := strings.ToLower(token.username)
+		if name == "all" {
+			if allowed, err := mentionAllAllowed(tx, message.ConversationID, message.SenderID); err != nil {
+				return err
+			} else if allowed {
+				for _, p := range participants {
+					add(p.ID, token, true)
+				}
+			}
+			continue
+		}
+		if userID, ok := byUsername[name]; ok {
+			add(userID, token, false)
+		}
+	}
+	if len(mentions) == 0 {
+		return nil
+	}
+	if err := tx.Create(&mentions).Error; err != nil {
+		return err
+	}
+	message.Mentions = mentions
+	return nil
+}
+
+// mentionAllAllowed limits @all to group admins
+func mentionAllAllowed(tx *gorm.DB, conversationID string, senderID string) (bool, error) {
+	var count int64
+	err := tx.Table("conversation_participants cp").
+		Joins("JOIN conversations c ON c.id = cp.conversation_id").
+		Where("cp.conversation_id = ? AND cp.user_id = ? AND c.is_group", conversationID, senderID).
+		Where("cp.role IN ?", []ParticipantRole{RoleOwner, RoleAdmin}).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetMentions(userID string, before *time.Time, limit int, w http.ResponseWriter) error {
+	if limit <= 0 {
+		limit = defaultMentionsLimit
+	}
+	limit = min(limit, maxMentionsLimit)
+
+	query := m.db.Joins("JOIN messages ON messages.id = mentions.message_id").
+		Scopes(notExpired).
+		Preload("Message").
+		Scopes(preloadMessageDetails("Message.")).
+		Where("mentions.mentioned_user_id = ?", userID)
+	if before != nil {
+		query = query.Where("mentions.created_at < ?", *before)
+	}
+
+	var mentions []Mention
+	err := query.Order("mentions.created_at DESC").Limit(limit).Find(&mentions).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch mentions"},
+		)
+	}
+
+	infos := []MentionOfMe{}
+	for _, mention := range mentions {
+		infos = append(infos, MentionOfMe{
+			ID:             mention.ID,
+			ConversationID: mention.ConversationID,
+			All:            mention.All,
+			Message:        messageType(mention.Message),
+			CreatedAt:      mention.CreatedAt,
+		})
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+func mentionInfos(mentions []Mention) []MentionInfo {
+	var infos []MentionInfo
+	for _, mention := range mentions {
+		infos = append(infos, MentionInfo{
+			UserID: mention.MentionedUserID,
+			All:    mention.All,
+			Offset: mention.Offset,
+			Length: mention.Length,
+		})
+	}
+	return infos
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
@@ -2,26 +2,120 @@ package database
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 
+	"github.com/inodinwetrust10/mumbleBackend/internal/linkpreview"
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
 	"github.com/inodinwetrust10/mumbleBackend/utils"
 )
 
 type MessageOperations interface {
 	SendMessage(*MessagePlain, string, string, http.ResponseWriter) error
 	GetMessage(string, string, http.ResponseWriter) error
-	GetUserForSidebar(string, http.ResponseWriter) error
+	GetUserForSidebar(string, bool, http.ResponseWriter) error
+	UploadAttachment(io.Reader, string, string, http.ResponseWriter) error
+	ServeAttachment(string, string, string, http.ResponseWriter, *http.Request) error
+	GetScheduledMessages(string, http.ResponseWriter) error
+	UpdateScheduledMessage(string, string, *MessagePlain, http.ResponseWriter) error
+	CancelScheduledMessage(string, string, http.ResponseWriter) error
+	SetDisappearingTimer(string, string, int64, http.ResponseWriter) error
+	GetMentions(string, *time.Time, int, http.ResponseWriter) error
+	ForwardMessages(*ForwardRequest, string, http.ResponseWriter) error
+	SetDraft(string, string, string, *DraftPlain, http.ResponseWriter) error
+	GetDraft(string, string, http.ResponseWriter) error
+	GetDrafts(string, http.ResponseWriter) error
+	Sync(*SyncRequest, string, http.ResponseWriter) error
+	ExportConversation(string, string, ExportOptions, http.ResponseWriter) error
+	ImportChat(io.Reader, ImportOptions, string, http.ResponseWriter) error
+	GetImportClaims(string, http.ResponseWriter) error
+	AnswerImportClaim(string, bool, string, http.ResponseWriter) error
+	CreatePoll(string, *PollRequest, string, http.ResponseWriter) error
+	GetPoll(string, string, http.ResponseWriter) error
+	VotePoll(string, *PollVoteRequest, string, http.ResponseWriter) error
+	ClosePoll(string, string, http.ResponseWriter) error
+	StarMessage(string, string, http.ResponseWriter) error
+	UnstarMessage(string, string, http.ResponseWriter) error
+	GetStarredMessages(string, *time.Time, int, http.ResponseWriter) error
+	Nudge(string, string, http.ResponseWriter) error
+	GetModerationFlags(string, string, *time.Time, int, http.ResponseWriter) error
+	ReviewModerationFlag(string, *FlagReview, string, http.ResponseWriter) error
+	PinMessage(string, string, string, http.ResponseWriter) error
+	UnpinMessage(string, string, string, http.ResponseWriter) error
+	GetPinnedMessages(string, string, http.ResponseWriter) error
+	CreateGroup(*GroupPlain, string, http.ResponseWriter) error
+	GetConversation(string, string, http.ResponseWriter) error
+	UpdateGroup(string, *GroupPlain, string, http.ResponseWriter) error
+	SendToConversation(string, *MessagePlain, string, http.ResponseWriter) error
+	GetConversationMessages(string, string, http.ResponseWriter) error
+	AddGroupMembers(string, *MembersRequest, string, http.ResponseWriter) error
+	RemoveGroupMember(string, string, string, http.ResponseWriter) error
+	SetMemberRole(string, string, *RoleRequest, string, http.ResponseWriter) error
+	TransferGroupOwnership(string, *OwnershipRequest, string, http.ResponseWriter) error
+	LeaveGroup(string, string, http.ResponseWriter) error
+	GetConversationSettings(string, string, http.ResponseWriter) error
+	UpdateConversationSettings(string, string, string, *ConversationSettingsRequest, http.ResponseWriter) error
+	BlockUser(string, string, http.ResponseWriter) error
+	UnblockUser(string, string, http.ResponseWriter) error
+	GetBlockedUsers(string, http.ResponseWriter) error
+	CreateInvite(string, *InviteRequest, string, http.ResponseWriter) error
+	GetInvites(string, string, http.ResponseWriter) error
+	RevokeInvite(string, string, string, http.ResponseWriter) error
+	PreviewInvite(string, string, http.ResponseWriter) error
+	JoinByInvite(string, string, http.ResponseWriter) error
+	GetJoinRequests(string, string, http.ResponseWriter) error
+	ReviewJoinRequest(string, string, *JoinDecision, string, http.ResponseWriter) error
+	SendContactRequest(*ContactRequestPlain, string, http.ResponseWriter) error
+	GetContactRequests(string, http.ResponseWriter) error
+	AnswerContactRequest(string, bool, string, http.ResponseWriter) error
+	GetContacts(string, http.ResponseWriter) error
+	RemoveContact(string, string, http.ResponseWriter) error
+	GetMessageRequests(string, http.ResponseWriter) error
+	AnswerMessageRequest(string, bool, string, http.ResponseWriter) error
 }
 
+const maxClientIDLength = 64
+
+// maxMessageLength is the longest body in characters
+const maxMessageLength = 4000
+
+var (
+	errUnknownReceiver = errors.New("user not found")
+	errEmptyMessage    = errors.New("message is empty")
+	errMessageTooLong  = errors.New("message is too long")
+)
+
+var errDuplicateClientID = errors.New("a message with this client id already exists")
+
 func NewPostgresMessage() (*PostgresMessage, error) {
 	conn, err := ExpoDB()
 	if err != nil {
 		log.Fatal(err)
 	}
-	connection := &PostgresMessage{db: conn}
+	moderator, err := moderation.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection := &PostgresMessage{
+		db:           conn,
+		push:         logPushNotifier{},
+		mediaQueue:   make(chan string, 256),
+		previews:     linkpreview.NewFetcher(linkpreview.ConfigFromEnv()),
+		previewSlots: make(chan struct{}, 8),
+		moderator:    moderator,
+	}
+	presenceHidden = func(userIDs []string) (map[string]map[string]bool, error) {
+		return blockedPairs(conn, userIDs)
+	}
 	return connection, err
 }
 
@@ -31,79 +125,285 @@ func (m *PostgresMessage) SendMessage(
 	receiverId string,
 	w http.ResponseWriter,
 ) error {
-	var conversation Conversation
-
-	subQuery := m.db.Table("conversation_participants").
-		Select("conversation_id").
-		Where("user_id IN (?, ?)", senderId, receiverId).
-		Group("conversation_id").
-		Having("COUNT(DISTINCT user_id) = ?", 2)
-
-	err := m.db.Where("id IN (?)", subQuery).
-		First(&conversation).Error
+	if len(mess.ClientID) > maxClientIDLength {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "clientId is too long"},
+		)
+	}
+	if err := formatMessage(mess); err != nil {
+		return writeFormatError(w, err)
+	}
+	if err := validateMessage(mess); err != nil {
+		return writeSendError(w, err)
+	}
+	if err := m.validateReceiver(receiverId); err != nil {
+		return writeSendError(w, err)
+	}
+	if err := blockBetween(m.db, senderId, receiverId); err != nil {
+		return writeBlockedSend(w, mess, senderId, err)
+	}
+	if mess.SendAt != nil && mess.SendAt.After(time.Now()) {
+		if err := m.moderate(mess, senderId); err != nil {
+			return writeModerationError(w, err)
+		}
+		return m.scheduleMessage(mess, senderId, receiverId, w)
+	}
 
-	if err == gorm.ErrRecordNotFound {
-		conversation = Conversation{}
-		err = m.db.Create(&conversation).Error
+	// a retry returns the message the first attempt created, without going
+	// through moderation again where it would count as a repeat of itself
+	if existing, err := m.messageByClientID(senderId, mess.ClientID); err != nil || existing != nil {
 		if err != nil {
 			return err
 		}
+		return utils.WriteJson(w, http.StatusOK, sendMessagePayload(*existing))
+	}
+	if err := m.moderate(mess, senderId); err != nil {
+		return writeModerationError(w, err)
+	}
 
-		sender := User{ID: senderId}
-		receiver := User{ID: receiverId}
-
-		err = m.db.Model(&conversation).Association("Participants").Append(&sender, &receiver)
-		if err != nil {
+	newMessage, err := m.sendMessage(mess, senderId, receiverId)
+	if errors.Is(err, errDuplicateClientID) {
+		existing, err := m.messageByClientID(senderId, mess.ClientID)
+		if err != nil || existing == nil {
 			return err
 		}
-	} else if err != nil {
+		return utils.WriteJson(w, http.StatusOK, sendMessagePayload(*existing))
+	}
+	if err != nil {
+		return writeBlockError(w, err)
+	}
+	return utils.WriteJson(w, http.StatusCreated, sendMessagePayload(*newMessage))
+}
+
+// validateMessage rejects messages without text or attachments and bodies
+// over the length limit, run after formatting so markup does not count
+func validateMessage(mess *MessagePlain) error {
+	if strings.TrimSpace(mess.Content) == "" && len(mess.Attachments) == 0 {
+		return errEmptyMessage
+	}
+	if utf8.RuneCountInString(mess.Content) > maxMessageLength {
+		return errMessageTooLong
+	}
+	return nil
+}
+
+func (m *PostgresMessage) validateReceiver(receiverId string) error {
+	if _, err := uuid.Parse(receiverId); err != nil {
+		return errUnknownReceiver
+	}
+	var count int64
+	if err := m.db.Model(&User{}).Where("id = ? AND NOT placeholder", receiverId).Count(&count).Error; err != nil {
 		return err
 	}
+	if count == 0 {
+		return errUnknownReceiver
+	}
+	return nil
+}
 
-	newMessage := Message{
-		SenderID:       senderId,
-		Body:           mess.Content,
-		ConversationID: conversation.ID,
+func writeSendError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errUnknownReceiver):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errEmptyMessage), errors.Is(err, errMessageTooLong):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
 	}
-	err = m.db.Create(&newMessage).Error
-	if err != nil {
+	return err
+}
+
+func (m *PostgresMessage) messageByClientID(senderId string, clientID string) (*Message, error) {
+	if clientID == "" {
+		return nil, nil
+	}
+	var messages []Message
+	err := m.db.Scopes(preloadMessageDetails("")).
+		Where("sender_id = ? AND client_message_id = ?", senderId, clientID).
+		Limit(1).
+		Find(&messages).Error
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+// sendMessage stores a message and pushes it to the receiver
+func (m *PostgresMessage) sendMessage(mess *MessagePlain, senderId string, receiverId string) (*Message, error) {
+	var newMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		newMessage, err = m.storeMessage(tx, mess, senderId, receiverId)
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.deliverToConversation(newMessage)
+	return newMessage, nil
+}
+
+// storeMessage writes the message inside tx, creating the conversation
+// between sender and receiver on their first message
+func (m *PostgresMessage) storeMessage(
+	tx *gorm.DB,
+	mess *MessagePlain,
+	senderId string,
+	receiverId string,
+) (*Message, error) {
+	conversation, err := findOrCreateConversation(tx, senderId, receiverId)
+	if err != nil {
+		return nil, err
 	}
+	return storeMessageIn(tx, conversation, mess, senderId)
+}
 
-	err = m.db.Preload("Participants").
-		Preload("Messages").
-		First(&conversation, "id = ?", conversation.ID).
-		Error
+// storeMessageIn writes a text message with its moderation flags and
+// attachments into conversation
+func storeMessageIn(tx *gorm.DB, conversation *Conversation, mess *MessagePlain, senderId string) (*Message, error) {
+	newMessage := &Message{
+		Kind:     MessageKindText,
+		SenderID: senderId,
+		Body:     mess.Content,
+		Entities: mess.Entities,
+	}
+	if mess.ClientID != "" {
+		newMessage.ClientMessageID = &mess.ClientID
+	}
+	err := storeInConversation(tx, conversation, newMessage)
+	if err != nil {
+		return nil, err
+	}
+	err = recordFlags(tx, newMessage, mess.Findings)
+	if err != nil {
+		return nil, err
+	}
+	err = attachUploads(tx, newMessage, mess.Attachments)
 	if err != nil {
+		return nil, err
+	}
+	return newMessage, nil
+}
+
+// findConversation returns the direct conversation between two users, or the
+// user's notes to self when both ids are the same. Nil without an error
+// means they have not talked yet.
+func findConversation(db *gorm.DB, userId string, otherId string) (*Conversation, error) {
+	members := 2
+	if userId == otherId {
+		members = 1
+	}
+	// exactly these members, so a conversation that also has others is
+	// never mistaken for the direct one
+	subQuery := db.Table("conversation_participants").
+		Select("conversation_id").
+		Group("conversation_id").
+		Having("COUNT(*) = ? AND COUNT(*) FILTER (WHERE user_id IN (?, ?)) = ?", members, userId, otherId, members)
+
+	var conversations []Conversation
+	err := db.Where("id IN (?) AND is_group = ?", subQuery, false).
+		Order("created_at ASC").
+		Limit(1).
+		Find(&conversations).Error
+	if err != nil || len(conversations) == 0 {
+		return nil, err
+	}
+	return &conversations[0], nil
+}
+
+func findOrCreateConversation(tx *gorm.DB, senderId string, receiverId string) (*Conversation, error) {
+	conversation, err := findConversation(tx, senderId, receiverId)
+	if err != nil || conversation != nil {
+		return conversation, err
+	}
+
+	conversation = &Conversation{}
+	if err := tx.Create(conversation).Error; err != nil {
+		return nil, err
+	}
+	participants := []ConversationParticipant{{ConversationID: conversation.ID, UserID: senderId}}
+	if receiverId != senderId {
+		// strangers writing to someone who only takes messages from contacts
+		// land in their message requests
+		isRequest, err := startsAsRequest(tx, senderId, receiverId)
+		if err != nil {
+			return nil, err
+		}
+		participants = append(participants, ConversationParticipant{
+			ConversationID: conversation.ID,
+			UserID:         receiverId,
+			IsRequest:      isRequest,
+		})
+	}
+	if err := tx.Create(&participants).Error; err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// storeInConversation inserts a prepared message into conversation, applying
+// the conversation's disappearing timer and resolving mentions. Direct
+// conversations with a block in place, or a declined message request,
+// refuse new messages.
+func storeInConversation(tx *gorm.DB, conversation *Conversation, newMessage *Message) error {
+	if err := directBlock(tx, conversation, newMessage.SenderID); err != nil {
 		return err
 	}
-	notifyReceiver(receiverId, newMessage)
-	messa := SendMessage{
-		ID:             newMessage.ID,
-		ConversationID: newMessage.ConversationID,
-		SenderID:       newMessage.SenderID,
-		Body:           newMessage.Body,
-		CreatedAt:      newMessage.CreatedAt,
-		UpdatedAt:      newMessage.UpdatedAt,
+	if err := answerRequestOnSend(tx, conversation, newMessage.SenderID); err != nil {
+		return err
+	}
+	newMessage.ConversationID = conversation.ID
+	if conversation.DisappearAfter > 0 {
+		expiresAt := time.Now().Add(time.Duration(conversation.DisappearAfter) * time.Second)
+		newMessage.ExpiresAt = &expiresAt
+	}
+	if err := insertMessage(tx, newMessage); err != nil {
+		return err
+	}
+	// forwarded text must not ping people in the new conversation
+	if newMessage.ForwardedFromID != nil {
+		return nil
 	}
+	return storeMentions(tx, newMessage)
+}
 
-	return utils.WriteJson(w, http.StatusCreated, messa)
+// deliverToConversation pushes a committed message to every participant
+// other than its sender, notes to self go to the sender's other devices
+func (m *PostgresMessage) deliverToConversation(newMessage *Message) {
+	participants, err := m.participantIDs(newMessage.ConversationID)
+	if err != nil {
+		log.Printf("Error loading participants of %s: %v", newMessage.ConversationID, err)
+		return
+	}
+	recipients := make([]string, 0, len(participants))
+	for _, id := range participants {
+		if id != newMessage.SenderID || len(participants) == 1 {
+			recipients = append(recipients, id)
+		}
+	}
+	m.unarchive(newMessage.ConversationID)
+	pending, err := m.pendingRequests(newMessage.ConversationID)
+	if err != nil {
+		log.Printf("Error loading message requests of %s: %v", newMessage.ConversationID, err)
+	}
+	for _, id := range recipients {
+		// message requests show up in their own inbox, not the chat list
+		if pending[id] {
+			notifyUsers([]string{id}, SocketEvent{Type: "messageRequest", Content: newMessagePayload(*newMessage)})
+		} else {
+			notifyUsers([]string{id}, newMessagePayload(*newMessage))
+		}
+	}
+	m.pushOffline(newMessage, recipients)
+	if len(newMessage.LinkPreviews) == 0 {
+		go m.attachLinkPreviews(*newMessage)
+	}
 }
 
 // /////////////////////////////////////////////////////////////////////////////////////
 
 func (m *PostgresMessage) GetMessage(toChat string, senderID string, w http.ResponseWriter) error {
-	var conversation Conversation
-
-	// Modified Query
-	err := m.db.Preload("Messages", func(db *gorm.DB) *gorm.DB {
-		return db.Order("created_at ASC")
-	}).
-		Joins("JOIN conversation_participants cp1 ON cp1.conversation_id = conversations.id").
-		Joins("JOIN conversation_participants cp2 ON cp2.conversation_id = conversations.id").
-		Where("cp1.user_id = ? AND cp2.user_id = ?", senderID, toChat).
-		Group("conversations.id").
-		Find(&conversation).Error
+	conversation, err := findConversation(m.db, senderID, toChat)
 	if err != nil {
 		return utils.WriteJson(
 			w,
@@ -111,31 +411,50 @@ func (m *PostgresMessage) GetMessage(toChat string, senderID string, w http.Resp
 			utils.ApiError{ErrorMessage: "Failed to fetch the conversation"},
 		)
 	}
-
-	if conversation.ID == "" {
+	if conversation == nil {
 		return utils.WriteJson(w, http.StatusOK, []interface{}{})
 	}
 
+	err = m.db.Preload("Messages", func(db *gorm.DB) *gorm.DB {
+		return notExpired(db).Order("seq ASC, created_at ASC")
+	}).
+		Scopes(preloadMessageDetails("Messages.")).
+		First(conversation, "id = ?", conversation.ID).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch the conversation"},
+		)
+	}
+
 	var messageArr []MessageType
 	for _, mess := range conversation.Messages {
-		message := MessageType{
-			ID:        mess.ID,
-			Body:      mess.Body,
-			SenderID:  mess.SenderID,
-			CreatedAt: mess.CreatedAt,
-		}
-		messageArr = append(messageArr, message)
+		messageArr = append(messageArr, messageType(mess))
 	}
 	return utils.WriteJson(w, http.StatusOK, messageArr)
 }
 
 // ////////////////////////////////////////////////////////////////////////////////////
-func (m *PostgresMessage) GetUserForSidebar(authUser string, w http.ResponseWriter) error {
+func (m *PostgresMessage) GetUserForSidebar(authUser string, archived bool, w http.ResponseWriter) error {
 	var users []UserInfo
 
+	// contacts and the people we chat with, message requests stay in their
+	// own inbox and users with a block either way are left out
+	contacts := m.db.Model(&Contact{}).Select("contact_id").Where("user_id = ?", authUser)
+	partners := m.db.Table("conversation_participants me").
+		Select("other.user_id").
+		Joins("JOIN conversations c ON c.id = me.conversation_id AND NOT c.is_group").
+		Joins("JOIN conversation_participants other ON other.conversation_id = me.conversation_id"+
+			" AND other.user_id <> me.user_id").
+		Where("me.user_id = ? AND NOT me.is_request AND NOT me.request_declined", authUser)
+	blocked := m.db.Model(&Block{}).Select("blocked_id").Where("blocker_id = ?", authUser)
+	blockedBy := m.db.Model(&Block{}).Select("blocker_id").Where("blocked_id = ?", authUser)
 	err := m.db.Model(&User{}).
 		Select("id, full_name, profile_pic").
 		Where("id != ?", authUser).
+		Where("id IN (?) OR id IN (?)", contacts, partners).
+		Where("id NOT IN (?) AND id NOT IN (?)", blocked, blockedBy).
 		Find(&users).Error
 	if err != nil {
 		return utils.WriteJson(
@@ -145,7 +464,181 @@ func (m *PostgresMessage) GetUserForSidebar(authUser string, w http.ResponseWrit
 		)
 	}
 
-	return utils.WriteJson(w, http.StatusOK, users)
+	drafts, err := m.draftPartners(authUser)
+	if err != nil {
+		return err
+	}
+	var groups []Conversation
+	err = m.db.Select("conversations.id", "conversations.name", "conversations.avatar_url").
+		Joins("JOIN conversation_participants cp ON cp.conversation_id = conversations.id").
+		Where("cp.user_id = ? AND conversations.is_group = ?", authUser, true).
+		Order("conversations.created_at DESC").
+		Find(&groups).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch groups"},
+		)
+	}
+	for _, group := range groups {
+		users = append(users, UserInfo{
+			ID:         group.ID,
+			FullName:   group.Name,
+			ProfilePic: group.AvatarURL,
+			IsGroup:    true,
+		})
+	}
+	settings, err := m.sidebarSettings(authUser)
+	if err != nil {
+		return err
+	}
+
+	// the default list hides archived conversations, ?archived=true lists
+	// only those
+	entries := []UserInfo{}
+	for _, user := range users {
+		user.HasDraft = drafts[user.ID]
+		if s, ok := settings[user.ID]; ok {
+			user.Muted = s.Muted
+			user.Archived = s.Archived
+			user.Pinned = s.Pinned
+		}
+		if user.Archived == archived {
+			entries = append(entries, user)
+		}
+	}
+	// pinned conversations stay on top, the latest pin first
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := settings[entries[i].ID].PinnedAt, settings[entries[j].ID].PinnedAt
+		if (a != nil) != (b != nil) {
+			return a != nil
+		}
+		return a != nil && a.After(*b)
+	})
+
+	return utils.WriteJson(w, http.StatusOK, entries)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) participantIDs(conversationID string) ([]string, error) {
+	var ids []string
+	err := m.db.Table("conversation_participants").
+		Where("conversation_id = ?", conversationID).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+func (m *PostgresMessage) isParticipant(conversationID string, userID string) (bool, error) {
+	var count int64
+	err := m.db.Table("conversation_participants").
+		Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// createSystemMessage records an event such as a pin in the conversation
+// history, callers push it to the participants once tx has committed
+func (m *PostgresMessage) createSystemMessage(
+	tx *gorm.DB,
+	conversationID string,
+	actorID string,
+	action string,
+	targetID string,
+	body string,
+) (*Message, error) {
+	message := Message{
+		ConversationID: conversationID,
+		SenderID:       actorID,
+		Kind:           MessageKindSystem,
+		SystemAction:   action,
+		Body:           body,
+	}
+	if targetID != "" {
+		message.TargetID = &targetID
+	}
+	if err := insertMessage(tx, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (m *PostgresMessage) notifyParticipants(conversationID string, event interface{}) {
+	participants, err := m.participantIDs(conversationID)
+	if err != nil {
+		log.Printf("Error loading participants of %s: %v", conversationID, err)
+		return
+	}
+	notifyUsers(participants, event)
+}
+
+// preloadMessageDetails loads everything messageType renders, prefix is the
+// association path leading to the messages, e.g. "Messages."
+func preloadMessageDetails(prefix string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Preload(prefix+"Attachments", func(db *gorm.DB) *gorm.DB {
+			return db.Order("created_at ASC")
+		}).
+			Preload(prefix+"Attachments.Thumbnails").
+			Preload(prefix+"LinkPreviews").
+			Preload(prefix+"Mentions").
+			Preload(prefix+"Poll.Options", func(db *gorm.DB) *gorm.DB {
+				return db.Order("position ASC")
+			}).
+			Preload(prefix + "Poll.Votes")
+	}
+}
+
+// notExpired hides disappearing messages whose timer ran out but which the
+// reaper has not deleted yet
+func notExpired(db *gorm.DB) *gorm.DB {
+	return db.Where("messages.expires_at IS NULL OR messages.expires_at > ?", time.Now())
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func sendMessagePayload(newMessage Message) SendMessage {
+	return SendMessage{
+		ID:             newMessage.ID,
+		ClientID:       stringValue(newMessage.ClientMessageID),
+		ConversationID: newMessage.ConversationID,
+		Seq:            newMessage.Seq,
+		SenderID:       newMessage.SenderID,
+		Body:           newMessage.Body,
+		Entities:       newMessage.Entities,
+		ForwardedFrom:  forwardInfo(&newMessage),
+		Attachments:    attachmentInfos(newMessage.Attachments),
+		CreatedAt:      newMessage.CreatedAt,
+		UpdatedAt:      newMessage.UpdatedAt,
+	}
+}
+
+func messageType(mess Message) MessageType {
+	return MessageType{
+		ID:             mess.ID,
+		ClientID:       stringValue(mess.ClientMessageID),
+		ConversationID: mess.ConversationID,
+		Seq:            mess.Seq,
+		Body:           mess.Body,
+		Entities:       mess.Entities,
+		SenderID:       mess.SenderID,
+		Kind:           mess.Kind,
+		SystemAction:   mess.SystemAction,
+		TargetID:       stringValue(mess.TargetID),
+		ForwardedFrom:  forwardInfo(&mess),
+		ImportedFrom:   mess.ImportedFrom,
+		Attachments:    attachmentInfos(mess.Attachments),
+		LinkPreviews:   linkPreviewInfos(mess.LinkPreviews),
+		Mentions:       mentionInfos(mess.Mentions),
+		Poll:           messagePollInfo(mess),
+		CreatedAt:      mess.CreatedAt,
+		ExpiresAt:      mess.ExpiresAt,
+	}
 }
 
 // ////////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,285 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
+	"github.com/inodinwetrust10/mumbleBackend/internal/richtext"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	defaultFlagsLimit = 50
+	maxFlagsLimit     = 200
+)
+
+var errNotModerator = errors.New("moderator access required")
+
+type ModerationFlagInfo struct {
+	ID             string               `json:"id"`
+	MessageID      string               `json:"messageId"`
+	ConversationID string               `json:"conversationId"`
+	SenderID       string               `json:"senderId"`
+	Body           string               `json:"body"`
+	Rules          string               `json:"rules"`
+	Reasons        string               `json:"reasons"`
+	Status         ModerationFlagStatus `json:"status"`
+	ReviewerID     string               `json:"reviewerId,omitempty"`
+	ReviewedAt     *time.Time           `json:"reviewedAt,omitempty"`
+	CreatedAt      time.Time            `json:"createdAt"`
+}
+
+type FlagReview struct {
+	// "dismiss" keeps the message, "remove" deletes it for everyone
+	Decision string `json:"decision"`
+}
+
+// messageHistory lets the repeat rule look at a sender's earlier messages
+type messageHistory struct {
+	db *gorm.DB
+}
+
+func (h messageHistory) RecentBodies(senderID string, since time.Time, limit int) ([]string, error) {
+	var bodies []string
+	err := h.db.Model(&Message{}).
+		Where("sender_id = ? AND kind <> ? AND created_at >= ?", senderID, MessageKindSystem, since).
+		Order("created_at DESC").
+		Limit(limit).
+		Pluck("body", &bodies).Error
+	return bodies, err
+}
+
+// moderate runs the moderation rules on an outgoing message, masking its
+// content in place. Link targets are checked along with the body, masked
+// ones lose their link. Findings that need a review travel with the message
+// until storeMessage records them.
+func (m *PostgresMessage) moderate(mess *MessagePlain, senderID string) error {
+	var urls []string
+	var links []int
+	for i, entity := range mess.Entities {
+		if entity.Type == richtext.TypeLink {
+			urls = append(urls, entity.URL)
+			links = append(links, i)
+		}
+	}
+	verdict, err := m.moderator.Run(context.Background(), &moderation.Input{
+		SenderID: senderID,
+		Body:     mess.Content,
+		URLs:     urls,
+		History:  messageHistory{db: m.db},
+	})
+	if err != nil {
+		return err
+	}
+	mess.Content = verdict.Body
+	mess.Findings = verdict.Findings
+	if len(verdict.MaskedURLs) > 0 {
+		masked := map[int]bool{}
+		for _, i := range verdict.MaskedURLs {
+			masked[links[i]] = true
+		}
+		entities := Entities{}
+		for i, entity := range mess.Entities {
+			if !masked[i] {
+				entities = append(entities, entity)
+			}
+		}
+		mess.Entities = entities
+	}
+	return nil
+}
+
+func (m *PostgresMessage) moderateText(text string, senderID string) (moderation.Verdict, error) {
+	return m.moderator.Run(context.Background(), &moderation.Input{
+		SenderID: senderID,
+		Body:     text,
+		History:  messageHistory{db: m.db},
+	})
+}
+
+// moderateName runs the rules on a group name, masking it in place. Names
+// have no history, so the repeat rule never applies to them.
+func (m *PostgresMessage) moderateName(name *string, actorID string) ([]moderation.Finding, error) {
+	verdict, err := m.moderator.Run(context.Background(), &moderation.Input{SenderID: actorID, Body: *name})
+	if err != nil {
+		return nil, err
+	}
+	*name = verdict.Body
+	return verdict.Findings, nil
+}
+
+// recordFlags queues message for review when a rule flagged it
+func recordFlags(tx *gorm.DB, message *Message, findings []moderation.Finding) error {
+	var rules, reasons []string
+	for _, finding := range findings {
+		if finding.Action == moderation.Flag {
+			rules = append(rules, finding.Rule)
+			reasons = append(reasons, finding.Reason)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	flag := ModerationFlag{
+		MessageID:      message.ID,
+		ConversationID: message.ConversationID,
+		SenderID:       message.SenderID,
+		Body:           message.Body,
+		Rules:          strings.Join(rules, ", "),
+		Reasons:        strings.Join(reasons, "; "),
+		Status:         FlagPending,
+	}
+	return tx.Create(&flag).Error
+}
+
+func writeModerationError(w http.ResponseWriter, err error) error {
+	var rejected *moderation.RejectedError
+	if errors.As(err, &rejected) {
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: rejected.Error()})
+	}
+	return err
+}
+
+// isModerator checks MODERATOR_USER_IDS, a comma separated list of user ids
+func isModerator(userID string) bool {
+	for _, id := range strings.Split(os.Getenv("MODERATOR_USER_IDS"), ",") {
+		if strings.TrimSpace(id) == userID && userID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetModerationFlags(
+	userID string,
+	status string,
+	before *time.Time,
+	limit int,
+	w http.ResponseWriter,
+) error {
+	if !isModerator(userID) {
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: errNotModerator.Error()})
+	}
+	if limit <= 0 {
+		limit = defaultFlagsLimit
+	}
+	limit = min(limit, maxFlagsLimit)
+	if status == "" {
+		status = string(FlagPending)
+	}
+
+	query := m.db.Where("status = ?", status)
+	if before != nil {
+		query = query.Where("created_at < ?", *before)
+	}
+	var flags []ModerationFlag
+	if err := query.Order("created_at DESC").Limit(limit).Find(&flags).Error; err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch moderation flags"},
+		)
+	}
+
+	infos := []ModerationFlagInfo{}
+	for _, flag := range flags {
+		infos = append(infos, moderationFlagInfo(flag))
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ReviewModerationFlag(
+	flagID string,
+	review *FlagReview,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if !isModerator(userID) {
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: errNotModerator.Error()})
+	}
+	status := FlagDismissed
+	switch review.Decision {
+	case "dismiss":
+	case "remove":
+		status = FlagRemoved
+	default:
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: `decision must be "dismiss" or "remove"`},
+		)
+	}
+
+	var flag ModerationFlag
+	err := m.db.First(&flag, "id = ?", flagID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: "flag not found"})
+	} else if err != nil {
+		return err
+	}
+
+	if status == FlagRemoved {
+		var messages []Message
+		err := m.db.Select("id", "conversation_id").
+			Preload("Attachments").
+			Preload("Attachments.Thumbnails").
+			Where("id = ?", flag.MessageID).
+			Find(&messages).Error
+		if err != nil {
+			return err
+		}
+		if err := m.deleteMessages(messages); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	flag.Status = status
+	flag.ReviewerID = &userID
+	flag.ReviewedAt = &now
+	err = m.db.Model(&flag).Updates(map[string]interface{}{
+		"status":      status,
+		"reviewer_id": userID,
+		"reviewed_at": now,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, moderationFlagInfo(flag))
+}
+
+func moderationFlagInfo(flag ModerationFlag) ModerationFlagInfo {
+	return ModerationFlagInfo{
+		ID:             flag.ID,
+		MessageID:      flag.MessageID,
+		ConversationID: flag.ConversationID,
+		SenderID:       flag.SenderID,
+		Body:           flag.Body,
+		Rules:          flag.Rules,
+		Reasons:        flag.Reasons,
+		Status:         flag.Status,
+		ReviewerID:     stringValue(flag.ReviewerID),
+		ReviewedAt:     flag.ReviewedAt,
+		CreatedAt:      flag.CreatedAt,
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeFlagReview(r *http.Request) (*FlagReview, error) {
+	review := new(FlagReview)
+	err := json.NewDecoder(r.Body).Decode(review)
+	if err != nil {
+		return nil, err
+	}
+	return review, nil
+}
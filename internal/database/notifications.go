@@ -0,0 +1,76 @@
+package database
+
+import (
+	"log"
+)
+
+type PushPriority string
+
+const (
+	PushNormal PushPriority = "normal"
+	PushHigh   PushPriority = "high"
+)
+
+// PushNotification is sent to users who have no open socket
+type PushNotification struct {
+	UserID         string       `json:"userId"`
+	ConversationID string       `json:"conversationId"`
+	MessageID      string       `json:"messageId"`
+	SenderID       string       `json:"senderId"`
+	Body           string       `json:"body"`
+	Priority       PushPriority `json:"priority"`
+}
+
+// PushNotifier delivers notifications through an external push service
+type PushNotifier interface {
+	Notify(PushNotification) error
+}
+
+// logPushNotifier is used until a real push service is configured
+type logPushNotifier struct{}
+
+func (logPushNotifier) Notify(n PushNotification) error {
+	log.Printf("Push (%s) to %s for message %s", n.Priority, n.UserID, n.MessageID)
+	return nil
+}
+
+func (m *PostgresMessage) SetPushNotifier(p PushNotifier) {
+	m.push = p
+}
+
+// pushOffline notifies the recipients of message that are not connected and
+// have not muted the conversation, mentioned users get a high priority
+// notification
+func (m *PostgresMessage) pushOffline(message *Message, recipients []string) {
+	muted, err := m.mutedUsers(message.ConversationID, recipients)
+	if err != nil {
+		log.Printf("Error loading muted participants of %s: %v", message.ConversationID, err)
+	}
+	mentioned := map[string]bool{}
+	for _, mention := range message.Mentions {
+		mentioned[mention.MentionedUserID] = true
+	}
+
+	seen := map[string]bool{}
+	for _, userID := range recipients {
+		if userID == message.SenderID || seen[userID] || muted[userID] || isConnected(userID) {
+			continue
+		}
+		seen[userID] = true
+		priority := PushNormal
+		if mentioned[userID] {
+			priority = PushHigh
+		}
+		err := m.push.Notify(PushNotification{
+			UserID:         userID,
+			ConversationID: message.ConversationID,
+			MessageID:      message.ID,
+			SenderID:       message.SenderID,
+			Body:           message.Body,
+			Priority:       priority,
+		})
+		if err != nil {
+			log.Printf("Error sending push notification to %s: %v", userID, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+// nudgeInterval is how long a sender waits between nudges in a conversation
+const nudgeInterval = 30 * time.Second
+
+type errNudgeTooSoon struct {
+	retryAfter time.Duration
+}
+
+func (e errNudgeTooSoon) Error() string {
+	return "wait before nudging this conversation again"
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) Nudge(conversationID string, userID string, w http.ResponseWriter) error {
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	}
+
+	var systemMessage *Message
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		// serializes nudges so two requests cannot both pass the rate limit
+		var conversation Conversation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&conversation, "id = ?", conversationID).Error
+		if err != nil {
+			return err
+		}
+		if err := directBlock(tx, &conversation, userID); err != nil {
+			return err
+		}
+
+		// the nudge history doubles as the rate limit state
+		var last Message
+		err = tx.Where("conversation_id = ? AND sender_id = ? AND kind = ? AND system_action = ?",
+			conversationID, userID, MessageKindSystem, "nudge").
+			Order("created_at DESC").
+			First(&last).Error
+		if err == nil {
+			if wait := nudgeInterval - time.Since(last.CreatedAt); wait > 0 {
+				return errNudgeTooSoon{retryAfter: wait}
+			}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, "nudge", "", "sent a nudge")
+		return err
+	})
+	var tooSoon errNudgeTooSoon
+	if errors.As(err, &tooSoon) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(tooSoon.retryAfter.Seconds()))))
+		return utils.WriteJson(w, http.StatusTooManyRequests, utils.ApiError{ErrorMessage: tooSoon.Error()})
+	} else if err != nil {
+		return writeBlockError(w, err)
+	}
+
+	m.deliverNudge(systemMessage)
+	return utils.WriteJson(w, http.StatusCreated, messageType(*systemMessage))
+}
+
+// deliverNudge pushes the nudge with ShouldShake set to every participant who
+// has not suppressed it, the others only get the history entry
+func (m *PostgresMessage) deliverNudge(message *Message) {
+	participants, err := m.participantIDs(message.ConversationID)
+	if err != nil {
+		log.Printf("Error loading participants of %s: %v", message.ConversationID, err)
+		return
+	}
+	var shaken []string
+	for _, userID := range participants {
+		payload := newMessagePayload(*message)
+		if userID != message.SenderID && !m.nudgeSuppressed(message.ConversationID, userID, message.SenderID) {
+			payload.ShouldShake = true
+			shaken = append(shaken, userID)
+		}
+		notifyUsers([]string{userID}, payload)
+	}
+	m.pushOffline(message, shaken)
+}
+
+// nudgeSuppressed reports whether userID opted out of nudges from senderID
+// in the conversation, by muting it or by a block between the two
+func (m *PostgresMessage) nudgeSuppressed(conversationID string, userID string, senderID string) bool {
+	if err := blockBetween(m.db, senderID, userID); err != nil {
+		return true
+	}
+	muted, err := m.mutedUsers(conversationID, []string{userID})
+	if err != nil {
+		log.Printf("Error loading mute of %s in %s: %v", userID, conversationID, err)
+	}
+	return muted[userID]
+}
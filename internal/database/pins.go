@@ -0,0 +1,205 @@
+package database
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const maxPinnedMessages = 10
+
+var (
+	errNotParticipant  = errors.New("conversation not found")
+	errMessageNotFound = errors.New("message not found")
+	errTooManyPins     = errors.New("too many pinned messages in this conversation")
+)
+
+type PinnedMessageInfo struct {
+	ConversationID string      `json:"conversationId"`
+	Message        MessageType `json:"message"`
+	PinnedBy       string      `json:"pinnedBy"`
+	PinnedAt       time.Time   `json:"pinnedAt"`
+}
+
+type UnpinnedMessageInfo struct {
+	ConversationID string `json:"conversationId"`
+	MessageID      string `json:"messageId"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) PinMessage(
+	conversationID string,
+	messageID string,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if err := m.canPin(conversationID, userID); err != nil {
+		return writePinError(w, err)
+	}
+
+	var pin PinnedMessage
+	var systemMessage *Message
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		// lock the conversation so concurrent pins cannot exceed the limit
+		var conversation Conversation
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&conversation, "id = ?", conversationID).Error
+		if err != nil {
+			return err
+		}
+
+		var message Message
+		err = tx.Where("id = ? AND conversation_id = ? AND kind <> ?",
+			messageID, conversationID, MessageKindSystem).
+			First(&message).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errMessageNotFound
+		} else if err != nil {
+			return err
+		}
+
+		err = tx.Where("conversation_id = ? AND message_id = ?", conversationID, messageID).
+			First(&pin).Error
+		if err == nil {
+			// already pinned
+			return nil
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		var count int64
+		err = tx.Model(&PinnedMessage{}).Where("conversation_id = ?", conversationID).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count >= maxPinnedMessages {
+			return errTooManyPins
+		}
+
+		pin = PinnedMessage{ConversationID: conversationID, MessageID: messageID, PinnedByID: userID}
+		if err := tx.Create(&pin).Error; err != nil {
+			return err
+		}
+		systemMessage, err = m.createSystemMessage(tx, conversationID, userID, "pin", messageID, "pinned a message")
+		return err
+	})
+	if err != nil {
+		return writePinError(w, err)
+	}
+
+	if err := m.db.Preload("Message").First(&pin, "id = ?", pin.ID).Error; err != nil {
+		return err
+	}
+	info := pinnedMessageInfo(pin)
+	if systemMessage != nil {
+		m.notifyParticipants(conversationID, newMessagePayload(*systemMessage))
+		m.notifyParticipants(conversationID, SocketEvent{Type: "messagePinned", Content: info})
+	}
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UnpinMessage(
+	conversationID string,
+	messageID string,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if err := m.canPin(conversationID, userID); err != nil {
+		return writePinError(w, err)
+	}
+
+	result := m.db.Where("conversation_id = ? AND message_id = ?", conversationID, messageID).
+		Delete(&PinnedMessage{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return writePinError(w, errMessageNotFound)
+	}
+
+	info := UnpinnedMessageInfo{ConversationID: conversationID, MessageID: messageID}
+	m.notifyParticipants(conversationID, SocketEvent{Type: "messageUnpinned", Content: info})
+	return utils.WriteJson(w, http.StatusOK, info)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetPinnedMessages(conversationID string, userID string, w http.ResponseWriter) error {
+	ok, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writePinError(w, errNotParticipant)
+	}
+
+	var pins []PinnedMessage
+	err = m.db.Joins("JOIN messages ON messages.id = pinned_messages.message_id").
+		Scopes(notExpired).
+		Preload("Message").
+		Scopes(preloadMessageDetails("Message.")).
+		Where("pinned_messages.conversation_id = ?", conversationID).
+		Order("pinned_messages.created_at DESC").
+		Find(&pins).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch pinned messages"},
+		)
+	}
+
+	infos := []PinnedMessageInfo{}
+	for _, pin := range pins {
+		infos = append(infos, pinnedMessageInfo(pin))
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// canPin checks that userID may change the pins of conversationID, in
+// groups that is left to admins
+func (m *PostgresMessage) canPin(conversationID string, userID string) error {
+	var conversation Conversation
+	err := m.db.Select("id", "is_group").First(&conversation, "id = ?", conversationID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errNotParticipant
+	} else if err != nil {
+		return err
+	}
+	role, err := participantRole(m.db, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if conversation.IsGroup && !role.canManage() {
+		return errNotGroupAdmin
+	}
+	return nil
+}
+
+func pinnedMessageInfo(pin PinnedMessage) PinnedMessageInfo {
+	return PinnedMessageInfo{
+		ConversationID: pin.ConversationID,
+		Message:        messageType(pin.Message),
+		PinnedBy:       pin.PinnedByID,
+		PinnedAt:       pin.CreatedAt,
+	}
+}
+
+func writePinError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errNotParticipant), errors.Is(err, gorm.ErrRecordNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	case errors.Is(err, errMessageNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errNotGroupAdmin):
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errTooManyPins):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return err
+}
@@ -0,0 +1,404 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	minPollOptions       = 2
+	maxPollOptions       = 10
+	maxPollQuestionChars = 300
+	maxPollOptionChars   = 100
+)
+
+var (
+	errPollNotFound    = errors.New("poll not found")
+	errPollClosed      = errors.New("poll is closed")
+	errInvalidPollVote = errors.New("unknown option or too many options for this poll")
+	errNotPollCreator  = errors.New("only the creator can close this poll")
+	errInvalidPoll     = errors.New("a poll needs a question and 2 to 10 distinct options")
+	errPollCloseInPast = errors.New("closesAt must be in the future")
+	errPollTextTooLong = errors.New("poll question or option is too long")
+	errPollClientID    = errors.New("clientId is too long")
+)
+
+type PollRequest struct {
+	Question       string     `json:"question"`
+	Options        []string   `json:"options"`
+	MultipleChoice bool       `json:"multipleChoice"`
+	Anonymous      bool       `json:"anonymous"`
+	ClosesAt       *time.Time `json:"closesAt"`
+	ClientID       string     `json:"clientId"`
+}
+
+type PollVoteRequest struct {
+	// an empty list retracts the caller's vote
+	OptionIDs []string `json:"optionIds"`
+}
+
+type PollInfo struct {
+	ID             string           `json:"id"`
+	MessageID      string           `json:"messageId"`
+	ConversationID string           `json:"conversationId"`
+	Question       string           `json:"question"`
+	MultipleChoice bool             `json:"multipleChoice"`
+	Anonymous      bool             `json:"anonymous"`
+	ClosesAt       *time.Time       `json:"closesAt,omitempty"`
+	Closed         bool             `json:"closed"`
+	Options        []PollOptionInfo `json:"options"`
+	TotalVoters    int              `json:"totalVoters"`
+	// options the requesting user voted for, only set on per-user reads
+	MyVotes []string `json:"myVotes,omitempty"`
+}
+
+type PollOptionInfo struct {
+	ID     string   `json:"id"`
+	Text   string   `json:"text"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) CreatePoll(
+	conversationID string,
+	req *PollRequest,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	if err := validatePoll(req); err != nil {
+		return writePollError(w, err)
+	}
+	participant, err := m.isParticipant(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !participant {
+		return writePollError(w, errNotParticipant)
+	}
+
+	// a retry returns the poll the first attempt created before moderation
+	// could count it as a repeat
+	if existing, err := m.messageByClientID(userID, req.ClientID); err != nil || existing != nil {
+		if err != nil {
+			return err
+		}
+		return utils.WriteJson(w, http.StatusOK, messageType(*existing))
+	}
+
+	// question and options are checked one by one so masking stays per text
+	var findings []moderation.Finding
+	texts := append([]string{req.Question}, req.Options...)
+	for i, text := range texts {
+		verdict, err := m.moderateText(text, userID)
+		if err != nil {
+			return writeModerationError(w, err)
+		}
+		texts[i] = verdict.Body
+		findings = append(findings, verdict.Findings...)
+	}
+	req.Question, req.Options = texts[0], texts[1:]
+
+	message := Message{
+		SenderID: userID,
+		Body:     strings.TrimSpace(req.Question),
+		Kind:     MessageKindPoll,
+	}
+	if req.ClientID != "" {
+		message.ClientMessageID = &req.ClientID
+	}
+	poll := Poll{
+		Question:       strings.TrimSpace(req.Question),
+		MultipleChoice: req.MultipleChoice,
+		Anonymous:      req.Anonymous,
+		ClosesAt:       req.ClosesAt,
+	}
+	for i, text := range req.Options {
+		poll.Options = append(poll.Options, PollOption{Position: i, Text: strings.TrimSpace(text)})
+	}
+
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		var conversation Conversation
+		if err := tx.First(&conversation, "id = ?", conversationID).Error; err != nil {
+			return err
+		}
+		// the poll is created on its own, a duplicate client id leaves the
+		// message without an id to link it to
+		if err := storeInConversation(tx, &conversation, &message); err != nil {
+			return err
+		}
+		if err := recordFlags(tx, &message, findings); err != nil {
+			return err
+		}
+		poll.MessageID = message.ID
+		return tx.Create(&poll).Error
+	})
+	if errors.Is(err, errDuplicateClientID) {
+		existing, err := m.messageByClientID(userID, req.ClientID)
+		if err != nil || existing == nil {
+			return err
+		}
+		return utils.WriteJson(w, http.StatusOK, messageType(*existing))
+	} else if err != nil {
+		return writePollError(w, err)
+	}
+	message.Poll = &poll
+
+	m.deliverToConversation(&message)
+	return utils.WriteJson(w, http.StatusCreated, messageType(message))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetPoll(pollID string, userID string, w http.ResponseWriter) error {
+	poll, err := m.readablePoll(m.db, pollID, userID)
+	if err != nil {
+		return writePollError(w, err)
+	}
+	return utils.WriteJson(w, http.StatusOK, pollInfo(*poll, userID))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) VotePoll(
+	pollID string,
+	req *PollVoteRequest,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	var poll *Poll
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		// serializes votes on the poll, so two concurrent votes of one user
+		// cannot both clear the old vote and leave two behind, and orders
+		// them against ClosePoll
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id").
+			Where("id = ?", pollID).
+			Find(&Poll{}).Error
+		if err != nil {
+			return err
+		}
+		poll, err = m.readablePoll(tx, pollID, userID)
+		if err != nil {
+			return err
+		}
+		if pollClosed(poll) {
+			return errPollClosed
+		}
+
+		optionIDs := uniqueStrings(req.OptionIDs)
+		if len(optionIDs) > 1 && !poll.MultipleChoice {
+			return errInvalidPollVote
+		}
+		valid := map[string]bool{}
+		for _, option := range poll.Options {
+			valid[option.ID] = true
+		}
+		for _, id := range optionIDs {
+			if !valid[id] {
+				return errInvalidPollVote
+			}
+		}
+
+		// a vote replaces the previous one of the same user
+		if err := tx.Where("poll_id = ? AND user_id = ?", poll.ID, userID).Delete(&PollVote{}).Error; err != nil {
+			return err
+		}
+		for _, id := range optionIDs {
+			vote := PollVote{PollID: poll.ID, OptionID: id, UserID: userID}
+			if err := tx.Create(&vote).Error; err != nil {
+				return err
+			}
+		}
+		_, err = appendEvent(tx, poll.Message.ConversationID, EventMessageUpdated, poll.MessageID)
+		return err
+	})
+	if err != nil {
+		return writePollError(w, err)
+	}
+
+	updated, err := m.readablePoll(m.db, pollID, userID)
+	if err != nil {
+		return err
+	}
+	m.notifyPollUpdated(*updated)
+	return utils.WriteJson(w, http.StatusOK, pollInfo(*updated, userID))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) ClosePoll(pollID string, userID string, w http.ResponseWriter) error {
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		poll, err := m.readablePoll(tx, pollID, userID)
+		if err != nil {
+			return err
+		}
+		if poll.Message.SenderID != userID {
+			return errNotPollCreator
+		}
+		if pollClosed(poll) {
+			return nil
+		}
+		if err := tx.Model(poll).Update("closed_at", time.Now()).Error; err != nil {
+			return err
+		}
+		_, err = appendEvent(tx, poll.Message.ConversationID, EventMessageUpdated, poll.MessageID)
+		return err
+	})
+	if err != nil {
+		return writePollError(w, err)
+	}
+
+	poll, err := m.readablePoll(m.db, pollID, userID)
+	if err != nil {
+		return err
+	}
+	m.notifyPollUpdated(*poll)
+	return utils.WriteJson(w, http.StatusOK, pollInfo(*poll, userID))
+}
+
+// readablePoll loads a poll with its options and votes if userID takes part
+// in the poll's conversation
+func (m *PostgresMessage) readablePoll(db *gorm.DB, pollID string, userID string) (*Poll, error) {
+	var poll Poll
+	err := db.Preload("Message").
+		Preload("Options", func(db *gorm.DB) *gorm.DB { return db.Order("position ASC") }).
+		Preload("Votes").
+		Joins("JOIN messages ON messages.id = polls.message_id").
+		Joins("JOIN conversation_participants cp ON cp.conversation_id = messages.conversation_id").
+		Where("polls.id = ? AND cp.user_id = ?", pollID, userID).
+		Scopes(notExpired).
+		First(&poll).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errPollNotFound
+	}
+	return &poll, err
+}
+
+func (m *PostgresMessage) notifyPollUpdated(poll Poll) {
+	m.notifyParticipants(poll.Message.ConversationID, SocketEvent{
+		Type:    "pollUpdated",
+		Content: pollInfo(poll, ""),
+	})
+}
+
+func pollClosed(poll *Poll) bool {
+	return poll.ClosedAt != nil || (poll.ClosesAt != nil && !poll.ClosesAt.After(time.Now()))
+}
+
+// pollInfo aggregates the votes of poll, voters are only listed for polls
+// that are not anonymous. viewerID fills MyVotes when set.
+func pollInfo(poll Poll, viewerID string) PollInfo {
+	info := PollInfo{
+		ID:             poll.ID,
+		MessageID:      poll.MessageID,
+		ConversationID: poll.Message.ConversationID,
+		Question:       poll.Question,
+		MultipleChoice: poll.MultipleChoice,
+		Anonymous:      poll.Anonymous,
+		ClosesAt:       poll.ClosesAt,
+		Closed:         pollClosed(&poll),
+		Options:        make([]PollOptionInfo, 0, len(poll.Options)),
+	}
+	byOption := map[string][]string{}
+	voters := map[string]bool{}
+	for _, vote := range poll.Votes {
+		byOption[vote.OptionID] = append(byOption[vote.OptionID], vote.UserID)
+		voters[vote.UserID] = true
+		if viewerID != "" && vote.UserID == viewerID {
+			info.MyVotes = append(info.MyVotes, vote.OptionID)
+		}
+	}
+	info.TotalVoters = len(voters)
+	for _, option := range poll.Options {
+		optionInfo := PollOptionInfo{ID: option.ID, Text: option.Text, Votes: len(byOption[option.ID])}
+		if !poll.Anonymous {
+			optionInfo.Voters = byOption[option.ID]
+		}
+		info.Options = append(info.Options, optionInfo)
+	}
+	return info
+}
+
+func messagePollInfo(message Message) *PollInfo {
+	if message.Poll == nil {
+		return nil
+	}
+	poll := *message.Poll
+	poll.Message = message
+	info := pollInfo(poll, "")
+	return &info
+}
+
+func validatePoll(req *PollRequest) error {
+	question := strings.TrimSpace(req.Question)
+	if question == "" || len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return errInvalidPoll
+	}
+	if utf8.RuneCountInString(question) > maxPollQuestionChars {
+		return errPollTextTooLong
+	}
+	seen := map[string]bool{}
+	for _, option := range req.Options {
+		text := strings.TrimSpace(option)
+		if text == "" || seen[strings.ToLower(text)] {
+			return errInvalidPoll
+		}
+		if utf8.RuneCountInString(text) > maxPollOptionChars {
+			return errPollTextTooLong
+		}
+		seen[strings.ToLower(text)] = true
+	}
+	if req.ClosesAt != nil && !req.ClosesAt.After(time.Now()) {
+		return errPollCloseInPast
+	}
+	if len(req.ClientID) > maxClientIDLength {
+		return errPollClientID
+	}
+	return nil
+}
+
+func writePollError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errNotParticipant), errors.Is(err, gorm.ErrRecordNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errNotParticipant.Error()})
+	case errors.Is(err, errPollNotFound):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errPollClosed):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errNotPollCreator):
+		return utils.WriteJson(w, http.StatusForbidden, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errInvalidPoll), errors.Is(err, errInvalidPollVote),
+		errors.Is(err, errPollCloseInPast), errors.Is(err, errPollTextTooLong),
+		errors.Is(err, errPollClientID):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return writeBlockError(w, err)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodePollRequest(r *http.Request) (*PollRequest, error) {
+	req := new(PollRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodePollVote(r *http.Request) (*PollVoteRequest, error) {
+	req := new(PollVoteRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
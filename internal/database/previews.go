@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/linkpreview"
+)
+
+const (
+	maxPreviewsPerMessage = 3
+	previewCacheTTL       = 24 * time.Hour
+	failedPreviewCacheTTL = time.Hour
+)
+
+// attachLinkPreviews runs after a message was stored. It looks up or fetches
+// metadata for the URLs in the body and pushes a messageUpdated event to the
+// participants once something was attached.
+func (m *PostgresMessage) attachLinkPreviews(message Message) {
+	urls := linkpreview.ExtractURLs(message.Body, maxPreviewsPerMessage)
+	if len(urls) == 0 {
+		return
+	}
+
+	// bound the number of concurrent outgoing fetches
+	m.previewSlots <- struct{}{}
+	defer func() { <-m.previewSlots }()
+
+	var previews []LinkPreview
+	for _, url := range urls {
+		preview, err := m.linkPreview(url)
+		if err != nil {
+			log.Printf("Error loading link preview for %s: %v", url, err)
+			continue
+		}
+		if !preview.Failed {
+			previews = append(previews, *preview)
+		}
+	}
+	if len(previews) == 0 {
+		return
+	}
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&message).Association("LinkPreviews").Append(&previews); err != nil {
+			return err
+		}
+		_, err := appendEvent(tx, message.ConversationID, EventMessageUpdated, message.ID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Error attaching link previews to %s: %v", message.ID, err)
+		return
+	}
+	m.notifyMessageUpdated(message.ID)
+}
+
+// linkPreview returns the cached preview for url, fetching it when the cache
+// entry is missing or stale. Failed fetches are cached for a shorter time.
+func (m *PostgresMessage) linkPreview(url string) (*LinkPreview, error) {
+	var cached LinkPreview
+	err := m.db.Where("url = ?", url).First(&cached).Error
+	if err == nil {
+		ttl := previewCacheTTL
+		if cached.Failed {
+			ttl = failedPreviewCacheTTL
+		}
+		if time.Since(cached.FetchedAt) < ttl {
+			return &cached, nil
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	preview := LinkPreview{URL: url, FetchedAt: time.Now()}
+	fetched, err := m.previews.Fetch(context.Background(), url)
+	if err != nil {
+		preview.Failed = true
+	} else {
+		preview.Title = fetched.Title
+		preview.Description = fetched.Description
+		preview.SiteName = fetched.SiteName
+		preview.ImageURL = fetched.ImageURL
+		preview.Type = fetched.Type
+	}
+
+	err = m.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "url"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"title", "description", "site_name", "image_url", "type", "failed", "fetched_at",
+		}),
+	}).Create(&preview).Error
+	if err != nil {
+		return nil, err
+	}
+	// the id is not returned when the row already existed
+	err = m.db.Where("url = ?", url).First(&preview).Error
+	return &preview, err
+}
+
+func (m *PostgresMessage) notifyMessageUpdated(messageID string) {
+	var message Message
+	err := m.db.Scopes(preloadMessageDetails("")).
+		First(&message, "id = ?", messageID).Error
+	if err != nil {
+		log.Printf("Error loading message %s: %v", messageID, err)
+		return
+	}
+	m.notifyParticipants(message.ConversationID, SocketEvent{Type: "messageUpdated", Content: messageType(message)})
+}
+
+func linkPreviewInfos(previews []LinkPreview) []linkpreview.Preview {
+	var infos []linkpreview.Preview
+	for _, p := range previews {
+		infos = append(infos, linkpreview.Preview{
+			URL:         p.URL,
+			Title:       p.Title,
+			Description: p.Description,
+			SiteName:    p.SiteName,
+			ImageURL:    p.ImageURL,
+			Type:        p.Type,
+		})
+	}
+	return infos
+}
@@ -0,0 +1,389 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/internal/moderation"
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// deliveries failing for a passing reason are retried with a doubling
+	// delay before the message is given up on
+	maxScheduledAttempts = 5
+	scheduledRetryDelay  = time.Minute
+)
+
+type ScheduledMessageInfo struct {
+	ID          string          `json:"id"`
+	ClientID    string          `json:"clientId,omitempty"`
+	ReceiverID  string          `json:"receiverId"`
+	Body        string          `json:"body"`
+	Attachments []string        `json:"attachments"`
+	SendAt      time.Time       `json:"sendAt"`
+	Status      ScheduledStatus `json:"status"`
+	MessageID   string          `json:"messageId,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+type ScheduledMessageSent struct {
+	ScheduledID string      `json:"scheduledId"`
+	Message     MessageType `json:"message"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) scheduleMessage(
+	mess *MessagePlain,
+	senderId string,
+	receiverId string,
+	w http.ResponseWriter,
+) error {
+	if mess.SendAt.After(time.Now().Add(maxScheduleAhead)) {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "messages can be scheduled at most one year ahead"},
+		)
+	}
+	attachmentIDs, err := json.Marshal(nonNilStrings(mess.Attachments))
+	if err != nil {
+		return err
+	}
+
+	scheduled := ScheduledMessage{
+		SenderID:      senderId,
+		ReceiverID:    receiverId,
+		Body:          mess.Content,
+		Entities:      mess.Entities,
+		AttachmentIDs: string(attachmentIDs),
+		SendAt:        *mess.SendAt,
+		Status:        ScheduledPending,
+	}
+	if mess.ClientID != "" {
+		scheduled.ClientMessageID = &mess.ClientID
+	}
+	result := m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&scheduled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		// retried request, answer with the first one
+		err := m.db.Where("sender_id = ? AND client_message_id = ?", senderId, mess.ClientID).
+			First(&scheduled).Error
+		if err != nil {
+			return err
+		}
+	}
+	return utils.WriteJson(w, http.StatusAccepted, scheduledMessageInfo(scheduled))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetScheduledMessages(senderId string, w http.ResponseWriter) error {
+	var scheduled []ScheduledMessage
+	err := m.db.Where("sender_id = ? AND status = ?", senderId, ScheduledPending).
+		Order("send_at ASC").
+		Find(&scheduled).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch scheduled messages"},
+		)
+	}
+
+	infos := []ScheduledMessageInfo{}
+	for _, s := range scheduled {
+		infos = append(infos, scheduledMessageInfo(s))
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UpdateScheduledMessage(
+	scheduledId string,
+	senderId string,
+	mess *MessagePlain,
+	w http.ResponseWriter,
+) error {
+	if err := formatMessage(mess); err != nil {
+		return writeFormatError(w, err)
+	}
+	if utf8.RuneCountInString(mess.Content) > maxMessageLength {
+		return writeSendError(w, errMessageTooLong)
+	}
+	if err := m.moderate(mess, senderId); err != nil {
+		return writeModerationError(w, err)
+	}
+	updates := map[string]interface{}{}
+	if mess.Content != "" {
+		updates["body"] = mess.Content
+		updates["entities"] = mess.Entities
+	}
+	if mess.Attachments != nil {
+		attachmentIDs, err := json.Marshal(nonNilStrings(mess.Attachments))
+		if err != nil {
+			return err
+		}
+		updates["attachment_ids"] = string(attachmentIDs)
+	}
+	if mess.SendAt != nil {
+		if mess.SendAt.Before(time.Now()) || mess.SendAt.After(time.Now().Add(maxScheduleAhead)) {
+			return utils.WriteJson(
+				w,
+				http.StatusUnprocessableEntity,
+				utils.ApiError{ErrorMessage: "sendAt must be in the future and at most one year ahead"},
+			)
+		}
+		updates["send_at"] = *mess.SendAt
+	}
+	if len(updates) == 0 {
+		return utils.WriteJson(w, http.StatusBadRequest, utils.ApiError{ErrorMessage: "nothing to update"})
+	}
+	// an edit starts the retries over
+	updates["attempts"] = 0
+	updates["retry_at"] = nil
+
+	var scheduled ScheduledMessage
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		// rows the scheduler is delivering are locked and no longer pending
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND sender_id = ? AND status = ?", scheduledId, senderId, ScheduledPending).
+			First(&scheduled).Error
+		if err != nil {
+			return err
+		}
+		// the edit must not leave a message without text or attachments
+		merged := scheduledPlain(scheduled)
+		if mess.Content != "" {
+			merged.Content = mess.Content
+		}
+		if mess.Attachments != nil {
+			merged.Attachments = mess.Attachments
+		}
+		if err := validateMessage(merged); err != nil {
+			return err
+		}
+		if err := tx.Model(&scheduled).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.First(&scheduled, "id = ?", scheduledId).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return utils.WriteJson(
+			w,
+			http.StatusNotFound,
+			utils.ApiError{ErrorMessage: "scheduled message not found or already sent"},
+		)
+	}
+	if err != nil {
+		return writeSendError(w, err)
+	}
+	return utils.WriteJson(w, http.StatusOK, scheduledMessageInfo(scheduled))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) CancelScheduledMessage(scheduledId string, senderId string, w http.ResponseWriter) error {
+	result := m.db.Model(&ScheduledMessage{}).
+		Where("id = ? AND sender_id = ? AND status = ?", scheduledId, senderId, ScheduledPending).
+		Update("status", ScheduledCanceled)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return utils.WriteJson(
+			w,
+			http.StatusNotFound,
+			utils.ApiError{ErrorMessage: "scheduled message not found or already sent"},
+		)
+	}
+	return utils.WriteJson(w, http.StatusOK, map[string]string{"message": "scheduled message canceled"})
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+// scheduler
+
+// StartScheduler delivers due scheduled messages every interval. Each row is
+// claimed with FOR UPDATE SKIP LOCKED and marked sent in the same transaction
+// that stores the message, so several instances never deliver it twice and a
+// crash before commit leaves it pending for the next run.
+func (m *PostgresMessage) StartScheduler(interval time.Duration) {
+	go func() {
+		for {
+			for {
+				delivered, err := m.deliverDueMessage()
+				if err != nil {
+					log.Printf("Error delivering scheduled message: %v", err)
+				}
+				if !delivered {
+					break
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (m *PostgresMessage) deliverDueMessage() (bool, error) {
+	var scheduled ScheduledMessage
+	var newMessage *Message
+	var sendErr error
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND send_at <= ?", ScheduledPending, now).
+			Where("retry_at IS NULL OR retry_at <= ?", now).
+			Order("send_at ASC").
+			First(&scheduled).Error
+		if err != nil {
+			return err
+		}
+
+		// rules are checked again at delivery, they may have changed and
+		// spam detection depends on what was sent in the meantime
+		mess := scheduledPlain(scheduled)
+		sendErr = validateMessage(mess)
+		if sendErr == nil {
+			sendErr = m.moderate(mess, scheduled.SenderID)
+		}
+		if sendErr == nil {
+			// a savepoint keeps the claim usable when storing fails
+			sendErr = tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				newMessage, err = m.storeMessage(tx, mess, scheduled.SenderID, scheduled.ReceiverID)
+				if err == nil && strings.TrimSpace(newMessage.Body) == "" && len(newMessage.Attachments) == 0 {
+					// its uploads went out with another message in the meantime
+					err = errEmptyMessage
+				}
+				return err
+			})
+		}
+		if errors.Is(sendErr, errDuplicateClientID) {
+			// an earlier attempt stored it but never got to mark the row
+			existing, err := m.messageByClientID(scheduled.SenderID, mess.ClientID)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				newMessage = nil
+				return tx.Model(&scheduled).Updates(map[string]interface{}{
+					"status":     ScheduledSent,
+					"message_id": existing.ID,
+				}).Error
+			}
+		}
+		if sendErr != nil {
+			newMessage = nil
+			if !rejectedSend(sendErr) {
+				// rolling back leaves the row pending for retryScheduled
+				return sendErr
+			}
+			return tx.Model(&scheduled).Updates(map[string]interface{}{
+				"status":     ScheduledFailed,
+				"last_error": sendErr.Error(),
+			}).Error
+		}
+		return tx.Model(&scheduled).Updates(map[string]interface{}{
+			"status":     ScheduledSent,
+			"message_id": newMessage.ID,
+		}).Error
+	})
+	if sendErr != nil && errors.Is(err, sendErr) {
+		return m.retryScheduled(&scheduled, sendErr)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if newMessage != nil {
+		m.deliverToConversation(newMessage)
+		notifyUsers([]string{scheduled.SenderID}, SocketEvent{
+			Type:    "scheduledMessageSent",
+			Content: ScheduledMessageSent{ScheduledID: scheduled.ID, Message: messageType(*newMessage)},
+		})
+	}
+	return true, nil
+}
+
+// retryScheduled postpones a delivery that failed for a passing reason, or
+// gives up on it once it used up its attempts. The scheduler goes on with
+// other due messages when the retry could be recorded.
+func (m *PostgresMessage) retryScheduled(scheduled *ScheduledMessage, sendErr error) (bool, error) {
+	updates := map[string]interface{}{
+		"attempts":   scheduled.Attempts + 1,
+		"last_error": sendErr.Error(),
+		"retry_at":   time.Now().Add(scheduledRetryDelay << scheduled.Attempts),
+	}
+	if scheduled.Attempts+1 >= maxScheduledAttempts {
+		updates["status"] = ScheduledFailed
+	}
+	err := m.db.Model(&ScheduledMessage{}).
+		Where("id = ? AND status = ?", scheduled.ID, ScheduledPending).
+		Updates(updates).Error
+	if err != nil {
+		return false, err
+	}
+	return true, fmt.Errorf("scheduled message %s: %w", scheduled.ID, sendErr)
+}
+
+// rejectedSend reports whether a delivery failed because the message itself
+// may not be sent, as opposed to a database or network error worth retrying
+func rejectedSend(err error) bool {
+	var rejected *moderation.RejectedError
+	return errors.As(err, &rejected) ||
+		errors.Is(err, errEmptyMessage) || errors.Is(err, errMessageTooLong) ||
+		errors.Is(err, errBlockedUser) || errors.Is(err, errBlockedBy) ||
+		errors.Is(err, errRequestDeclined) || errors.Is(err, errDuplicateClientID)
+}
+
+// scheduledPlain rebuilds the message a scheduled row will send
+func scheduledPlain(scheduled ScheduledMessage) *MessagePlain {
+	var attachmentIDs []string
+	if err := json.Unmarshal([]byte(scheduled.AttachmentIDs), &attachmentIDs); err != nil {
+		attachmentIDs = nil
+	}
+	return &MessagePlain{
+		ClientID:    stringValue(scheduled.ClientMessageID),
+		Content:     scheduled.Body,
+		Entities:    scheduled.Entities,
+		Attachments: attachmentIDs,
+	}
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func scheduledMessageInfo(s ScheduledMessage) ScheduledMessageInfo {
+	info := ScheduledMessageInfo{
+		ID:         s.ID,
+		ClientID:   stringValue(s.ClientMessageID),
+		ReceiverID: s.ReceiverID,
+		Body:       s.Body,
+		SendAt:     s.SendAt,
+		Status:     s.Status,
+		MessageID:  stringValue(s.MessageID),
+		CreatedAt:  s.CreatedAt,
+	}
+	if err := json.Unmarshal([]byte(s.AttachmentIDs), &info.Attachments); err != nil || info.Attachments == nil {
+		info.Attachments = []string{}
+	}
+	return info
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+	maxSearchQuery     = 64
+	// chats within this window rank above older ones
+	recentChatWindow = 30 * 24 * time.Hour
+)
+
+type UserSearchResult struct {
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	FullName   string     `json:"fullname"`
+	ProfilePic string     `json:"profilePic"`
+	IsContact  bool       `json:"isContact"`
+	LastChatAt *time.Time `json:"lastChatAt,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (u *PostgresUser) SearchUsers(userID string, query string, offset int, limit int, w http.ResponseWriter) error {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" || utf8.RuneCountInString(query) > maxSearchQuery {
+		return utils.WriteJson(
+			w,
+			http.StatusUnprocessableEntity,
+			utils.ApiError{ErrorMessage: "q must be between 1 and 64 characters"},
+		)
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+	offset = max(offset, 0)
+
+	prefix := escapeLike(query) + "%"
+	wordPrefix := "% " + prefix
+	// last message in each direct chat with the searching user
+	lastChats := u.db.Table("conversation_participants me").
+		Select("other.user_id, MAX(messages.created_at) AS last_at").
+		Joins("JOIN conversations c ON c.id = me.conversation_id AND NOT c.is_group").
+		Joins("JOIN conversation_participants other ON other.conversation_id = me.conversation_id"+
+			" AND other.user_id <> me.user_id").
+		Joins("JOIN messages ON messages.conversation_id = me.conversation_id").
+		Where("me.user_id = ? AND NOT me.is_request AND NOT me.request_declined", userID).
+		Group("other.user_id")
+	blocked := u.db.Model(&Block{}).Select("blocked_id").Where("blocker_id = ?", userID)
+	blockedBy := u.db.Model(&Block{}).Select("blocker_id").Where("blocked_id = ?", userID)
+
+	// prefix matches beat fuzzy ones, then contacts and recent chat partners
+	// get a boost on top of the trigram similarity
+	score := gorm.Expr(`GREATEST(similarity(lower(users.username), ?), similarity(lower(users.full_name), ?))
+		+ CASE WHEN lower(users.username) LIKE ? ESCAPE '\' OR lower(users.full_name) LIKE ? ESCAPE '\'
+			OR lower(users.full_name) LIKE ? ESCAPE '\' THEN 1 ELSE 0 END
+		+ CASE WHEN contacts.contact_id IS NOT NULL THEN 0.5 ELSE 0 END
+		+ CASE WHEN chats.last_at > ? THEN 0.3 WHEN chats.last_at IS NOT NULL THEN 0.1 ELSE 0 END`,
+		query, query, prefix, prefix, wordPrefix, time.Now().Add(-recentChatWindow))
+
+	results := []UserSearchResult{}
+	err := u.db.Model(&User{}).
+		Select("users.id, users.username, users.full_name, users.profile_pic,"+
+			" contacts.contact_id IS NOT NULL AS is_contact, chats.last_at AS last_chat_at").
+		Joins("LEFT JOIN contacts ON contacts.user_id = ? AND contacts.contact_id = users.id", userID).
+		Joins("LEFT JOIN (?) chats ON chats.user_id = users.id", lastChats).
+		Where("users.id <> ?", userID).
+		Where("users.searchable OR contacts.contact_id IS NOT NULL").
+		Where("users.id NOT IN (?) AND users.id NOT IN (?)", blocked, blockedBy).
+		Where(`lower(users.username) LIKE ? ESCAPE '\' OR lower(users.full_name) LIKE ? ESCAPE '\'
+			OR lower(users.full_name) LIKE ? ESCAPE '\'
+			OR lower(users.username) % ? OR lower(users.full_name) % ?`,
+			prefix, prefix, wordPrefix, query, query).
+		Clauses(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "? DESC, users.username ASC",
+			Vars:               []interface{}{score},
+			WithoutParentheses: true,
+		}}).
+		Offset(offset).
+		Limit(limit).
+		Scan(&results).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to search users"},
+		)
+	}
+	return utils.WriteJson(w, http.StatusOK, results)
+}
+
+// createSearchIndexes adds the trigram indexes behind SearchUsers, they
+// serve both the prefix LIKE and the fuzzy % matches
+func createSearchIndexes(db *gorm.DB) error {
+	if err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_users_username_trgm
+		ON users USING GIN (lower(username) gin_trgm_ops)`).Error; err != nil {
+		return err
+	}
+	return db.Exec(`CREATE INDEX IF NOT EXISTS idx_users_full_name_trgm
+		ON users USING GIN (lower(full_name) gin_trgm_ops)`).Error
+}
+
+// escapeLike makes the LIKE wildcards in s match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
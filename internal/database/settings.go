@@ -0,0 +1,250 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	maxPinnedConversations = 5
+	maxMuteDuration        = 365 * 24 * time.Hour
+)
+
+var (
+	errTooManyPinnedConversations = errors.New("too many pinned conversations")
+	errInvalidMute                = errors.New("muteFor must be between 0 and a year in seconds")
+)
+
+type ConversationSettingsRequest struct {
+	Muted *bool `json:"muted"`
+	// seconds the mute lasts, 0 mutes until unmuted
+	MuteFor  int64 `json:"muteFor"`
+	Archived *bool `json:"archived"`
+	// keeps the conversation archived when new messages arrive
+	KeepArchived *bool `json:"keepArchived"`
+	Pinned       *bool `json:"pinned"`
+}
+
+type ConversationSettings struct {
+	ConversationID string     `json:"conversationId"`
+	Muted          bool       `json:"muted"`
+	MutedUntil     *time.Time `json:"mutedUntil,omitempty"`
+	Archived       bool       `json:"archived"`
+	KeepArchived   bool       `json:"keepArchived"`
+	Pinned         bool       `json:"pinned"`
+	PinnedAt       *time.Time `json:"pinnedAt,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetConversationSettings(
+	conversationID string,
+	userID string,
+	w http.ResponseWriter,
+) error {
+	var participant ConversationParticipant
+	err := m.db.Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		First(&participant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return writeSettingsError(w, errNotParticipant)
+	} else if err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, conversationSettings(participant))
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UpdateConversationSettings(
+	conversationID string,
+	userID string,
+	socketID string,
+	req *ConversationSettingsRequest,
+	w http.ResponseWriter,
+) error {
+	if req.MuteFor < 0 || time.Duration(req.MuteFor)*time.Second > maxMuteDuration {
+		return writeSettingsError(w, errInvalidMute)
+	}
+
+	var participant ConversationParticipant
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		// lock all of the user's rows so concurrent pins respect the limit
+		var participants []ConversationParticipant
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", userID).
+			Find(&participants).Error
+		if err != nil {
+			return err
+		}
+		pinned := 0
+		found := false
+		for _, p := range participants {
+			if p.ConversationID == conversationID {
+				participant = p
+				found = true
+			} else if p.PinnedAt != nil {
+				pinned++
+			}
+		}
+		if !found {
+			return errNotParticipant
+		}
+
+		now := time.Now()
+		if req.Muted != nil {
+			participant.Muted = *req.Muted
+			participant.MutedUntil = nil
+			if *req.Muted && req.MuteFor > 0 {
+				until := now.Add(time.Duration(req.MuteFor) * time.Second)
+				participant.MutedUntil = &until
+			}
+		}
+		if req.Archived != nil {
+			if !*req.Archived {
+				participant.ArchivedAt = nil
+			} else if participant.ArchivedAt == nil {
+				participant.ArchivedAt = &now
+			}
+		}
+		if req.KeepArchived != nil {
+			participant.KeepArchived = *req.KeepArchived
+		}
+		if req.Pinned != nil {
+			if !*req.Pinned {
+				participant.PinnedAt = nil
+			} else if participant.PinnedAt == nil {
+				if pinned >= maxPinnedConversations {
+					return errTooManyPinnedConversations
+				}
+				participant.PinnedAt = &now
+			}
+		}
+
+		return tx.Model(&ConversationParticipant{}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+			Updates(map[string]interface{}{
+				"muted":         participant.Muted,
+				"muted_until":   participant.MutedUntil,
+				"archived_at":   participant.ArchivedAt,
+				"keep_archived": participant.KeepArchived,
+				"pinned_at":     participant.PinnedAt,
+			}).Error
+	})
+	if err != nil {
+		return writeSettingsError(w, err)
+	}
+
+	settings := conversationSettings(participant)
+	notifyUserExcept(userID, socketID, SocketEvent{Type: "conversationSettingsUpdated", Content: settings})
+	return utils.WriteJson(w, http.StatusOK, settings)
+}
+
+// unarchive brings a conversation back for everyone who archived it without
+// asking to keep it archived, once a new message arrives
+func (m *PostgresMessage) unarchive(conversationID string) {
+	var participants []ConversationParticipant
+	err := m.db.Model(&participants).
+		Clauses(clause.Returning{}).
+		Where("conversation_id = ? AND archived_at IS NOT NULL AND NOT keep_archived", conversationID).
+		Update("archived_at", nil).Error
+	if err != nil {
+		log.Printf("Error unarchiving %s: %v", conversationID, err)
+		return
+	}
+	for _, participant := range participants {
+		notifyUsers([]string{participant.UserID}, SocketEvent{
+			Type:    "conversationSettingsUpdated",
+			Content: conversationSettings(participant),
+		})
+	}
+}
+
+// mutedUsers returns which of userIDs have conversationID muted right now,
+// pending message requests count as muted
+func (m *PostgresMessage) mutedUsers(conversationID string, userIDs []string) (map[string]bool, error) {
+	muted := map[string]bool{}
+	if len(userIDs) == 0 {
+		return muted, nil
+	}
+	var ids []string
+	err := m.db.Model(&ConversationParticipant{}).
+		Where("conversation_id = ? AND user_id IN ?", conversationID, userIDs).
+		Where("(muted AND (muted_until IS NULL OR muted_until > ?)) OR is_request", time.Now()).
+		Pluck("user_id", &ids).Error
+	for _, id := range ids {
+		muted[id] = true
+	}
+	return muted, err
+}
+
+// sidebarSettings returns the settings userID changed from the defaults,
+// keyed like sidebar entries: the partner's id for direct chats and the
+// conversation id for groups
+func (m *PostgresMessage) sidebarSettings(userID string) (map[string]ConversationSettings, error) {
+	var rows []struct {
+		EntryID string
+		ConversationParticipant
+	}
+	err := m.db.Table("conversation_participants cp").
+		Select("CASE WHEN c.is_group THEN c.id::text ELSE o.user_id::text END AS entry_id, cp.*").
+		Joins("JOIN conversations c ON c.id = cp.conversation_id").
+		Joins("LEFT JOIN conversation_participants o ON NOT c.is_group"+
+			" AND o.conversation_id = cp.conversation_id AND o.user_id <> cp.user_id").
+		Where("cp.user_id = ? AND (cp.muted OR cp.archived_at IS NOT NULL OR cp.pinned_at IS NOT NULL)", userID).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]ConversationSettings, len(rows))
+	for _, row := range rows {
+		// notes to self have no partner and no sidebar entry
+		if row.EntryID != "" {
+			settings[row.EntryID] = conversationSettings(row.ConversationParticipant)
+		}
+	}
+	return settings, nil
+}
+
+func conversationSettings(p ConversationParticipant) ConversationSettings {
+	settings := ConversationSettings{
+		ConversationID: p.ConversationID,
+		Archived:       p.ArchivedAt != nil,
+		KeepArchived:   p.KeepArchived,
+		Pinned:         p.PinnedAt != nil,
+		PinnedAt:       p.PinnedAt,
+	}
+	// an expired mute reads as unmuted without a write
+	if p.Muted && (p.MutedUntil == nil || p.MutedUntil.After(time.Now())) {
+		settings.Muted = true
+		settings.MutedUntil = p.MutedUntil
+	}
+	return settings
+}
+
+func writeSettingsError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, errNotParticipant):
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errTooManyPinnedConversations):
+		return utils.WriteJson(w, http.StatusConflict, utils.ApiError{ErrorMessage: err.Error()})
+	case errors.Is(err, errInvalidMute):
+		return utils.WriteJson(w, http.StatusUnprocessableEntity, utils.ApiError{ErrorMessage: err.Error()})
+	}
+	return err
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeConversationSettings(r *http.Request) (*ConversationSettingsRequest, error) {
+	req := new(ConversationSettingsRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
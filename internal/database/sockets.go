@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -24,18 +25,54 @@ type Messagews struct {
 	Content []string `json:"content"`
 }
 
+// SocketEvent wraps server pushes other than new messages, e.g. messageUpdated
+type SocketEvent struct {
+	Type    string      `json:"type"`
+	Content interface{} `json:"content"`
+}
+
 type NewMessage struct {
-	Id          string    `json:"id"`
-	Body        string    `json:"body"`
-	SenderId    string    `json:"senderId"`
-	CreatedAt   time.Time `json:"createdAt"`
-	ShouldShake bool      `json:"shouldShake,omitempty"`
+	Id             string           `json:"id"`
+	ClientId       string           `json:"clientId,omitempty"`
+	ConversationId string           `json:"conversationId,omitempty"`
+	Seq            int64            `json:"seq,omitempty"`
+	Body           string           `json:"body"`
+	Entities       Entities         `json:"entities,omitempty"`
+	SenderId       string           `json:"senderId"`
+	Kind           MessageKind      `json:"kind,omitempty"`
+	SystemAction   string           `json:"action,omitempty"`
+	TargetId       string           `json:"targetId,omitempty"`
+	ForwardedFrom  *ForwardInfo     `json:"forwardedFrom,omitempty"`
+	Attachments    []AttachmentInfo `json:"attachments,omitempty"`
+	Mentions       []MentionInfo    `json:"mentions,omitempty"`
+	Poll           *PollInfo        `json:"poll,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	ExpiresAt      *time.Time       `json:"expiresAt,omitempty"`
+	ShouldShake    bool             `json:"shouldShake,omitempty"`
+}
+
+type SocketConnected struct {
+	SocketId string `json:"socketId"`
+}
+
+// socketConn is one open socket, a user may have several (web and phone).
+// gorilla/websocket allows a single concurrent writer per connection.
+type socketConn struct {
+	id   string
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *socketConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteJSON(v)
 }
 
 var userSocketMap = struct {
 	sync.RWMutex
-	connections map[string]*websocket.Conn
-}{connections: make(map[string]*websocket.Conn)}
+	connections map[string]map[string]*socketConn
+}{connections: make(map[string]map[string]*socketConn)}
 
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -51,12 +88,18 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	socket := &socketConn{id: uuid.NewString(), conn: conn}
 	userSocketMap.Lock()
-	userSocketMap.connections[userId] = conn
+	if userSocketMap.connections[userId] == nil {
+		userSocketMap.connections[userId] = make(map[string]*socketConn)
+	}
+	userSocketMap.connections[userId][socket.id] = socket
 	userSocketMap.Unlock()
 
 	log.Printf("User connected: %s", userId)
 
+	// clients send the id back in X-Socket-Id so their own changes are not echoed
+	socket.WriteJSON(SocketEvent{Type: "connected", Content: SocketConnected{SocketId: socket.id}})
 	broadcastOnlineUsers()
 
 	for {
@@ -68,13 +111,20 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userSocketMap.Lock()
-	delete(userSocketMap.connections, userId)
+	delete(userSocketMap.connections[userId], socket.id)
+	if len(userSocketMap.connections[userId]) == 0 {
+		delete(userSocketMap.connections, userId)
+	}
 	userSocketMap.Unlock()
 	log.Printf("User disconnected: %s", userId)
 
 	broadcastOnlineUsers()
 }
 
+// presenceHidden returns, per user, whose presence they must not see. The
+// message store sets it so blocked users do not see each other online.
+var presenceHidden func(userIds []string) (map[string]map[string]bool, error)
+
 func broadcastOnlineUsers() {
 	userSocketMap.RLock()
 	onlineUsers := make([]string, 0, len(userSocketMap.connections))
@@ -83,37 +133,77 @@ func broadcastOnlineUsers() {
 	}
 	userSocketMap.RUnlock()
 
-	message := Messagews{
-		Type:    "getOnlineUsers",
-		Content: onlineUsers,
+	var hidden map[string]map[string]bool
+	if presenceHidden != nil {
+		var err error
+		if hidden, err = presenceHidden(onlineUsers); err != nil {
+			log.Println("Error loading hidden presence:", err)
+		}
 	}
-
-	for userId, conn := range userSocketMap.connections {
-		if err := conn.WriteJSON(message); err != nil {
-			log.Printf("Error sending online users to %s: %v", userId, err)
-			conn.Close()
-			userSocketMap.RUnlock()
-			userSocketMap.Lock()
-			delete(userSocketMap.connections, userId)
-			userSocketMap.Unlock()
-			userSocketMap.RLock()
+	for _, userId := range onlineUsers {
+		visible := onlineUsers
+		if len(hidden[userId]) > 0 {
+			visible = make([]string, 0, len(onlineUsers))
+			for _, id := range onlineUsers {
+				if !hidden[userId][id] {
+					visible = append(visible, id)
+				}
+			}
 		}
+		notifyUserExcept(userId, "", Messagews{Type: "getOnlineUsers", Content: visible})
 	}
 }
 
-func notifyReceiver(receiverId string, newMessage Message) {
-	userSocketMap.RLock()
-	defer userSocketMap.RUnlock()
+func newMessagePayload(newMessage Message) NewMessage {
+	return NewMessage{
+		Id:             newMessage.ID,
+		ClientId:       stringValue(newMessage.ClientMessageID),
+		ConversationId: newMessage.ConversationID,
+		Seq:            newMessage.Seq,
+		Body:           newMessage.Body,
+		Entities:       newMessage.Entities,
+		SenderId:       newMessage.SenderID,
+		Kind:           newMessage.Kind,
+		SystemAction:   newMessage.SystemAction,
+		TargetId:       stringValue(newMessage.TargetID),
+		ForwardedFrom:  forwardInfo(&newMessage),
+		Attachments:    attachmentInfos(newMessage.Attachments),
+		Mentions:       mentionInfos(newMessage.Mentions),
+		Poll:           messagePollInfo(newMessage),
+		CreatedAt:      newMessage.CreatedAt,
+		ExpiresAt:      newMessage.ExpiresAt,
+	}
+}
 
-	if conn, ok := userSocketMap.connections[receiverId]; ok {
-		message := NewMessage{
-			Id:        newMessage.ID,
-			Body:      newMessage.Body,
-			SenderId:  newMessage.SenderID,
-			CreatedAt: newMessage.CreatedAt,
+func notifyUsers(userIds []string, event interface{}) {
+	for _, userId := range userIds {
+		notifyUserExcept(userId, "", event)
+	}
+}
+
+// notifyUserExcept sends event to every socket of userId but exceptSocketId.
+// A failed write closes the socket, its read loop then unregisters it.
+func notifyUserExcept(userId string, exceptSocketId string, event interface{}) {
+	userSocketMap.RLock()
+	sockets := make([]*socketConn, 0, len(userSocketMap.connections[userId]))
+	for id, socket := range userSocketMap.connections[userId] {
+		if id != exceptSocketId {
+			sockets = append(sockets, socket)
 		}
-		if err := conn.WriteJSON(message); err != nil {
-			log.Printf("Error sending message to receiver %s: %v", receiverId, err)
+	}
+	userSocketMap.RUnlock()
+
+	for _, socket := range sockets {
+		if err := socket.WriteJSON(event); err != nil {
+			log.Printf("Error sending event to %s: %v", userId, err)
+			socket.conn.Close()
 		}
 	}
 }
+
+func isConnected(userId string) bool {
+	userSocketMap.RLock()
+	defer userSocketMap.RUnlock()
+	_, ok := userSocketMap.connections[userId]
+	return ok
+}
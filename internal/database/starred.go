@@ -0,0 +1,199 @@
+package database
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	defaultStarredLimit = 50
+	maxStarredLimit     = 100
+)
+
+type StarredMessageInfo struct {
+	MessageID      string `json:"messageId"`
+	ConversationID string `json:"conversationId"`
+	IsGroup        bool   `json:"isGroup"`
+	Name           string `json:"name,omitempty"`
+	AvatarURL      string `json:"avatarUrl,omitempty"`
+	// the other participant of a direct chat, empty for groups
+	Participants []UserInfo `json:"participants,omitempty"`
+	StarredAt    time.Time  `json:"starredAt"`
+	// nil with Deleted set once the message is gone for everyone
+	Message *MessageType `json:"message,omitempty"`
+	Deleted bool         `json:"deleted,omitempty"`
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) StarMessage(messageID string, userID string, w http.ResponseWriter) error {
+	var message Message
+	err := m.db.Joins("JOIN conversation_participants cp ON cp.conversation_id = messages.conversation_id").
+		Scopes(notExpired).
+		Where("messages.id = ? AND cp.user_id = ? AND messages.kind <> ?", messageID, userID, MessageKindSystem).
+		First(&message).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return utils.WriteJson(w, http.StatusNotFound, utils.ApiError{ErrorMessage: errMessageNotFound.Error()})
+	} else if err != nil {
+		return err
+	}
+
+	star := StarredMessage{UserID: userID, MessageID: message.ID, ConversationID: message.ConversationID}
+	err = m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&star).Error
+	if err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, map[string]string{"messageId": message.ID})
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) UnstarMessage(messageID string, userID string, w http.ResponseWriter) error {
+	err := m.db.Where("user_id = ? AND message_id = ?", userID, messageID).Delete(&StarredMessage{}).Error
+	if err != nil {
+		return err
+	}
+	return utils.WriteJson(w, http.StatusOK, map[string]string{"messageId": messageID})
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) GetStarredMessages(
+	userID string,
+	before *time.Time,
+	limit int,
+	w http.ResponseWriter,
+) error {
+	if limit <= 0 {
+		limit = defaultStarredLimit
+	}
+	limit = min(limit, maxStarredLimit)
+
+	// stars in conversations the user has left stay hidden until they rejoin
+	joined := m.db.Model(&ConversationParticipant{}).Select("conversation_id").Where("user_id = ?", userID)
+	query := m.db.Where("user_id = ? AND conversation_id IN (?)", userID, joined)
+	if before != nil {
+		query = query.Where("starred_at < ?", *before)
+	}
+	var stars []StarredMessage
+	err := query.Order("starred_at DESC").Limit(limit).Find(&stars).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to fetch starred messages"},
+		)
+	}
+
+	var messageIDs, conversationIDs []string
+	for _, star := range stars {
+		messageIDs = append(messageIDs, star.MessageID)
+		conversationIDs = append(conversationIDs, star.ConversationID)
+	}
+	messages := map[string]Message{}
+	contexts := map[string]starredContext{}
+	if len(stars) > 0 {
+		var found []Message
+		err := m.db.Scopes(notExpired, preloadMessageDetails("")).
+			Where("id IN ?", messageIDs).
+			Find(&found).Error
+		if err != nil {
+			return err
+		}
+		for _, message := range found {
+			messages[message.ID] = message
+		}
+		contexts, err = m.starredContexts(uniqueStrings(conversationIDs), userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	infos := []StarredMessageInfo{}
+	for _, star := range stars {
+		context := contexts[star.ConversationID]
+		info := StarredMessageInfo{
+			MessageID:      star.MessageID,
+			ConversationID: star.ConversationID,
+			IsGroup:        context.IsGroup,
+			Name:           context.Name,
+			AvatarURL:      context.AvatarURL,
+			Participants:   context.Participants,
+			StarredAt:      star.StarredAt,
+		}
+		// the star has no foreign key, so it outlives the message and shows
+		// a tombstone instead
+		if message, ok := messages[star.MessageID]; ok {
+			payload := messageType(message)
+			info.Message = &payload
+		} else {
+			info.Deleted = true
+		}
+		infos = append(infos, info)
+	}
+	return utils.WriteJson(w, http.StatusOK, infos)
+}
+
+type starredContext struct {
+	IsGroup      bool
+	Name         string
+	AvatarURL    string
+	Participants []UserInfo
+}
+
+// starredContexts describes each of the conversations, keyed by id. Groups
+// are named by their name and avatar, direct chats by the other participant
+// with the profiles of anyone userID has a block with hidden.
+func (m *PostgresMessage) starredContexts(
+	conversationIDs []string,
+	userID string,
+) (map[string]starredContext, error) {
+	var conversations []Conversation
+	err := m.db.Select("id", "is_group", "name", "avatar_url").
+		Where("id IN ?", conversationIDs).
+		Find(&conversations).Error
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]starredContext{}
+	var direct []string
+	for _, conversation := range conversations {
+		result[conversation.ID] = starredContext{
+			IsGroup:   conversation.IsGroup,
+			Name:      conversation.Name,
+			AvatarURL: conversation.AvatarURL,
+		}
+		if !conversation.IsGroup {
+			direct = append(direct, conversation.ID)
+		}
+	}
+	if len(direct) == 0 {
+		return result, nil
+	}
+
+	var rows []struct {
+		ConversationID string
+		UserInfo
+	}
+	err = m.db.Table("conversation_participants cp").
+		Select("cp.conversation_id, users.id, users.full_name, users.profile_pic").
+		Joins("JOIN users ON users.id = cp.user_id").
+		Where("cp.conversation_id IN ? AND cp.user_id <> ?", direct, userID).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := hiddenProfiles(m.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		context := result[row.ConversationID]
+		context.Participants = append(context.Participants, redactUser(row.UserInfo, hidden))
+		result[row.ConversationID] = context
+	}
+	return result, nil
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/inodinwetrust10/mumbleBackend/utils"
+)
+
+const (
+	EventMessageCreated = "message_created"
+	EventMessageUpdated = "message_updated"
+	EventMessageDeleted = "message_deleted"
+
+	defaultSyncLimit = 200
+	maxSyncLimit     = 1000
+)
+
+type SyncRequest struct {
+	// last seq the client has seen per conversation, missing ones start at 0
+	Checkpoints map[string]int64 `json:"checkpoints"`
+	Limit       int              `json:"limit"`
+}
+
+type SyncEvent struct {
+	Seq       int64        `json:"seq"`
+	Kind      string       `json:"kind"`
+	MessageID string       `json:"messageId"`
+	Message   *MessageType `json:"message,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+type ConversationSync struct {
+	ConversationID string      `json:"conversationId"`
+	Events         []SyncEvent `json:"events"`
+	Checkpoint     int64       `json:"checkpoint"`
+	HasMore        bool        `json:"hasMore"`
+}
+
+// nextSeq hands out the next sequence number of a conversation. The row lock
+// taken by the update serializes writers and a rollback returns the number,
+// so the sequence has no gaps.
+func nextSeq(tx *gorm.DB, conversationID string) (int64, error) {
+	var seq int64
+	err := tx.Raw(
+		"UPDATE conversations SET last_seq = last_seq + 1 WHERE id = ? RETURNING last_seq",
+		conversationID,
+	).Scan(&seq).Error
+	return seq, err
+}
+
+func appendEvent(tx *gorm.DB, conversationID string, kind string, messageID string) (int64, error) {
+	seq, err := nextSeq(tx, conversationID)
+	if err != nil {
+		return 0, err
+	}
+	event := ConversationEvent{ConversationID: conversationID, Seq: seq, Kind: kind, MessageID: messageID}
+	return seq, tx.Create(&event).Error
+}
+
+// insertMessage stores message with the next sequence number of its
+// conversation and records the matching message_created event
+func insertMessage(tx *gorm.DB, message *Message) error {
+	seq, err := nextSeq(tx, message.ConversationID)
+	if err != nil {
+		return err
+	}
+	message.Seq = seq
+
+	create := tx
+	if message.ClientMessageID != nil {
+		create = tx.Clauses(clause.OnConflict{DoNothing: true})
+	}
+	result := create.Create(message)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errDuplicateClientID
+	}
+
+	event := ConversationEvent{
+		ConversationID: message.ConversationID,
+		Seq:            seq,
+		Kind:           EventMessageCreated,
+		MessageID:      message.ID,
+	}
+	return tx.Create(&event).Error
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (m *PostgresMessage) Sync(req *SyncRequest, userID string, w http.ResponseWriter) error {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultSyncLimit
+	}
+	limit = min(limit, maxSyncLimit)
+	checkpoints, err := json.Marshal(req.Checkpoints)
+	if err != nil {
+		return err
+	}
+	if req.Checkpoints == nil {
+		checkpoints = []byte("{}")
+	}
+
+	// one extra row per conversation tells whether more pages follow
+	var events []struct {
+		ConversationEvent
+		Rank int
+	}
+	err = m.db.Raw(`
+		SELECT * FROM (
+			SELECT e.*, ROW_NUMBER() OVER (PARTITION BY e.conversation_id ORDER BY e.seq) AS rank
+			FROM conversation_events e
+			JOIN conversation_participants cp ON cp.conversation_id = e.conversation_id
+			WHERE cp.user_id = ?
+				AND e.seq > COALESCE((?::jsonb ->> e.conversation_id::text)::bigint, 0)
+		) ranked
+		WHERE rank <= ?
+		ORDER BY conversation_id, seq`,
+		userID, string(checkpoints), limit+1,
+	).Scan(&events).Error
+	if err != nil {
+		return utils.WriteJson(
+			w,
+			http.StatusInternalServerError,
+			utils.ApiError{ErrorMessage: "Failed to sync conversations"},
+		)
+	}
+
+	var messageIDs []string
+	for _, e := range events {
+		if e.Kind != EventMessageDeleted && e.Rank <= limit {
+			messageIDs = append(messageIDs, e.MessageID)
+		}
+	}
+	messages := map[string]MessageType{}
+	if len(messageIDs) > 0 {
+		var found []Message
+		err := m.db.Scopes(notExpired, preloadMessageDetails("")).
+			Where("id IN ?", uniqueStrings(messageIDs)).
+			Find(&found).Error
+		if err != nil {
+			return err
+		}
+		for _, message := range found {
+			messages[message.ID] = messageType(message)
+		}
+	}
+
+	result := []ConversationSync{}
+	for _, e := range events {
+		if len(result) == 0 || result[len(result)-1].ConversationID != e.ConversationID {
+			result = append(result, ConversationSync{ConversationID: e.ConversationID, Events: []SyncEvent{}})
+		}
+		current := &result[len(result)-1]
+		if e.Rank > limit {
+			current.HasMore = true
+			continue
+		}
+		event := SyncEvent{Seq: e.Seq, Kind: e.Kind, MessageID: e.MessageID, CreatedAt: e.CreatedAt}
+		if message, ok := messages[e.MessageID]; ok {
+			event.Message = &message
+		}
+		current.Events = append(current.Events, event)
+		current.Checkpoint = e.Seq
+	}
+	return utils.WriteJson(w, http.StatusOK, result)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodeSyncRequest(r *http.Request) (*SyncRequest, error) {
+	req := new(SyncRequest)
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// backfillSequences numbers the messages of conversations created before
+// sequence numbers existed, in created_at order
+func backfillSequences(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(`
+			UPDATE messages SET seq = numbered.rn
+			FROM (
+				SELECT m.id, ROW_NUMBER() OVER (PARTITION BY m.conversation_id ORDER BY m.created_at, m.id) AS rn
+				FROM messages m JOIN conversations c ON c.id = m.conversation_id
+				WHERE c.last_seq = 0
+			) numbered
+			WHERE messages.id = numbered.id`).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec(`
+			INSERT INTO conversation_events (conversation_id, seq, kind, message_id, created_at)
+			SELECT m.conversation_id, m.seq, ?, m.id, m.created_at
+			FROM messages m JOIN conversations c ON c.id = m.conversation_id
+			WHERE c.last_seq = 0`, EventMessageCreated).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`
+			UPDATE conversations SET last_seq = (
+				SELECT COALESCE(MAX(seq), 0) FROM messages WHERE messages.conversation_id = conversations.id
+			)
+			WHERE last_seq = 0`).Error
+	})
+}
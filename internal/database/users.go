@@ -18,6 +18,13 @@ type UserOperations interface {
 	Login(*UserPlain, http.ResponseWriter) error
 	Logout(http.ResponseWriter) error
 	GetMe(string, http.ResponseWriter) error
+	SetPrivacy(string, *PrivacySettings, http.ResponseWriter) error
+	SearchUsers(string, string, int, int, http.ResponseWriter) error
+}
+
+type PrivacySettings struct {
+	MessagePrivacy *MessagePrivacy `json:"messagePrivacy"`
+	Searchable     *bool           `json:"searchable"`
 }
 
 func NewPostgresUser() (*PostgresUser, error) {
@@ -163,6 +170,9 @@ func (pu *PostgresUser) Login(u *UserPlain, w http.ResponseWriter) error {
 			Username:   existingUser.Username,
 			ProfilePic: existingUser.ProfilePic,
 			Gender:     string(existingUser.Gender),
+			// only the owner sees their privacy settings
+			MessagePrivacy: string(existingUser.MessagePrivacy),
+			Searchable:     &existingUser.Searchable,
 		},
 	)
 }
@@ -209,10 +219,39 @@ func (u *PostgresUser) GetMe(id string, w http.ResponseWriter) error {
 			Username:   existingUser.Username,
 			ProfilePic: existingUser.ProfilePic,
 			Gender:     string(existingUser.Gender),
+			// only the owner sees their privacy settings
+			MessagePrivacy: string(existingUser.MessagePrivacy),
+			Searchable:     &existingUser.Searchable,
 		},
 	)
 }
 
+// ////////////////////////////////////////////////////////////////////////////////////
+func (u *PostgresUser) SetPrivacy(userID string, settings *PrivacySettings, w http.ResponseWriter) error {
+	updates := map[string]interface{}{}
+	if settings.MessagePrivacy != nil {
+		switch *settings.MessagePrivacy {
+		case PrivacyEveryone, PrivacyContacts:
+			updates["message_privacy"] = *settings.MessagePrivacy
+		default:
+			return utils.WriteJson(
+				w,
+				http.StatusUnprocessableEntity,
+				utils.ApiError{ErrorMessage: `messagePrivacy must be "everyone" or "contacts"`},
+			)
+		}
+	}
+	if settings.Searchable != nil {
+		updates["searchable"] = *settings.Searchable
+	}
+	if len(updates) > 0 {
+		if err := u.db.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return u.GetMe(userID, w)
+}
+
 // ////////////////////////////////////////////////////////////////////////////////////
 func DecodeUser(r *http.Request) (*UserPlain, error) {
 	user := new(UserPlain)
@@ -222,3 +261,13 @@ func DecodeUser(r *http.Request) (*UserPlain, error) {
 	}
 	return user, nil
 }
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func DecodePrivacySettings(r *http.Request) (*PrivacySettings, error) {
+	settings := new(PrivacySettings)
+	err := json.NewDecoder(r.Body).Decode(settings)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
@@ -0,0 +1,377 @@
+// Package linkpreview fetches OpenGraph and oEmbed metadata for URLs found in
+// message bodies. Requests run with strict timeouts and size limits and refuse
+// to connect to private, loopback or link-local addresses unless the host or
+// network has been allowlisted.
+package linkpreview
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBlockedAddress = errors.New("address is not allowed")
+	ErrNoMetadata     = errors.New("no preview metadata found")
+)
+
+type Preview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+	ImageURL    string `json:"image,omitempty"`
+	Type        string `json:"type,omitempty"`
+}
+
+type Config struct {
+	// Timeout bounds the whole fetch including redirects and oEmbed
+	Timeout      time.Duration
+	MaxBodySize  int64
+	MaxRedirects int
+	UserAgent    string
+	// AllowedHosts and AllowedNets bypass the private address check, e.g. to
+	// point the fetcher at a local test server
+	AllowedHosts []string
+	AllowedNets  []*net.IPNet
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:      5 * time.Second,
+		MaxBodySize:  512 << 10,
+		MaxRedirects: 3,
+		UserAgent:    "MumbleLinkPreview/1.0",
+	}
+}
+
+// ConfigFromEnv reads LINK_PREVIEW_ALLOWLIST, a comma separated list of
+// host names and CIDR ranges that may resolve to private addresses.
+func ConfigFromEnv() Config {
+	cfg := DefaultConfig()
+	for _, entry := range strings.Split(os.Getenv("LINK_PREVIEW_ALLOWLIST"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			cfg.AllowedNets = append(cfg.AllowedNets, network)
+		} else {
+			cfg.AllowedHosts = append(cfg.AllowedHosts, strings.ToLower(entry))
+		}
+	}
+	return cfg
+}
+
+type Fetcher struct {
+	cfg    Config
+	client *http.Client
+}
+
+func NewFetcher(cfg Config) *Fetcher {
+	f := &Fetcher{cfg: cfg}
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	transport := &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return f.dial(ctx, dialer, network, addr)
+		},
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > cfg.MaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return checkScheme(req.URL)
+		},
+	}
+	return f
+}
+
+// dial resolves the host itself and connects to a vetted IP so a second DNS
+// lookup cannot swap in a private address
+func (f *Fetcher) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	hostAllowed := f.hostAllowed(host)
+	var lastErr error = ErrBlockedAddress
+	for _, ip := range ips {
+		if !hostAllowed && !f.ipAllowed(ip.IP) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (f *Fetcher) hostAllowed(host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range f.cfg.AllowedHosts {
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fetcher) ipAllowed(ip net.IP) bool {
+	for _, network := range f.cfg.AllowedNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return isPublicIP(ip)
+}
+
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil && (cgnat.Contains(ip4) || ip4[0] == 0 || ip4.Equal(net.IPv4bcast)) {
+		return false
+	}
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.User != nil {
+		return errors.New("credentials in URL are not allowed")
+	}
+	return nil
+}
+
+// Fetch downloads rawURL and extracts its preview metadata. Pages without
+// OpenGraph tags fall back to their oEmbed endpoint and then to <title>.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Preview, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	defer cancel()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+
+	body, contentType, finalURL, err := f.get(ctx, u.String(), "text/html,application/xhtml+xml")
+	if err != nil {
+		return nil, err
+	}
+	preview := &Preview{URL: rawURL}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "image/") {
+		preview.ImageURL = finalURL.String()
+		preview.Type = "image"
+		return preview, nil
+	}
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNoMetadata
+	}
+
+	page := parseHTML(string(body))
+	preview.Title = firstNonEmpty(page.meta["og:title"], page.meta["twitter:title"])
+	preview.Description = firstNonEmpty(
+		page.meta["og:description"],
+		page.meta["twitter:description"],
+		page.meta["description"],
+	)
+	preview.SiteName = page.meta["og:site_name"]
+	preview.ImageURL = resolve(finalURL, firstNonEmpty(page.meta["og:image"], page.meta["twitter:image"]))
+	preview.Type = page.meta["og:type"]
+
+	if preview.Title == "" && page.oembed != "" {
+		if oembedURL, err := finalURL.Parse(page.oembed); err == nil {
+			f.fillOEmbed(ctx, oembedURL, preview)
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = page.title
+	}
+	if preview.Title == "" && preview.Description == "" && preview.ImageURL == "" {
+		return nil, ErrNoMetadata
+	}
+	return preview, nil
+}
+
+func (f *Fetcher) get(ctx context.Context, rawURL, accept string) ([]byte, string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req.Header.Set("User-Agent", f.cfg.UserAgent)
+	req.Header.Set("Accept", accept)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	// a truncated page still has its metadata in <head>
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.cfg.MaxBodySize))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return body, resp.Header.Get("Content-Type"), resp.Request.URL, nil
+}
+
+func (f *Fetcher) fillOEmbed(ctx context.Context, oembedURL *url.URL, preview *Preview) {
+	if checkScheme(oembedURL) != nil {
+		return
+	}
+	body, _, _, err := f.get(ctx, oembedURL.String(), "application/json")
+	if err != nil {
+		return
+	}
+	var data struct {
+		Type         string `json:"type"`
+		Title        string `json:"title"`
+		AuthorName   string `json:"author_name"`
+		ProviderName string `json:"provider_name"`
+		ThumbnailURL string `json:"thumbnail_url"`
+	}
+	if json.Unmarshal(body, &data) != nil {
+		return
+	}
+	preview.Title = data.Title
+	preview.Description = firstNonEmpty(preview.Description, data.AuthorName)
+	preview.SiteName = firstNonEmpty(preview.SiteName, data.ProviderName)
+	preview.ImageURL = firstNonEmpty(preview.ImageURL, resolve(oembedURL, data.ThumbnailURL))
+	preview.Type = firstNonEmpty(preview.Type, data.Type)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'()\[\]]+`)
+
+// ExtractURLs returns up to limit distinct http(s) URLs in text, in order of
+// appearance, with trailing punctuation trimmed.
+func ExtractURLs(text string, limit int) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		match = strings.TrimRight(match, ".,;:!?")
+		if seen[match] {
+			continue
+		}
+		if u, err := url.Parse(match); err != nil || u.Host == "" {
+			continue
+		}
+		seen[match] = true
+		urls = append(urls, match)
+		if len(urls) == limit {
+			break
+		}
+	}
+	return urls
+}
+
+var (
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	linkTagPattern  = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	titlePattern    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	attrPattern     = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	whitespaceRegex = regexp.MustCompile(`\s+`)
+)
+
+type page struct {
+	meta   map[string]string
+	title  string
+	oembed string
+}
+
+func parseHTML(body string) page {
+	p := page{meta: map[string]string{}}
+	for _, tag := range metaTagPattern.FindAllString(body, -1) {
+		attrs := parseAttrs(tag)
+		key := strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"]))
+		if key != "" && p.meta[key] == "" {
+			p.meta[key] = clean(attrs["content"])
+		}
+	}
+	for _, tag := range linkTagPattern.FindAllString(body, -1) {
+		attrs := parseAttrs(tag)
+		if strings.EqualFold(attrs["rel"], "alternate") &&
+			strings.EqualFold(attrs["type"], "application/json+oembed") {
+			p.oembed = attrs["href"]
+			break
+		}
+	}
+	if match := titlePattern.FindStringSubmatch(body); match != nil {
+		p.title = clean(match[1])
+	}
+	return p
+}
+
+func parseAttrs(tag string) map[string]string {
+	attrs := map[string]string{}
+	for _, match := range attrPattern.FindAllStringSubmatch(tag, -1) {
+		attrs[strings.ToLower(match[1])] = html.UnescapeString(match[2] + match[3] + match[4])
+	}
+	return attrs
+}
+
+func clean(s string) string {
+	s = whitespaceRegex.ReplaceAllString(html.UnescapeString(s), " ")
+	s = strings.TrimSpace(s)
+	if len([]rune(s)) > 300 {
+		s = string([]rune(s)[:300])
+	}
+	return s
+}
+
+func resolve(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,218 @@
+// Package media inspects and transforms uploaded images: format sniffing,
+// metadata stripping, thumbnails and blurhash placeholders.
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+// MaxPixels guards the decoder against decompression bombs.
+const MaxPixels = 50_000_000
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrImageTooLarge     = errors.New("image dimensions are too large")
+)
+
+// Sniff returns the image format of data based on its magic bytes, or an
+// empty string when data is not a supported image.
+func Sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(data, pngSignature):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return FormatGIF
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	}
+	return ""
+}
+
+// ContentType maps a format returned by Sniff to its MIME type.
+func ContentType(format string) string {
+	if format == "" {
+		return "application/octet-stream"
+	}
+	return "image/" + format
+}
+
+// Dimensions reports the pixel size of an encoded image without decoding it.
+func Dimensions(format string, data []byte) (int, int, error) {
+	if format == FormatWebP {
+		return webpDimensions(data)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// CanDecode reports whether the decoders registered in this package
+// understand format.
+func CanDecode(format string) bool {
+	return format == FormatJPEG || format == FormatPNG || format == FormatGIF || format == FormatWebP
+}
+
+// Decode decodes data after checking its dimensions against MaxPixels.
+// Animated GIFs decode to their first frame.
+func Decode(format string, data []byte) (image.Image, error) {
+	if !CanDecode(format) {
+		return nil, ErrUnsupportedFormat
+	}
+	width, height, err := Dimensions(format, data)
+	if err != nil {
+		return nil, err
+	}
+	if width*height > MaxPixels {
+		return nil, ErrImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// Fit scales img down so that neither side exceeds maxDim, averaging the
+// source pixels covered by each destination pixel. Images that already fit
+// are returned as is.
+func Fit(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	if srcW <= maxDim && srcH <= maxDim {
+		return img
+	}
+	dstW, dstH := maxDim, maxDim
+	if srcW > srcH {
+		dstH = max(1, srcH*maxDim/srcW)
+	} else {
+		dstW = max(1, srcW*maxDim/srcH)
+	}
+
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		src = image.NewNRGBA(image.Rect(0, 0, srcW, srcH))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for dy := 0; dy < dstH; dy++ {
+		y0, y1 := dy*srcH/dstH, max((dy+1)*srcH/dstH, dy*srcH/dstH+1)
+		for dx := 0; dx < dstW; dx++ {
+			x0, x1 := dx*srcW/dstW, max((dx+1)*srcW/dstW, dx*srcW/dstW+1)
+			var r, g, bl, a, n int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4 : x*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			o := dst.Pix[dy*dst.Stride+dx*4:]
+			o[0], o[1], o[2], o[3] = uint8(r/n), uint8(g/n), uint8(bl/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// Orient turns img upright according to an EXIF orientation returned by
+// Orientation. Orientations 5 to 8 swap the width and height.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			// the source pixel that lands on x, y
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			d, o := y*dst.Stride+x*4, sy*src.Stride+sx*4
+			copy(dst.Pix[d:d+4], src.Pix[o:o+4])
+		}
+	}
+	return dst
+}
+
+// EncodeJPEG writes img as a JPEG, flattening any transparency onto white.
+func EncodeJPEG(w io.Writer, img image.Image) error {
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return jpeg.Encode(w, flat, &jpeg.Options{Quality: 80})
+}
+
+func webpDimensions(data []byte) (int, int, error) {
+	if len(data) < 30 {
+		return 0, 0, ErrCorruptImage
+	}
+	chunk := data[12:]
+	payload := chunk[8:]
+	switch string(chunk[0:4]) {
+	case "VP8X":
+		w := int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16
+		h := int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16
+		return w + 1, h + 1, nil
+	case "VP8 ":
+		if payload[3] != 0x9D || payload[4] != 0x01 || payload[5] != 0x2A {
+			return 0, 0, ErrCorruptImage
+		}
+		w := int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3FFF)
+		h := int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3FFF)
+		return w, h, nil
+	case "VP8L":
+		if payload[0] != 0x2F {
+			return 0, 0, ErrCorruptImage
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		return int(bits&0x3FFF) + 1, int(bits>>14&0x3FFF) + 1, nil
+	}
+	return 0, 0, ErrCorruptImage
+}
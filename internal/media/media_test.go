@@ -0,0 +1,129 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encoded(t *testing.T, encode func(*bytes.Buffer, image.Image) error, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func lossyWebP(w, h int) []byte {
+	payload := make([]byte, 10)
+	payload[3], payload[4], payload[5] = 0x9D, 0x01, 0x2A
+	binary.LittleEndian.PutUint16(payload[6:8], uint16(w))
+	binary.LittleEndian.PutUint16(payload[8:10], uint16(h))
+	return riff(webpChunk("VP8 ", payload))
+}
+
+func losslessWebP(w, h int) []byte {
+	payload := make([]byte, 10)
+	payload[0] = 0x2F
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(w-1)|uint32(h-1)<<14)
+	return riff(webpChunk("VP8L", payload))
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestDimensions(t *testing.T) {
+	tests := []struct {
+		name          string
+		format        string
+		data          []byte
+		width, height int
+		err           bool
+	}{
+		{"jpeg", FormatJPEG, encoded(t, func(b *bytes.Buffer, i image.Image) error { return jpeg.Encode(b, i, nil) }, 7, 3), 7, 3, false},
+		{"png", FormatPNG, encoded(t, func(b *bytes.Buffer, i image.Image) error { return png.Encode(b, i) }, 3, 9), 3, 9, false},
+		{"gif", FormatGIF, encoded(t, func(b *bytes.Buffer, i image.Image) error { return gif.Encode(b, i, nil) }, 5, 5), 5, 5, false},
+		{"webp extended", FormatWebP, testWebP(nil, 4000, 3000), 4000, 3000, false},
+		{"webp lossy", FormatWebP, lossyWebP(640, 480), 640, 480, false},
+		{"webp lossless", FormatWebP, losslessWebP(16383, 1), 16383, 1, false},
+		{"webp too short", FormatWebP, []byte("RIFF\x00\x00\x00\x00WEBP"), 0, 0, true},
+		{"webp bad lossy tag", FormatWebP, riff(webpChunk("VP8 ", make([]byte, 10))), 0, 0, true},
+		{"webp unknown chunk", FormatWebP, riff(webpChunk("ALPH", make([]byte, 10))), 0, 0, true},
+		{"png garbage", FormatPNG, []byte("not an image at all"), 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, err := Dimensions(tt.format, tt.data)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error, got %dx%d", w, h)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w != tt.width || h != tt.height {
+				t.Errorf("got %dx%d, want %dx%d", w, h, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestOrient(t *testing.T) {
+	const w, h = 3, 2
+	src := testImage(w, h)
+	corner := func(x, y int) [4]uint8 {
+		o := src.PixOffset(x, y)
+		return [4]uint8(src.Pix[o : o+4])
+	}
+	// where the top corners of the oriented image come from in the source
+	tests := []struct {
+		orientation       int
+		topLeft, topRight [2]int
+	}{
+		{1, [2]int{0, 0}, [2]int{w - 1, 0}},
+		{2, [2]int{w - 1, 0}, [2]int{0, 0}},
+		{3, [2]int{w - 1, h - 1}, [2]int{0, h - 1}},
+		{4, [2]int{0, h - 1}, [2]int{w - 1, h - 1}},
+		{5, [2]int{0, 0}, [2]int{0, h - 1}},
+		{6, [2]int{0, h - 1}, [2]int{0, 0}},
+		{7, [2]int{w - 1, h - 1}, [2]int{w - 1, 0}},
+		{8, [2]int{w - 1, 0}, [2]int{w - 1, h - 1}},
+	}
+	for _, tt := range tests {
+		out := Orient(src, tt.orientation)
+		b := out.Bounds()
+		wantW, wantH := w, h
+		if tt.orientation >= 5 {
+			wantW, wantH = h, w
+		}
+		if b.Dx() != wantW || b.Dy() != wantH {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), wantW, wantH)
+			continue
+		}
+		dst := out.(*image.NRGBA)
+		pixel := func(x, y int) [4]uint8 {
+			o := dst.PixOffset(x, y)
+			return [4]uint8(dst.Pix[o : o+4])
+		}
+		if pixel(0, 0) != corner(tt.topLeft[0], tt.topLeft[1]) {
+			t.Errorf("orientation %d: wrong top left pixel", tt.orientation)
+		}
+		if pixel(wantW-1, 0) != corner(tt.topRight[0], tt.topRight[1]) {
+			t.Errorf("orientation %d: wrong top right pixel", tt.orientation)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var ErrCorruptImage = errors.New("corrupt image data")
+
+// StripMetadata removes EXIF, XMP and text metadata (GPS position, camera
+// serials, comments) from an encoded image without re-encoding the pixels.
+// The EXIF Orientation tag survives in a minimal EXIF block, phones record
+// rotation only there. GIF carries no EXIF block and is returned unchanged.
+func StripMetadata(format string, data []byte) ([]byte, error) {
+	out, _, err := strip(format, data)
+	return out, err
+}
+
+// Orientation returns the EXIF orientation of an encoded image, from 1
+// (upright) to 8, and 1 when it has none.
+func Orientation(format string, data []byte) int {
+	_, orientation, err := strip(format, data)
+	if err != nil {
+		return 1
+	}
+	return orientation
+}
+
+func strip(format string, data []byte) ([]byte, int, error) {
+	switch format {
+	case FormatJPEG:
+		return stripJPEG(data)
+	case FormatPNG:
+		return stripPNG(data)
+	case FormatWebP:
+		return stripWebP(data)
+	default:
+		return data, 1, nil
+	}
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+func stripJPEG(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, ErrCorruptImage
+	}
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, 0, ErrCorruptImage
+		}
+		// skip fill bytes
+		for pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+1 >= len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		marker := data[pos+1]
+		// standalone markers without a length field
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+		if marker == 0xD9 {
+			out.Write(data[pos : pos+2])
+			return out.Bytes(), orientation, nil
+		}
+		if pos+4 > len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		// start of scan, the rest is entropy coded image data
+		if marker == 0xDA {
+			out.Write(data[pos:])
+			return out.Bytes(), orientation, nil
+		}
+		segment := data[pos+4 : end]
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) && orientation == 1:
+			// the EXIF block is rewritten in place with only its orientation
+			orientation = exifOrientation(segment[len(exifHeader):])
+			if orientation != 1 {
+				payload := append(append([]byte(nil), exifHeader...), orientationEXIF(orientation)...)
+				out.Write([]byte{0xFF, 0xE1})
+				binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+				out.Write(payload)
+			}
+		// APP1 holds EXIF and XMP, APP13 holds IPTC, 0xFE is a comment
+		case marker == 0xE1, marker == 0xED, marker == 0xFE:
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), orientation, nil
+}
+
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1A, '\n'}
+
+func stripPNG(data []byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, 0, ErrCorruptImage
+	}
+	orientation := 1
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf":
+			if orientation != 1 {
+				break
+			}
+			orientation = exifOrientation(data[pos+8 : end-4])
+			if orientation != 1 {
+				writePNGChunk(out, "eXIf", orientationEXIF(orientation))
+			}
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	return out.Bytes(), orientation, nil
+}
+
+func writePNGChunk(out *bytes.Buffer, chunkType string, payload []byte) {
+	binary.Write(out, binary.BigEndian, uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(payload)
+	out.WriteString(chunkType)
+	out.Write(payload)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+func stripWebP(data []byte) ([]byte, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, 0, ErrCorruptImage
+	}
+	orientation := 1
+	body := bytes.NewBuffer(make([]byte, 0, len(data)))
+	body.WriteString("WEBP")
+	flags := -1
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + size + size%2
+		if size < 0 || end > len(data) {
+			return nil, 0, ErrCorruptImage
+		}
+		switch fourCC {
+		case "EXIF":
+			if orientation != 1 {
+				break
+			}
+			// some encoders keep the JPEG style header in front of the TIFF data
+			orientation = exifOrientation(bytes.TrimPrefix(data[pos+8:pos+8+size], exifHeader))
+			if orientation != 1 {
+				payload := orientationEXIF(orientation)
+				body.WriteString("EXIF")
+				binary.Write(body, binary.LittleEndian, uint32(len(payload)))
+				body.Write(payload)
+			}
+		case "XMP ":
+		case "VP8X":
+			if size > 0 {
+				flags = body.Len() + 8
+			}
+			body.Write(data[pos:end])
+		default:
+			body.Write(data[pos:end])
+		}
+		pos = end
+	}
+	if flags >= 0 {
+		// the EXIF flag stays only for the rewritten orientation block
+		chunk := body.Bytes()
+		chunk[flags] &^= 0x04
+		if orientation == 1 {
+			chunk[flags] &^= 0x08
+		}
+	}
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:8], uint32(body.Len()))
+	return append(out, body.Bytes()...), orientation, nil
+}
+
+const orientationTag = 0x0112
+
+// exifOrientation reads the Orientation tag from the first IFD of TIFF
+// formatted EXIF data, anything unreadable counts as upright
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// a single SHORT sits in the first bytes of the value field
+		if order.Uint16(tiff[entry:entry+2]) != orientationTag || order.Uint16(tiff[entry+2:entry+4]) != 3 {
+			continue
+		}
+		if value := int(order.Uint16(tiff[entry+8 : entry+10])); value >= 1 && value <= 8 {
+			return value
+		}
+		return 1
+	}
+	return 1
+}
+
+// orientationEXIF builds TIFF formatted EXIF data holding nothing but the
+// Orientation tag
+func orientationEXIF(orientation int) []byte {
+	tiff := make([]byte, 26)
+	copy(tiff, "MM\x00*")
+	binary.BigEndian.PutUint32(tiff[4:8], 8)
+	binary.BigEndian.PutUint16(tiff[8:10], 1)
+	binary.BigEndian.PutUint16(tiff[10:12], orientationTag)
+	binary.BigEndian.PutUint16(tiff[12:14], 3)
+	binary.BigEndian.PutUint32(tiff[14:18], 1)
+	binary.BigEndian.PutUint16(tiff[18:20], uint16(orientation))
+	// the next IFD offset, tiff[22:26], stays zero
+	return tiff
+}
@@ -0,0 +1,222 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+const secret = "SECRET"
+
+// testEXIF builds TIFF formatted EXIF data with a camera make, an
+// orientation and a GPS pointer to data holding the secret marker
+func testEXIF(order binary.ByteOrder, orientation int) []byte {
+	var buf bytes.Buffer
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, order, uint32(8))
+	binary.Write(&buf, order, uint16(3))
+	entry := func(tag, kind uint16, count uint32, value []byte) {
+		binary.Write(&buf, order, tag)
+		binary.Write(&buf, order, kind)
+		binary.Write(&buf, order, count)
+		buf.Write(value)
+	}
+	short := make([]byte, 4)
+	order.PutUint16(short, uint16(orientation))
+	gps := make([]byte, 4)
+	order.PutUint32(gps, 8+2+3*12+4)
+	entry(0x010F, 2, 4, []byte("Cam\x00"))
+	entry(orientationTag, 3, 1, short)
+	entry(0x8825, 4, 1, gps)
+	binary.Write(&buf, order, uint32(0))
+	buf.WriteString(secret + "-GPS")
+	return buf.Bytes()
+}
+
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 40), G: uint8(y * 40), B: 100, A: 255})
+		}
+	}
+	return img
+}
+
+func testJPEG(t *testing.T, exif []byte) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(4, 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(marker byte, payload []byte) []byte {
+		out := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(out[2:], uint16(len(payload)+2))
+		return append(out, payload...)
+	}
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:2])
+	if exif != nil {
+		out.Write(segment(0xE1, append([]byte("Exif\x00\x00"), exif...)))
+	}
+	out.Write(segment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>"+secret+"-XMP")))
+	out.Write(segment(0xFE, []byte(secret+"-COMMENT")))
+	out.Write(encoded.Bytes()[2:])
+	return out.Bytes()
+}
+
+func testPNG(t *testing.T, exif []byte) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage(3, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// the signature and IHDR come first
+	head := len(pngSignature) + 25
+	var out bytes.Buffer
+	out.Write(encoded.Bytes()[:head])
+	if exif != nil {
+		writePNGChunk(&out, "eXIf", exif)
+	}
+	writePNGChunk(&out, "tEXt", []byte("Comment\x00"+secret+"-TEXT"))
+	out.Write(encoded.Bytes()[head:])
+	return out.Bytes()
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	out := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(payload)))
+	out = append(out, payload...)
+	if len(payload)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func testWebP(exif []byte, width, height int) []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x08 | 0x04
+	vp8x[4], vp8x[5], vp8x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	vp8x[7], vp8x[8], vp8x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2F, 1, 2, 3, 4})...)
+	if exif != nil {
+		body = append(body, webpChunk("EXIF", exif)...)
+	}
+	body = append(body, webpChunk("XMP ", []byte("<x:xmpmeta>"+secret+"-XMP"))...)
+	out := append([]byte("RIFF"), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		data        []byte
+		orientation int
+	}{
+		{"jpeg without exif", FormatJPEG, testJPEG(t, nil), 1},
+		{"jpeg upright", FormatJPEG, testJPEG(t, testEXIF(binary.BigEndian, 1)), 1},
+		{"jpeg rotated", FormatJPEG, testJPEG(t, testEXIF(binary.LittleEndian, 6)), 6},
+		{"jpeg mirrored", FormatJPEG, testJPEG(t, testEXIF(binary.BigEndian, 2)), 2},
+		{"png without exif", FormatPNG, testPNG(t, nil), 1},
+		{"png upright", FormatPNG, testPNG(t, testEXIF(binary.LittleEndian, 1)), 1},
+		{"png rotated", FormatPNG, testPNG(t, testEXIF(binary.BigEndian, 8)), 8},
+		{"webp without exif", FormatWebP, testWebP(nil, 300, 200), 1},
+		{"webp upright", FormatWebP, testWebP(testEXIF(binary.LittleEndian, 1), 300, 200), 1},
+		{"webp rotated", FormatWebP, testWebP(testEXIF(binary.LittleEndian, 3), 300, 200), 3},
+		{"webp exif header", FormatWebP, testWebP(append([]byte("Exif\x00\x00"), testEXIF(binary.BigEndian, 5)...), 300, 200), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Orientation(tt.format, tt.data); got != tt.orientation {
+				t.Errorf("Orientation before stripping = %d, want %d", got, tt.orientation)
+			}
+			out, err := StripMetadata(tt.format, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(out, []byte(secret)) || bytes.Contains(out, []byte("Cam\x00")) {
+				t.Errorf("metadata survived stripping")
+			}
+			if got := Orientation(tt.format, out); got != tt.orientation {
+				t.Errorf("Orientation after stripping = %d, want %d", got, tt.orientation)
+			}
+			if tt.orientation == 1 && (bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("eXIf")) ||
+				bytes.Contains(out, []byte("EXIF"))) {
+				t.Errorf("upright image kept an EXIF block")
+			}
+
+			before, after := dimensions(t, tt.format, tt.data), dimensions(t, tt.format, out)
+			if before != after {
+				t.Errorf("dimensions changed from %v to %v", before, after)
+			}
+			switch tt.format {
+			case FormatJPEG, FormatPNG:
+				if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+					t.Errorf("stripped image does not decode: %v", err)
+				}
+			case FormatWebP:
+				if size := int(binary.LittleEndian.Uint32(out[4:8])); size != len(out)-8 {
+					t.Errorf("RIFF size %d, want %d", size, len(out)-8)
+				}
+				flags := out[20]
+				if flags&0x04 != 0 {
+					t.Errorf("XMP flag still set")
+				}
+				if hasEXIF := flags&0x08 != 0; hasEXIF != (tt.orientation != 1) {
+					t.Errorf("EXIF flag set = %v with orientation %d", hasEXIF, tt.orientation)
+				}
+			}
+		})
+	}
+}
+
+func TestStripMetadataCorrupt(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+	}{
+		{"jpeg without soi", FormatJPEG, []byte("not a jpeg")},
+		{"jpeg truncated segment", FormatJPEG, []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x40, 'E'}},
+		{"png without signature", FormatPNG, []byte("not a png")},
+		{"png truncated chunk", FormatPNG, append(append([]byte(nil), pngSignature...), 0, 0, 1, 0, 'I', 'H', 'D', 'R')},
+		{"webp without header", FormatWebP, []byte("RIFF\x00\x00\x00\x00WAVE")},
+		{"webp truncated chunk", FormatWebP, []byte("RIFF\x10\x00\x00\x00WEBPVP8L\xff\x00\x00\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := StripMetadata(tt.format, tt.data); err != ErrCorruptImage {
+				t.Errorf("got %v, want %v", err, ErrCorruptImage)
+			}
+			if got := Orientation(tt.format, tt.data); got != 1 {
+				t.Errorf("Orientation = %d, want 1", got)
+			}
+		})
+	}
+
+	gif := []byte("GIF89a anything")
+	if out, err := StripMetadata(FormatGIF, gif); err != nil || !bytes.Equal(out, gif) {
+		t.Errorf("gif should pass through unchanged, got %q, %v", out, err)
+	}
+}
+
+func dimensions(t *testing.T, format string, data []byte) [2]int {
+	t.Helper()
+	w, h, err := Dimensions(format, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [2]int{w, h}
+}
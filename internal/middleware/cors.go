@@ -7,8 +7,8 @@ func CORSMiddleware(next http.Handler) http.Handler {
 		w.Header().
 			Set("Access-Control-Allow-Origin", "https://mumble-frontend.vercel.app")
 			// Adjust as necessary
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Socket-Id, Idempotency-Key")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,109 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Classification is a verdict of an external model, Score is the confidence
+// in [0, 1] that the text is abusive
+type Classification struct {
+	Label string  `json:"label"`
+	Score float64 `json:"score"`
+}
+
+// Classifier is an external content classifier, e.g. a hosted toxicity model
+type Classifier interface {
+	Classify(ctx context.Context, text string) (Classification, error)
+}
+
+// ClassifierRule flags or rejects messages the classifier scores above the
+// thresholds, a threshold of 0 disables that action
+type ClassifierRule struct {
+	name        string
+	classifier  Classifier
+	flagAbove   float64
+	rejectAbove float64
+	timeout     time.Duration
+}
+
+func NewClassifierRule(
+	name string,
+	classifier Classifier,
+	flagAbove float64,
+	rejectAbove float64,
+	timeout time.Duration,
+) *ClassifierRule {
+	return &ClassifierRule{
+		name:        name,
+		classifier:  classifier,
+		flagAbove:   flagAbove,
+		rejectAbove: rejectAbove,
+		timeout:     timeout,
+	}
+}
+
+func (r *ClassifierRule) Name() string { return r.name }
+
+func (r *ClassifierRule) Check(ctx context.Context, in *Input) (Result, error) {
+	if in.Body == "" {
+		return Result{}, nil
+	}
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	c, err := r.classifier.Classify(ctx, in.Body)
+	if err != nil {
+		return Result{}, err
+	}
+	reason := fmt.Sprintf("classified as %s (%.2f)", c.Label, c.Score)
+	switch {
+	case r.rejectAbove > 0 && c.Score >= r.rejectAbove:
+		return Result{Action: Reject, Reason: reason}, nil
+	case r.flagAbove > 0 && c.Score >= r.flagAbove:
+		return Result{Action: Flag, Reason: reason}, nil
+	}
+	return Result{}, nil
+}
+
+// HTTPClassifier posts {"text": ...} to URL and expects a Classification
+// as JSON in return
+type HTTPClassifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c *HTTPClassifier) Classify(ctx context.Context, text string) (Classification, error) {
+	var result Classification
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return result, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("classifier returned %s", resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result)
+	return result, err
+}
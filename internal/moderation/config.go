@@ -0,0 +1,115 @@
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config is the JSON file named by MODERATION_CONFIG, for example
+//
+//	{"rules": [
+//	  {"type": "words", "action": "mask", "words": ["darn"], "patterns": ["(?i)fr[e3]{2} money"]},
+//	  {"type": "domains", "action": "reject", "domains": ["spam.example"]},
+//	  {"type": "repeat", "action": "flag", "window": "1m", "threshold": 3},
+//	  {"type": "classifier", "url": "http://classifier:8080/classify", "flagAbove": 0.7, "rejectAbove": 0.95}
+//	]}
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+type RuleConfig struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+
+	Words    []string `json:"words"`
+	Patterns []string `json:"patterns"`
+
+	Domains []string `json:"domains"`
+
+	Window    string `json:"window"`
+	Threshold int    `json:"threshold"`
+
+	URL         string  `json:"url"`
+	FlagAbove   float64 `json:"flagAbove"`
+	RejectAbove float64 `json:"rejectAbove"`
+	Timeout     string  `json:"timeout"`
+}
+
+// FromEnv builds the pipeline configured by MODERATION_CONFIG, without the
+// variable every message is allowed
+func FromEnv() (*Pipeline, error) {
+	path := os.Getenv("MODERATION_CONFIG")
+	if path == "" {
+		return NewPipeline(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("moderation config: %w", err)
+	}
+	return config.Pipeline()
+}
+
+func (c Config) Pipeline() (*Pipeline, error) {
+	var rules []Rule
+	for i, rc := range c.Rules {
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", rc.Type, i)
+		}
+		action := Flag
+		if rc.Action != "" {
+			var err error
+			if action, err = ParseAction(rc.Action); err != nil {
+				return nil, fmt.Errorf("rule %s: %w", name, err)
+			}
+		}
+
+		switch rc.Type {
+		case "words":
+			rule, err := NewPatternRule(name, action, rc.Words, rc.Patterns)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		case "domains":
+			rules = append(rules, NewDomainRule(name, action, rc.Domains))
+		case "repeat":
+			window, err := parseDuration(rc.Window, time.Minute)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", name, err)
+			}
+			threshold := rc.Threshold
+			if threshold <= 0 {
+				threshold = 3
+			}
+			rules = append(rules, NewRepeatRule(name, action, window, threshold))
+		case "classifier":
+			if rc.URL == "" {
+				return nil, fmt.Errorf("rule %s: classifier url is required", name)
+			}
+			timeout, err := parseDuration(rc.Timeout, 2*time.Second)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", name, err)
+			}
+			classifier := &HTTPClassifier{URL: rc.URL}
+			rules = append(rules, NewClassifierRule(name, classifier, rc.FlagAbove, rc.RejectAbove, timeout))
+		default:
+			return nil, fmt.Errorf("rule %s: unknown type %q", name, rc.Type)
+		}
+	}
+	return NewPipeline(rules...), nil
+}
+
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,197 @@
+// Package moderation checks outgoing messages against configurable rules
+// before they are stored. Every rule decides to allow, flag, mask or reject a
+// message; the pipeline combines the decisions, masking never changes the
+// UTF-16 length of the body so formatting entities stay valid.
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Action int
+
+// ordered by severity, the strongest action of all rules wins
+const (
+	Allow Action = iota
+	Flag
+	Mask
+	Reject
+)
+
+func (a Action) String() string {
+	switch a {
+	case Flag:
+		return "flag"
+	case Mask:
+		return "mask"
+	case Reject:
+		return "reject"
+	}
+	return "allow"
+}
+
+func ParseAction(s string) (Action, error) {
+	switch s {
+	case "allow":
+		return Allow, nil
+	case "flag":
+		return Flag, nil
+	case "mask":
+		return Mask, nil
+	case "reject":
+		return Reject, nil
+	}
+	return Allow, fmt.Errorf("unknown moderation action %q", s)
+}
+
+// History gives rules access to what a sender posted before
+type History interface {
+	RecentBodies(senderID string, since time.Time, limit int) ([]string, error)
+}
+
+type Input struct {
+	SenderID string
+	Body     string
+	// link targets that are not part of the body, e.g. of formatted links
+	URLs    []string
+	History History
+}
+
+// Span is a byte range of the body
+type Span struct {
+	Start, End int
+}
+
+type Result struct {
+	Action Action
+	Reason string
+	// parts of the body to hide when Action is Mask
+	Spans []Span
+	// indexes into Input.URLs of the links to drop when Action is Mask
+	URLs []int
+}
+
+type Rule interface {
+	Name() string
+	Check(ctx context.Context, in *Input) (Result, error)
+}
+
+// Finding is a rule that did not simply allow the message
+type Finding struct {
+	Rule   string
+	Action Action
+	Reason string
+}
+
+type Verdict struct {
+	Action Action
+	// the body to store, masked when a rule asked for it
+	Body string
+	// indexes into Input.URLs of the links to drop
+	MaskedURLs []int
+	Findings   []Finding
+}
+
+// Flagged reports whether the message needs a human review
+func (v Verdict) Flagged() bool {
+	for _, f := range v.Findings {
+		if f.Action == Flag {
+			return true
+		}
+	}
+	return false
+}
+
+// RejectedError is returned by Run for messages that must not be stored
+type RejectedError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "message rejected: " + e.Reason
+}
+
+type Pipeline struct {
+	rules []Rule
+}
+
+func NewPipeline(rules ...Rule) *Pipeline {
+	return &Pipeline{rules: rules}
+}
+
+// Run checks in against every rule. A rule that fails, e.g. an unreachable
+// classifier, is logged and skipped so moderation outages do not stop chat.
+func (p *Pipeline) Run(ctx context.Context, in *Input) (Verdict, error) {
+	verdict := Verdict{Action: Allow, Body: in.Body}
+	if p == nil {
+		return verdict, nil
+	}
+
+	var spans []Span
+	for _, rule := range p.rules {
+		result, err := rule.Check(ctx, in)
+		if err != nil {
+			log.Printf("Moderation rule %s failed: %v", rule.Name(), err)
+			continue
+		}
+		if result.Action == Allow {
+			continue
+		}
+		if result.Action == Reject {
+			return verdict, &RejectedError{Rule: rule.Name(), Reason: result.Reason}
+		}
+		verdict.Findings = append(verdict.Findings, Finding{
+			Rule:   rule.Name(),
+			Action: result.Action,
+			Reason: result.Reason,
+		})
+		verdict.Action = max(verdict.Action, result.Action)
+		if result.Action == Mask {
+			spans = append(spans, result.Spans...)
+			verdict.MaskedURLs = append(verdict.MaskedURLs, result.URLs...)
+		}
+	}
+	verdict.Body = MaskSpans(in.Body, spans)
+	return verdict, nil
+}
+
+// MaskSpans replaces every character inside spans with asterisks, one per
+// UTF-16 code unit so offsets computed on the original body still hold
+func MaskSpans(body string, spans []Span) string {
+	if len(spans) == 0 {
+		return body
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	var b strings.Builder
+	b.Grow(len(body))
+	pos := 0
+	for _, span := range spans {
+		start := max(span.Start, pos)
+		end := min(span.End, len(body))
+		if start >= end {
+			continue
+		}
+		b.WriteString(body[pos:start])
+		for _, r := range body[start:end] {
+			switch {
+			case r == '\n':
+				b.WriteRune(r)
+			case r > 0xFFFF:
+				// a surrogate pair in UTF-16
+				b.WriteString("**")
+			default:
+				b.WriteByte('*')
+			}
+		}
+		pos = end
+	}
+	b.WriteString(body[pos:])
+	return b.String()
+}
@@ -0,0 +1,189 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+func TestMaskSpans(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		spans []Span
+		want  string
+	}{
+		{"no spans", "hello", nil, "hello"},
+		{"ascii", "say darn it", []Span{{4, 8}}, "say **** it"},
+		{"surrogate pair", "a😀b", []Span{{0, 6}}, "****"},
+		{"astral word", "x 𝒳𝒴 y", []Span{{2, 10}}, "x **** y"},
+		{"bmp multibyte", "é ü", []Span{{0, 5}}, "***"},
+		{"newline kept", "ab\ncd", []Span{{0, 5}}, "**\n**"},
+		{"crlf", "a\r\nb", []Span{{0, 4}}, "**\n*"},
+		{"overlapping", "abcdefg", []Span{{1, 4}, {3, 6}}, "a*****g"},
+		{"nested", "abcdefg", []Span{{1, 6}, {2, 3}}, "a*****g"},
+		{"unsorted", "abcdefg", []Span{{5, 6}, {0, 1}}, "*bcde*g"},
+		{"adjacent", "abcd", []Span{{0, 2}, {2, 4}}, "****"},
+		{"past the end", "abc", []Span{{1, 10}}, "a**"},
+		{"empty span", "abc", []Span{{2, 2}}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MaskSpans(tt.body, tt.spans)
+			if got != tt.want {
+				t.Errorf("MaskSpans(%q, %v) = %q, want %q", tt.body, tt.spans, got, tt.want)
+			}
+			if utf16Len(got) != utf16Len(tt.body) {
+				t.Errorf("UTF-16 length changed from %d to %d", utf16Len(tt.body), utf16Len(got))
+			}
+		})
+	}
+}
+
+// stubRule answers with a fixed result and counts its calls
+type stubRule struct {
+	name   string
+	result Result
+	err    error
+	calls  int
+}
+
+func (r *stubRule) Name() string { return r.name }
+
+func (r *stubRule) Check(ctx context.Context, in *Input) (Result, error) {
+	r.calls++
+	return r.result, r.err
+}
+
+type stubClassifier struct {
+	result Classification
+	err    error
+}
+
+func (c stubClassifier) Classify(ctx context.Context, text string) (Classification, error) {
+	return c.result, c.err
+}
+
+func TestPipelineRun(t *testing.T) {
+	in := &Input{SenderID: "u1", Body: "buy 😀 now\nplease", URLs: []string{"https://a.example", "https://b.example"}}
+
+	t.Run("strongest action wins", func(t *testing.T) {
+		flag := &stubRule{name: "flag", result: Result{Action: Flag, Reason: "suspicious", URLs: []int{0}}}
+		mask := &stubRule{name: "mask", result: Result{Action: Mask, Reason: "word", Spans: []Span{{4, 8}}, URLs: []int{1}}}
+		allow := &stubRule{name: "allow"}
+		verdict, err := NewPipeline(flag, mask, allow).Run(context.Background(), in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verdict.Action != Mask {
+			t.Errorf("action = %v, want mask", verdict.Action)
+		}
+		if !verdict.Flagged() {
+			t.Error("the flag finding was lost")
+		}
+		if want := "buy ** now\nplease"; verdict.Body != want {
+			t.Errorf("body = %q, want %q", verdict.Body, want)
+		}
+		// only masking rules drop links
+		if !reflect.DeepEqual(verdict.MaskedURLs, []int{1}) {
+			t.Errorf("masked urls = %v, want [1]", verdict.MaskedURLs)
+		}
+		wantFindings := []Finding{{Rule: "flag", Action: Flag, Reason: "suspicious"}, {Rule: "mask", Action: Mask, Reason: "word"}}
+		if !reflect.DeepEqual(verdict.Findings, wantFindings) {
+			t.Errorf("findings = %+v, want %+v", verdict.Findings, wantFindings)
+		}
+	})
+
+	t.Run("reject short-circuits", func(t *testing.T) {
+		mask := &stubRule{name: "mask", result: Result{Action: Mask, Spans: []Span{{0, 3}}}}
+		reject := &stubRule{name: "spam", result: Result{Action: Reject, Reason: "spam link"}}
+		after := &stubRule{name: "after", result: Result{Action: Flag}}
+		_, err := NewPipeline(mask, reject, after).Run(context.Background(), in)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) {
+			t.Fatalf("err = %v, want a RejectedError", err)
+		}
+		if rejected.Rule != "spam" || rejected.Reason != "spam link" {
+			t.Errorf("rejected by %q for %q", rejected.Rule, rejected.Reason)
+		}
+		if after.calls != 0 {
+			t.Error("rules after a rejection still ran")
+		}
+	})
+
+	t.Run("failing rules are skipped", func(t *testing.T) {
+		broken := &stubRule{name: "broken", result: Result{Action: Reject}, err: errors.New("unreachable")}
+		classifier := NewClassifierRule("toxicity", stubClassifier{err: context.DeadlineExceeded}, 0.5, 0.9, 0)
+		flag := &stubRule{name: "flag", result: Result{Action: Flag, Reason: "suspicious"}}
+		verdict, err := NewPipeline(broken, classifier, flag).Run(context.Background(), in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verdict.Action != Flag || verdict.Body != in.Body {
+			t.Errorf("verdict = %+v", verdict)
+		}
+		if len(verdict.Findings) != 1 || verdict.Findings[0].Rule != "flag" {
+			t.Errorf("findings = %+v, want only the flag rule", verdict.Findings)
+		}
+		if flag.calls != 1 {
+			t.Error("the rule after a failing one did not run")
+		}
+	})
+
+	t.Run("nil pipeline allows", func(t *testing.T) {
+		var p *Pipeline
+		verdict, err := p.Run(context.Background(), in)
+		if err != nil || verdict.Action != Allow || verdict.Body != in.Body {
+			t.Errorf("verdict = %+v, %v", verdict, err)
+		}
+	})
+}
+
+func TestClassifierRule(t *testing.T) {
+	tests := []struct {
+		name  string
+		score float64
+		want  Action
+	}{
+		{"below", 0.2, Allow},
+		{"flag threshold", 0.7, Flag},
+		{"reject threshold", 0.95, Reject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := NewClassifierRule("toxicity", stubClassifier{result: Classification{Label: "toxic", Score: tt.score}}, 0.7, 0.95, 0)
+			result, err := rule.Check(context.Background(), &Input{Body: "text"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Action != tt.want {
+				t.Errorf("action = %v, want %v", result.Action, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatternRuleMasking(t *testing.T) {
+	rule, err := NewPatternRule("words", Mask, []string{"darn"}, []string{`fr[e3]{2} money`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := "😀 DARN it\nfr33 money, darned"
+	verdict, err := NewPipeline(rule).Run(context.Background(), &Input{Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// whole words only, so darned stays
+	if want := "😀 **** it\n**********, darned"; verdict.Body != want {
+		t.Errorf("body = %q, want %q", verdict.Body, want)
+	}
+	if utf16Len(verdict.Body) != utf16Len(body) {
+		t.Errorf("UTF-16 length changed from %d to %d", utf16Len(body), utf16Len(verdict.Body))
+	}
+}
@@ -0,0 +1,152 @@
+package moderation
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PatternRule matches blocklisted words (whole words, case insensitive) and
+// regular expressions
+type PatternRule struct {
+	name     string
+	action   Action
+	patterns []*regexp.Regexp
+}
+
+func NewPatternRule(name string, action Action, words []string, patterns []string) (*PatternRule, error) {
+	rule := &PatternRule{name: name, action: action}
+	if len(words) > 0 {
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = regexp.QuoteMeta(word)
+		}
+		rule.patterns = append(rule.patterns, regexp.MustCompile(`(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`))
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", name, err)
+		}
+		rule.patterns = append(rule.patterns, re)
+	}
+	return rule, nil
+}
+
+func (r *PatternRule) Name() string { return r.name }
+
+func (r *PatternRule) Check(ctx context.Context, in *Input) (Result, error) {
+	var spans []Span
+	var urls []int
+	for _, re := range r.patterns {
+		for _, match := range re.FindAllStringIndex(in.Body, -1) {
+			spans = append(spans, Span{Start: match[0], End: match[1]})
+		}
+	}
+	for i, target := range in.URLs {
+		for _, re := range r.patterns {
+			if re.MatchString(target) {
+				urls = append(urls, i)
+				break
+			}
+		}
+	}
+	if len(spans) == 0 && len(urls) == 0 {
+		return Result{}, nil
+	}
+	return Result{Action: r.action, Reason: "blocked word or pattern", Spans: spans, URLs: urls}, nil
+}
+
+// links with or without a scheme, the host is the first group
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})(?::\d+)?(?:[/?#][^\s]*)?`)
+
+// DomainRule matches links to blocklisted domains and their subdomains
+type DomainRule struct {
+	name    string
+	action  Action
+	domains []string
+}
+
+func NewDomainRule(name string, action Action, domains []string) *DomainRule {
+	rule := &DomainRule{name: name, action: action}
+	for _, domain := range domains {
+		rule.domains = append(rule.domains, strings.TrimPrefix(strings.ToLower(domain), "."))
+	}
+	return rule
+}
+
+func (r *DomainRule) Name() string { return r.name }
+
+func (r *DomainRule) Check(ctx context.Context, in *Input) (Result, error) {
+	var spans []Span
+	var urls []int
+	for _, match := range linkPattern.FindAllStringSubmatchIndex(in.Body, -1) {
+		if r.blocked(in.Body[match[2]:match[3]]) {
+			spans = append(spans, Span{Start: match[0], End: match[1]})
+		}
+	}
+	for i, target := range in.URLs {
+		if u, err := url.Parse(target); err == nil && r.blocked(u.Hostname()) {
+			urls = append(urls, i)
+		}
+	}
+	if len(spans) == 0 && len(urls) == 0 {
+		return Result{}, nil
+	}
+	return Result{Action: r.action, Reason: "link to a blocked domain", Spans: spans, URLs: urls}, nil
+}
+
+func (r *DomainRule) blocked(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range r.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// RepeatRule catches a sender posting the same text again and again. A
+// message matches when Threshold earlier messages within Window have the
+// same text, ignoring case and whitespace.
+type RepeatRule struct {
+	name      string
+	action    Action
+	window    time.Duration
+	threshold int
+}
+
+func NewRepeatRule(name string, action Action, window time.Duration, threshold int) *RepeatRule {
+	return &RepeatRule{name: name, action: action, window: window, threshold: threshold}
+}
+
+func (r *RepeatRule) Name() string { return r.name }
+
+func (r *RepeatRule) Check(ctx context.Context, in *Input) (Result, error) {
+	body := normalize(in.Body)
+	if body == "" || in.History == nil {
+		return Result{}, nil
+	}
+	// only the newest messages can push the count over the threshold
+	recent, err := in.History.RecentBodies(in.SenderID, time.Now().Add(-r.window), r.threshold*4)
+	if err != nil {
+		return Result{}, err
+	}
+	repeats := 0
+	for _, previous := range recent {
+		if normalize(previous) == body {
+			repeats++
+		}
+	}
+	if repeats < r.threshold {
+		return Result{}, nil
+	}
+	return Result{Action: r.action, Reason: "repeated message", Spans: []Span{{Start: 0, End: len(in.Body)}}}, nil
+}
+
+func normalize(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
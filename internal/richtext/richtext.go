@@ -0,0 +1,379 @@
+// Package richtext turns the Markdown subset accepted by the send endpoint
+// into plain text plus entity spans, so every client renders formatting the
+// same way. Offsets and lengths are counted in UTF-16 code units, which is
+// what JavaScript string indices use.
+//
+// Supported syntax: **bold**, *italic* or _italic_, `code`, ```lang
+// code blocks```, [text](url) and ||spoiler||. A backslash escapes the next
+// punctuation character.
+package richtext
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+)
+
+const (
+	TypeBold    = "bold"
+	TypeItalic  = "italic"
+	TypeCode    = "code"
+	TypePre     = "pre"
+	TypeLink    = "link"
+	TypeSpoiler = "spoiler"
+)
+
+// MaxEntities bounds the work clients do to render a single message
+const MaxEntities = 100
+
+var (
+	ErrMalformed  = errors.New("malformed formatting")
+	ErrUnsafeLink = errors.New("unsafe link")
+)
+
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+type Entity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// maxPasses bounds the reparsing of text whose markers keep turning out to
+// be unmatched, such text is kept without formatting
+const maxPasses = 4
+
+type openMarker struct {
+	kind   string
+	marker string
+	offset int
+	// position of the marker in src
+	pos int
+}
+
+type parser struct {
+	src      []rune
+	pos      int
+	out      strings.Builder
+	offset   int
+	stack    []openMarker
+	entities []Entity
+	// source positions of markers to keep as plain text, reparse is set
+	// when this pass added some
+	literal map[int]bool
+	reparse bool
+}
+
+// Parse converts markdown into plain text and its entities. Markers without
+// a partner, or crossing another span, stay in the text as typed, like
+// CommonMark does. Links with a scheme other than http, https or mailto
+// return ErrUnsafeLink.
+func Parse(markdown string) (string, []Entity, error) {
+	src := []rune(markdown)
+	literal := map[int]bool{}
+	var p *parser
+	for pass := 0; ; pass++ {
+		if pass == maxPasses {
+			return markdown, nil, nil
+		}
+		p = &parser{src: src, literal: literal}
+		if err := p.parse(); err != nil {
+			return "", nil, err
+		}
+		if !p.reparse {
+			break
+		}
+	}
+	if len(p.entities) > MaxEntities {
+		return "", nil, fmt.Errorf("%w: more than %d entities", ErrMalformed, MaxEntities)
+	}
+	// outer spans first when several start at the same offset
+	sort.SliceStable(p.entities, func(i, j int) bool {
+		if p.entities[i].Offset != p.entities[j].Offset {
+			return p.entities[i].Offset < p.entities[j].Offset
+		}
+		return p.entities[i].Length > p.entities[j].Length
+	})
+	return p.out.String(), p.entities, nil
+}
+
+func (p *parser) parse() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\\' && p.pos+1 < len(p.src) && isEscapable(p.src[p.pos+1]):
+			p.emit(p.src[p.pos+1])
+			p.pos += 2
+		case p.hasPrefix("```"):
+			p.codeBlock()
+		case c == '`':
+			p.inlineCode()
+		case p.hasPrefix("**"):
+			p.emphasis(TypeBold, "**")
+		case p.hasPrefix("||"):
+			p.emphasis(TypeSpoiler, "||")
+		case c == '*':
+			p.emphasis(TypeItalic, "*")
+		case c == '_' && !p.intraword():
+			p.emphasis(TypeItalic, "_")
+		case c == '[' && !p.literal[p.pos] && p.linkAhead():
+			p.stack = append(p.stack, openMarker{kind: TypeLink, marker: "[", offset: p.offset, pos: p.pos})
+			p.pos++
+		case c == ']' && p.top() != nil && p.top().kind == TypeLink:
+			if err := p.closeLink(); err != nil {
+				return err
+			}
+		default:
+			p.emit(c)
+			p.pos++
+		}
+	}
+	p.markLiteral(p.stack)
+	return nil
+}
+
+// markLiteral keeps the markers of unmatched spans as text on the next pass
+func (p *parser) markLiteral(unmatched []openMarker) {
+	for _, open := range unmatched {
+		p.literal[open.pos] = true
+		p.reparse = true
+	}
+}
+
+// emphasis opens or closes a span delimited by marker on both sides
+func (p *parser) emphasis(kind, marker string) {
+	n := len([]rune(marker))
+	closing := p.pos > 0 && !unicode.IsSpace(p.src[p.pos-1])
+	if top := p.top(); top != nil && closing {
+		switch {
+		case top.marker == marker:
+			p.pos += n
+			p.closeTop(Entity{Type: kind})
+			return
+		case top.marker == "*" && marker == "**" && p.isOpen("**"):
+			// in ***x*** the inner italic closes first
+			p.pos++
+			p.closeTop(Entity{Type: TypeItalic})
+			return
+		}
+	}
+	if p.literal[p.pos] {
+		p.literalMarker(marker)
+		return
+	}
+	for i, open := range p.stack {
+		if open.marker == marker && closing {
+			// the spans cross, the ones opened inside this one lose their markers
+			p.markLiteral(p.stack[i+1:])
+			p.stack = p.stack[:i+1]
+			p.pos += n
+			p.closeTop(Entity{Type: kind})
+			return
+		}
+	}
+	next := p.pos + n
+	if next >= len(p.src) || unicode.IsSpace(p.src[next]) {
+		// a lone marker followed by a space is literal text
+		p.literalMarker(marker)
+		return
+	}
+	p.stack = append(p.stack, openMarker{kind: kind, marker: marker, offset: p.offset, pos: p.pos})
+	p.pos = next
+}
+
+func (p *parser) literalMarker(marker string) {
+	for _, r := range marker {
+		p.emit(r)
+	}
+	p.pos += len([]rune(marker))
+}
+
+func (p *parser) inlineCode() {
+	end := p.find("`", p.pos+1)
+	if end < 0 {
+		p.literalMarker("`")
+		return
+	}
+	start := p.offset
+	for _, r := range p.src[p.pos+1 : end] {
+		p.emit(r)
+	}
+	p.addEntity(Entity{Type: TypeCode, Offset: start, Length: p.offset - start})
+	p.pos = end + 1
+}
+
+func (p *parser) codeBlock() {
+	contentStart := p.pos + 3
+	end := p.find("```", contentStart)
+	if end < 0 {
+		p.literalMarker("```")
+		return
+	}
+	content := p.src[contentStart:end]
+
+	// an identifier on the opening line names the language
+	language := ""
+	if nl := indexRune(content, '\n'); nl >= 0 && isLanguage(content[:nl]) {
+		language = string(content[:nl])
+		content = content[nl+1:]
+	}
+	if len(content) > 0 && content[len(content)-1] == '\n' {
+		content = content[:len(content)-1]
+	}
+
+	start := p.offset
+	for _, r := range content {
+		p.emit(r)
+	}
+	p.addEntity(Entity{Type: TypePre, Offset: start, Length: p.offset - start, Language: language})
+	p.pos = end + 3
+}
+
+func (p *parser) closeLink() error {
+	end := -1
+	if p.pos+1 < len(p.src) && p.src[p.pos+1] == '(' {
+		end = p.find(")", p.pos+2)
+	}
+	if end < 0 {
+		// [text] without a (target) is plain text
+		p.markLiteral(p.stack[len(p.stack)-1:])
+		p.stack = p.stack[:len(p.stack)-1]
+		p.emit(']')
+		p.pos++
+		return nil
+	}
+	target, err := validateURL(string(p.src[p.pos+2 : end]))
+	if err != nil {
+		return err
+	}
+	p.pos = end + 1
+	p.closeTop(Entity{Type: TypeLink, URL: target})
+	return nil
+}
+
+func (p *parser) closeTop(e Entity) {
+	open := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	e.Offset = open.offset
+	e.Length = p.offset - open.offset
+	p.addEntity(e)
+}
+
+func (p *parser) addEntity(e Entity) {
+	// empty spans carry no formatting
+	if e.Length > 0 {
+		p.entities = append(p.entities, e)
+	}
+}
+
+func (p *parser) emit(r rune) {
+	p.out.WriteRune(r)
+	p.offset += len(utf16.Encode([]rune{r}))
+}
+
+func (p *parser) isOpen(marker string) bool {
+	for _, open := range p.stack {
+		if open.marker == marker {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) top() *openMarker {
+	if len(p.stack) == 0 {
+		return nil
+	}
+	return &p.stack[len(p.stack)-1]
+}
+
+func (p *parser) hasPrefix(s string) bool {
+	r := []rune(s)
+	if p.pos+len(r) > len(p.src) {
+		return false
+	}
+	return string(p.src[p.pos:p.pos+len(r)]) == s
+}
+
+func (p *parser) find(s string, from int) int {
+	r := []rune(s)
+	for i := from; i+len(r) <= len(p.src); i++ {
+		if string(p.src[i:i+len(r)]) == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// intraword reports whether an underscore sits inside a word like snake_case
+func (p *parser) intraword() bool {
+	if p.pos == 0 || p.pos+1 >= len(p.src) {
+		return false
+	}
+	return isWordRune(p.src[p.pos-1]) && isWordRune(p.src[p.pos+1])
+}
+
+// linkAhead reports whether the [ at pos is followed by ]( on the same line
+func (p *parser) linkAhead() bool {
+	for i := p.pos + 1; i+1 < len(p.src) && p.src[i] != '\n'; i++ {
+		if p.src[i] == ']' {
+			return p.src[i+1] == '('
+		}
+	}
+	return false
+}
+
+func validateURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	for _, r := range raw {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return "", fmt.Errorf("%w: invalid characters in link", ErrUnsafeLink)
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnsafeLink, err)
+	}
+	if !allowedSchemes[strings.ToLower(u.Scheme)] {
+		return "", fmt.Errorf("%w: links must use http, https or mailto", ErrUnsafeLink)
+	}
+	if u.Scheme != "mailto" && u.Host == "" {
+		return "", fmt.Errorf("%w: link has no host", ErrUnsafeLink)
+	}
+	return u.String(), nil
+}
+
+func isEscapable(r rune) bool {
+	return strings.ContainsRune("\\`*_[]()|~>#+-.!", r)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isLanguage(r []rune) bool {
+	if len(r) == 0 || len(r) > 32 {
+		return false
+	}
+	for _, c := range r {
+		if !isWordRune(c) && c != '_' && c != '+' && c != '-' && c != '#' {
+			return false
+		}
+	}
+	return true
+}
+
+func indexRune(r []rune, c rune) int {
+	for i, x := range r {
+		if x == c {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,132 @@
+package richtext
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		text     string
+		entities []Entity
+	}{
+		{"plain", "hello world", "hello world", nil},
+		{"bold", "a **b** c", "a b c", []Entity{{Type: TypeBold, Offset: 2, Length: 1}}},
+		{"italic star", "*a*", "a", []Entity{{Type: TypeItalic, Offset: 0, Length: 1}}},
+		{"italic underscore", "_a b_", "a b", []Entity{{Type: TypeItalic, Offset: 0, Length: 3}}},
+		{"spoiler", "||x||", "x", []Entity{{Type: TypeSpoiler, Offset: 0, Length: 1}}},
+		{"code", "run `ls -l` now", "run ls -l now", []Entity{{Type: TypeCode, Offset: 4, Length: 5}}},
+		{"code keeps markers", "`**x**`", "**x**", []Entity{{Type: TypeCode, Offset: 0, Length: 5}}},
+		{
+			"code block with language", "```go\nfmt.Println()\n```", "fmt.Println()",
+			[]Entity{{Type: TypePre, Offset: 0, Length: 13, Language: "go"}},
+		},
+		{
+			"link", "see [docs](https://example.com/a?b=c)", "see docs",
+			[]Entity{{Type: TypeLink, Offset: 4, Length: 4, URL: "https://example.com/a?b=c"}},
+		},
+		{
+			"mailto link", "[mail](mailto:a@example.com)", "mail",
+			[]Entity{{Type: TypeLink, Offset: 0, Length: 4, URL: "mailto:a@example.com"}},
+		},
+		{
+			"nested", "**a *b* c**", "a b c",
+			[]Entity{{Type: TypeBold, Offset: 0, Length: 5}, {Type: TypeItalic, Offset: 2, Length: 1}},
+		},
+		{
+			"bold inside italic", "*a**b** c*", "ab c",
+			[]Entity{{Type: TypeItalic, Offset: 0, Length: 4}, {Type: TypeBold, Offset: 1, Length: 1}},
+		},
+		{
+			"bold italic", "***x***", "x",
+			[]Entity{{Type: TypeItalic, Offset: 0, Length: 1}, {Type: TypeBold, Offset: 0, Length: 1}},
+		},
+		{"escape", `\*not italic\*`, "*not italic*", nil},
+		{"empty span", "****", "", nil},
+
+		// unmatched markers stay as typed
+		{"multiplication", "2*3=6", "2*3=6", nil},
+		{"product", "a*b", "a*b", nil},
+		{"underscore in url", "https://example.com/_a", "https://example.com/_a", nil},
+		{"snake case", "snake_case_name", "snake_case_name", nil},
+		{"spaced star", "a * b * c", "a * b * c", nil},
+		{"unclosed bold", "**bold", "**bold", nil},
+		{"unclosed spoiler", "||x", "||x", nil},
+		{"unclosed code", "`code", "`code", nil},
+		{"unclosed code block", "```go\nx", "```go\nx", nil},
+		{"brackets without target", "[a] and [b]", "[a] and [b]", nil},
+		{"unclosed link target", "[a](https://example.com", "[a](https://example.com", nil},
+		{
+			"unmatched before a span", "2*3 is **six**", "2*3 is six",
+			[]Entity{{Type: TypeBold, Offset: 7, Length: 3}},
+		},
+		{
+			"crossing spans", "**a ||b** c||", "a ||b c||",
+			[]Entity{{Type: TypeBold, Offset: 0, Length: 5}},
+		},
+		{
+			"crossing italic", "*a **b* c**", "a **b c**",
+			[]Entity{{Type: TypeItalic, Offset: 0, Length: 5}},
+		},
+
+		// offsets count UTF-16 code units
+		{"astral before", "😀 **bold**", "😀 bold", []Entity{{Type: TypeBold, Offset: 3, Length: 4}}},
+		{"astral inside", "**😀👍**x", "😀👍x", []Entity{{Type: TypeBold, Offset: 0, Length: 4}}},
+		{"bmp only", "é **ü**", "é ü", []Entity{{Type: TypeBold, Offset: 2, Length: 1}}},
+		{
+			"astral link", "🎉[𝒳](https://example.com)", "🎉𝒳",
+			[]Entity{{Type: TypeLink, Offset: 2, Length: 2, URL: "https://example.com"}},
+		},
+		{
+			"astral after literal", "𝟙*𝟚 *x*", "𝟙*𝟚 x",
+			[]Entity{{Type: TypeItalic, Offset: 6, Length: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, entities, err := Parse(tt.markdown)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.markdown, err)
+			}
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if len(entities) == 0 && len(tt.entities) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(entities, tt.entities) {
+				t.Errorf("entities = %+v, want %+v", entities, tt.entities)
+			}
+		})
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		err      error
+	}{
+		{"javascript", "[x](javascript:alert(1))", ErrUnsafeLink},
+		{"javascript mixed case", "[x](JaVaScRiPt:alert)", ErrUnsafeLink},
+		{"javascript with spaces", "[x]( javascript:alert)", ErrUnsafeLink},
+		{"data", "[x](data:text/html,hi)", ErrUnsafeLink},
+		{"vbscript", "[x](vbscript:msgbox)", ErrUnsafeLink},
+		{"relative", "[x](/path)", ErrUnsafeLink},
+		{"no host", "[x](https:///path)", ErrUnsafeLink},
+		{"control character", "[x](https://exa\tmple.com)", ErrUnsafeLink},
+		{"too many entities", strings.Repeat("*a* ", MaxEntities+1), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Parse(tt.markdown)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Parse(%q) error = %v, want %v", tt.markdown, err, tt.err)
+			}
+		})
+	}
+}
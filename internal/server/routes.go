@@ -2,6 +2,8 @@ package server
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 
@@ -20,14 +22,149 @@ func (s *Server) Handlers() *mux.Router {
 	router.Handle("/api/auth/me", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleMe))).
 		Methods("GET")
 
+	router.Handle("/api/user/search", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSearchUsers))).
+		Methods("GET")
+	router.Handle("/api/user/blocked", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetBlockedUsers))).
+		Methods("GET")
+	router.Handle("/api/user/{id}/block", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleBlockUser))).
+		Methods("POST")
+	router.Handle("/api/user/{id}/block", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUnblockUser))).
+		Methods("DELETE")
+	router.Handle("/api/user/privacy", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSetPrivacy))).
+		Methods("PUT")
+
+	router.Handle("/api/contacts", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetContacts))).
+		Methods("GET")
+	router.Handle("/api/contacts/requests", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetContactRequests))).
+		Methods("GET")
+	router.Handle("/api/contacts/requests", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSendContactRequest))).
+		Methods("POST")
+	router.Handle("/api/contacts/requests/{id}/accept", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleAcceptContactRequest))).
+		Methods("POST")
+	router.Handle("/api/contacts/requests/{id}/decline", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleDeclineContactRequest))).
+		Methods("POST")
+	router.Handle("/api/contacts/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleRemoveContact))).
+		Methods("DELETE")
+
+	router.Handle("/api/message/requests", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetMessageRequests))).
+		Methods("GET")
+	router.Handle("/api/message/requests/{id}/accept", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleAcceptMessageRequest))).
+		Methods("POST")
+	router.Handle("/api/message/requests/{id}/decline", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleDeclineMessageRequest))).
+		Methods("POST")
+
 	router.Handle("/api/message/conversations", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetUserForSidebar))).
 		Methods("GET")
 
 	router.Handle("/api/message/send/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSendMessage))).
 		Methods("POST")
 
+	router.Handle("/api/message/forward", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleForwardMessages))).
+		Methods("POST")
+	router.Handle("/api/message/mentions", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetMentions))).
+		Methods("GET")
+	router.Handle("/api/message/starred", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetStarredMessages))).
+		Methods("GET")
+	router.Handle("/api/message/{id}/star", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleStarMessage))).
+		Methods("POST")
+	router.Handle("/api/message/{id}/star", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUnstarMessage))).
+		Methods("DELETE")
+	router.Handle("/api/message/scheduled", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetScheduledMessages))).
+		Methods("GET")
+	router.Handle("/api/message/scheduled/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUpdateScheduledMessage))).
+		Methods("PUT")
+	router.Handle("/api/message/scheduled/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleCancelScheduledMessage))).
+		Methods("DELETE")
+
+	router.Handle("/api/import", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleImportChat))).
+		Methods("POST")
+	router.Handle("/api/import/claims", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetImportClaims))).
+		Methods("GET")
+	router.Handle("/api/import/claims/{id}/confirm", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleConfirmImportClaim))).
+		Methods("POST")
+	router.Handle("/api/import/claims/{id}/decline", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleDeclineImportClaim))).
+		Methods("POST")
+	router.Handle("/api/sync", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSync))).
+		Methods("POST")
+
 	router.Handle("/api/message/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetMessage))).
 		Methods("GET")
+	router.Handle("/api/moderation/flags", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetModerationFlags))).
+		Methods("GET")
+	router.Handle("/api/moderation/flags/{id}/review", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleReviewModerationFlag))).
+		Methods("POST")
+	router.Handle("/api/poll/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetPoll))).
+		Methods("GET")
+	router.Handle("/api/poll/{id}/vote", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleVotePoll))).
+		Methods("POST")
+	router.Handle("/api/poll/{id}/close", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleClosePoll))).
+		Methods("POST")
+	router.Handle("/api/attachment/upload", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUploadAttachment))).
+		Methods("POST")
+	router.Handle("/api/attachment/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetAttachment))).
+		Methods("GET")
+	router.Handle("/api/attachment/{id}/thumbnail/{size}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetAttachment))).
+		Methods("GET")
+	router.Handle("/api/conversation/drafts", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetDrafts))).
+		Methods("GET")
+	router.Handle("/api/conversation/group", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleCreateGroup))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetConversation))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUpdateGroup))).
+		Methods("PATCH")
+	router.Handle("/api/conversation/{id}/messages", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetConversationMessages))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/messages", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSendToConversation))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/members", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleAddGroupMembers))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/members/{userId}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleRemoveGroupMember))).
+		Methods("DELETE")
+	router.Handle("/api/conversation/{id}/members/{userId}/role", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSetMemberRole))).
+		Methods("PUT")
+	router.Handle("/api/conversation/{id}/owner", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleTransferGroupOwnership))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/leave", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleLeaveGroup))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/invites", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleCreateInvite))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/invites", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetInvites))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/invites/{inviteId}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleRevokeInvite))).
+		Methods("DELETE")
+	router.Handle("/api/conversation/{id}/join-requests", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetJoinRequests))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/join-requests/{requestId}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleReviewJoinRequest))).
+		Methods("POST")
+	router.Handle("/api/invite/{id}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handlePreviewInvite))).
+		Methods("GET")
+	router.Handle("/api/invite/{id}/join", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleJoinByInvite))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/settings", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetConversationSettings))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/settings", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUpdateConversationSettings))).
+		Methods("PUT")
+	router.Handle("/api/conversation/{id}/draft", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetDraft))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/draft", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSetDraft))).
+		Methods("PUT")
+	router.Handle("/api/conversation/{id}/draft", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleClearDraft))).
+		Methods("DELETE")
+	router.Handle("/api/conversation/{id}/export", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleExportConversation))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/nudge", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleNudge))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/polls", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleCreatePoll))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/disappearing", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleSetDisappearingTimer))).
+		Methods("PUT")
+	router.Handle("/api/conversation/{id}/pins", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleGetPinnedMessages))).
+		Methods("GET")
+	router.Handle("/api/conversation/{id}/pins/{messageId}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handlePinMessage))).
+		Methods("POST")
+	router.Handle("/api/conversation/{id}/pins/{messageId}", middleware.AuthMiddleware(utils.MakeHTTPHandleFunc(s.handleUnpinMessage))).
+		Methods("DELETE")
 	router.HandleFunc("/ws", s.handleWS)
 	return router
 }
@@ -92,6 +229,9 @@ func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) error
 	if err != nil {
 		return err
 	}
+	if message.ClientID == "" {
+		message.ClientID = r.Header.Get("Idempotency-Key")
+	}
 	err = s.messages.SendMessage(message, senderID, receiverID, w)
 	if err != nil {
 		return err
@@ -111,22 +251,557 @@ func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleForwardMessages(w http.ResponseWriter, r *http.Request) error {
+	_, senderID := getID(r)
+	req, err := database.DecodeForwardRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.ForwardMessages(req, senderID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetMentions(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	before, limit, err := getPage(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.GetMentions(userID, before, limit, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	req, err := database.DecodeSyncRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.Sync(req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleExportConversation(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	opts, err := database.DecodeExportOptions(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.ExportConversation(conversationID, userID, *opts, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleNudge(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.Nudge(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleCreatePoll(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	req, err := database.DecodePollRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.CreatePoll(conversationID, req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetModerationFlags(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	before, limit, err := getPage(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.GetModerationFlags(userID, r.URL.Query().Get("status"), before, limit, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleReviewModerationFlag(w http.ResponseWriter, r *http.Request) error {
+	flagID, userID := getID(r)
+	review, err := database.DecodeFlagReview(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.ReviewModerationFlag(flagID, review, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetPoll(w http.ResponseWriter, r *http.Request) error {
+	pollID, userID := getID(r)
+	return s.messages.GetPoll(pollID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleVotePoll(w http.ResponseWriter, r *http.Request) error {
+	pollID, userID := getID(r)
+	req, err := database.DecodePollVote(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.VotePoll(pollID, req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleClosePoll(w http.ResponseWriter, r *http.Request) error {
+	pollID, userID := getID(r)
+	return s.messages.ClosePoll(pollID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetStarredMessages(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	before, limit, err := getPage(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.GetStarredMessages(userID, before, limit, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleStarMessage(w http.ResponseWriter, r *http.Request) error {
+	messageID, userID := getID(r)
+	return s.messages.StarMessage(messageID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUnstarMessage(w http.ResponseWriter, r *http.Request) error {
+	messageID, userID := getID(r)
+	return s.messages.UnstarMessage(messageID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetScheduledMessages(w http.ResponseWriter, r *http.Request) error {
+	_, senderID := getID(r)
+	return s.messages.GetScheduledMessages(senderID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUpdateScheduledMessage(w http.ResponseWriter, r *http.Request) error {
+	scheduledID, senderID := getID(r)
+	message, err := database.DecodeMessage(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.UpdateScheduledMessage(scheduledID, senderID, message, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleCancelScheduledMessage(w http.ResponseWriter, r *http.Request) error {
+	scheduledID, senderID := getID(r)
+	return s.messages.CancelScheduledMessage(scheduledID, senderID, w)
+}
+
 // ////////////////////////////////////////////////////////////////////////////////////
 func (s *Server) handleGetUserForSidebar(w http.ResponseWriter, r *http.Request) error {
 	_, authUser := getID(r)
-	err := s.messages.GetUserForSidebar(authUser, w)
+	err := s.messages.GetUserForSidebar(authUser, r.URL.Query().Get("archived") == "true", w)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUploadAttachment(w http.ResponseWriter, r *http.Request) error {
+	uploaderID := r.Context().Value("id").(string)
+	r.Body = http.MaxBytesReader(w, r.Body, database.MaxUploadSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.messages.UploadAttachment(file, header.Filename, uploaderID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleImportChat(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	r.Body = http.MaxBytesReader(w, r.Body, database.MaxImportSize+1<<20)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	opts, err := database.DecodeImportOptions(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.ImportChat(file, *opts, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetImportClaims(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	return s.messages.GetImportClaims(userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleConfirmImportClaim(w http.ResponseWriter, r *http.Request) error {
+	claimID, userID := getID(r)
+	return s.messages.AnswerImportClaim(claimID, true, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleDeclineImportClaim(w http.ResponseWriter, r *http.Request) error {
+	claimID, userID := getID(r)
+	return s.messages.AnswerImportClaim(claimID, false, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) error {
+	attachmentID, userID := getID(r)
+	return s.messages.ServeAttachment(attachmentID, mux.Vars(r)["size"], userID, w, r)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetDrafts(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	return s.messages.GetDrafts(userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetDraft(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetDraft(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSetDraft(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	draft, err := database.DecodeDraft(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.SetDraft(conversationID, userID, r.Header.Get("X-Socket-Id"), draft, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleClearDraft(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	draft := &database.DraftPlain{}
+	if value := r.URL.Query().Get("updatedAt"); value != "" {
+		updatedAt, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return err
+		}
+		draft.UpdatedAt = updatedAt
+	}
+	return s.messages.SetDraft(conversationID, userID, r.Header.Get("X-Socket-Id"), draft, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSetDisappearingTimer(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	settings, err := database.DecodeDisappearingSettings(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.SetDisappearingTimer(conversationID, userID, settings.Seconds, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handlePinMessage(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.PinMessage(conversationID, mux.Vars(r)["messageId"], userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUnpinMessage(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.UnpinMessage(conversationID, mux.Vars(r)["messageId"], userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetPinnedMessages(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetPinnedMessages(conversationID, userID, w)
+}
+
 func getID(r *http.Request) (string, string) {
 	userToChatID := mux.Vars(r)["id"]
 	senderID := r.Context().Value("id").(string)
 	return userToChatID, senderID
 }
 
+// getPage reads the optional before (RFC 3339) and limit query parameters
+func getPage(r *http.Request) (*time.Time, int, error) {
+	var before *time.Time
+	if value := r.URL.Query().Get("before"); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, 0, err
+		}
+		before = &t
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, 0, err
+		}
+		limit = n
+	}
+	return before, limit, nil
+}
+
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	database.HandleWebSocket(w, r)
 }
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleCreateGroup(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	group, err := database.DecodeGroup(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.CreateGroup(group, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetConversation(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetConversation(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUpdateGroup(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	group, err := database.DecodeGroup(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.UpdateGroup(conversationID, group, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetConversationMessages(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetConversationMessages(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSendToConversation(w http.ResponseWriter, r *http.Request) error {
+	conversationID, senderID := getID(r)
+	message, err := database.DecodeMessage(r)
+	if err != nil {
+		return err
+	}
+	if message.ClientID == "" {
+		message.ClientID = r.Header.Get("Idempotency-Key")
+	}
+	return s.messages.SendToConversation(conversationID, message, senderID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleAddGroupMembers(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	req, err := database.DecodeMembersRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.AddGroupMembers(conversationID, req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleRemoveGroupMember(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.RemoveGroupMember(conversationID, mux.Vars(r)["userId"], userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSetMemberRole(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	req, err := database.DecodeRoleRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.SetMemberRole(conversationID, mux.Vars(r)["userId"], req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleTransferGroupOwnership(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	req, err := database.DecodeOwnershipRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.TransferGroupOwnership(conversationID, req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleLeaveGroup(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.LeaveGroup(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	req, err := database.DecodeInviteRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.CreateInvite(conversationID, req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetInvites(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetInvites(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleRevokeInvite(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.RevokeInvite(conversationID, mux.Vars(r)["inviteId"], userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetJoinRequests(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetJoinRequests(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleReviewJoinRequest(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	decision, err := database.DecodeJoinDecision(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.ReviewJoinRequest(conversationID, mux.Vars(r)["requestId"], decision, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handlePreviewInvite(w http.ResponseWriter, r *http.Request) error {
+	code, userID := getID(r)
+	return s.messages.PreviewInvite(code, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleJoinByInvite(w http.ResponseWriter, r *http.Request) error {
+	code, userID := getID(r)
+	return s.messages.JoinByInvite(code, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetConversationSettings(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.GetConversationSettings(conversationID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUpdateConversationSettings(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	req, err := database.DecodeConversationSettings(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.UpdateConversationSettings(conversationID, userID, r.Header.Get("X-Socket-Id"), req, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleBlockUser(w http.ResponseWriter, r *http.Request) error {
+	blockedID, userID := getID(r)
+	return s.messages.BlockUser(blockedID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleUnblockUser(w http.ResponseWriter, r *http.Request) error {
+	blockedID, userID := getID(r)
+	return s.messages.UnblockUser(blockedID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetBlockedUsers(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	return s.messages.GetBlockedUsers(userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSetPrivacy(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	settings, err := database.DecodePrivacySettings(r)
+	if err != nil {
+		return err
+	}
+	return s.user.SetPrivacy(userID, settings, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetContacts(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	return s.messages.GetContacts(userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleRemoveContact(w http.ResponseWriter, r *http.Request) error {
+	contactID, userID := getID(r)
+	return s.messages.RemoveContact(contactID, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetContactRequests(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	return s.messages.GetContactRequests(userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSendContactRequest(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	req, err := database.DecodeContactRequest(r)
+	if err != nil {
+		return err
+	}
+	return s.messages.SendContactRequest(req, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleAcceptContactRequest(w http.ResponseWriter, r *http.Request) error {
+	requestID, userID := getID(r)
+	return s.messages.AnswerContactRequest(requestID, true, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleDeclineContactRequest(w http.ResponseWriter, r *http.Request) error {
+	requestID, userID := getID(r)
+	return s.messages.AnswerContactRequest(requestID, false, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleGetMessageRequests(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	return s.messages.GetMessageRequests(userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleAcceptMessageRequest(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.AnswerMessageRequest(conversationID, true, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleDeclineMessageRequest(w http.ResponseWriter, r *http.Request) error {
+	conversationID, userID := getID(r)
+	return s.messages.AnswerMessageRequest(conversationID, false, userID, w)
+}
+
+// ////////////////////////////////////////////////////////////////////////////////////
+func (s *Server) handleSearchUsers(w http.ResponseWriter, r *http.Request) error {
+	_, userID := getID(r)
+	_, limit, err := getPage(r)
+	if err != nil {
+		return err
+	}
+	offset := 0
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+	}
+	return s.user.SearchUsers(userID, r.URL.Query().Get("q"), offset, limit, w)
+}